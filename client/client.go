@@ -34,201 +34,146 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package client
 
 import (
-	"../core/crypto/auth"
+	"../core/crypto"
 	"../core/db"
-	"../external"
 	"../logger"
+	"../sync/peer"
 	"../sync/protocol"
-	"crypto/rsa"
 	"errors"
 	"fmt"
-	"net"
 	"sync"
 	"time"
 )
 
-type OnionConnection struct {
-	*net.TCPConn
-	Onion       string
-	Established bool
+// time after which a peer that did not understand HELLO is asked again
+const LEGACY_PEER_RECHECK = time.Hour
+
+// peers which dropped the connection on HELLO, they run a syncerd from
+// before the handshake existed. Peers which answered HELLO once are never
+// taken for legacy ones again, that would give up the secure channel.
+var legacyPeers = struct {
+	sync.Mutex
+	since map[string]time.Time
+	hello map[string]bool
+}{since: map[string]time.Time{}, hello: map[string]bool{}}
+
+func isLegacyPeer(onion string) bool {
+	legacyPeers.Lock()
+	defer legacyPeers.Unlock()
+	since, ok := legacyPeers.since[onion]
+	if ok && time.Since(since) > LEGACY_PEER_RECHECK {
+		delete(legacyPeers.since, onion)
+		return false
+	}
+	return ok
 }
 
-func ConnectToOnion(onion string) (OnionConnection, error) {
-	// step 1: connect to TOR proxy
-	laddr, _ := net.ResolveTCPAddr("tcp", "localhost")
-	raddr, _ := net.ResolveTCPAddr("tcp", "localhost:9050")
-	conn, err := net.DialTCP("tcp", laddr, raddr)
-	//	_ = conn.SetDeadline(time.Now().Add(time.Second*5))
-	if err != nil {
-		return OnionConnection{conn, onion, false}, err
+// false if onion answered HELLO before
+func markLegacyPeer(onion string) bool {
+	legacyPeers.Lock()
+	defer legacyPeers.Unlock()
+	if legacyPeers.hello[onion] {
+		return false
 	}
-	// step 2: tell TOR proxy to connect to onion address
-	err = socks.Connect(conn, onion)
-	if err != nil {
-		conn.Close()
-		return OnionConnection{conn, onion, false}, err
-	}
-	// success
-	return OnionConnection{conn, onion, true}, nil
+	legacyPeers.since[onion] = time.Now()
+	return true
 }
 
-func (conn OnionConnection) Auth(key *rsa.PrivateKey) error {
-	// 1. send auth request
-	//logger.Debug("...sending auth request")
-	pkg := protocol.EncodeAuth(key.PublicKey)
-	conn.Write(pkg)
-
-	// 2 read and check challenge
-	//logger.Debug("...waiting for challenge")
-	header, err := protocol.ReadHeader(conn)
-	if err != nil {
-		return errors.New("error while reading challenge header: " + err.Error())
-	}
-	if header.PacketType != protocol.CHALLENGE {
-		return errors.New("wrong package type waiting for challenge")
-	}
-	buffer := make([]byte, 16384)
-	_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
-	challenge, err := protocol.DecodeChallenge(buffer[:header.PacketLength])
-	if err != nil {
-		return errors.New("could not decode challenge" + err.Error())
-	}
+func markHelloPeer(onion string) {
+	legacyPeers.Lock()
+	legacyPeers.hello[onion] = true
+	delete(legacyPeers.since, onion)
+	legacyPeers.Unlock()
+}
 
-	// 3 build and send response
-	//logger.Debug("...generating response")
-	response, err := auth.GenerateResponse(challenge,
-		key,
-		conn.Onion)
+func dialOnion(onion string) (peer.OnionConnection, error) {
+	conn, err := DefaultTransport.Dial(onion)
 	if err != nil {
-		return errors.New("could not build resonionsponse: " + err.Error())
-	}
-	//logger.Debug("...sending response")
-	pkg = protocol.EncodeResponse(&response)
-	conn.Write(pkg)
-
-	// 4. await success notification
-	if header, err = protocol.ReadHeader(conn); err != nil {
-		return errors.New("could not receive success notification: " + err.Error())
-	}
-	if header.PacketType != protocol.SUCCESS {
-		return fmt.Errorf("expected success packet, but got %s instead",
-			header.PacketType)
+		return peer.OnionConnection{Onion: onion}, err
 	}
-	return nil
+	// success
+	return peer.NewOnionConnection(conn, onion, []string{}), nil
 }
 
-func (conn OnionConnection) Pull(timestamp int64) ([]db.Post, []db.Profile, error) {
-	posts := []db.Post{}
-	profiles := []db.Profile{}
-
-	//logger.Debug(fmt.Sprint("sending PULL with timestamp ", timestamp))
-	conn.Write(protocol.EncodePull(timestamp))
-
-	// default length of post: 64 Kilobyte, relocation is implemented
-	length := uint32(65536)
-	buffer := make([]byte, length)
-	for {
-		header, err := protocol.ReadHeader(conn)
+// connects to onion and agrees on protocol version and features with HELLO,
+// falls back to the version 0 protocol if the peer closes the connection on
+// it. Any other failure of HELLO is returned, a timeout or a dropped
+// circuit must not downgrade the connection.
+func ConnectToOnion(onion string) (peer.OnionConnection, error) {
+	if !isLegacyPeer(onion) {
+		conn, err := dialOnion(onion)
 		if err != nil {
-			return posts,
-				profiles,
-				errors.New("error while receiving posts: " + err.Error())
+			return conn, err
 		}
-
-		if 16777216 < header.PacketLength { // if payload greater than 16 Megabyte
-			return posts,
-				profiles,
-				errors.New("Received payload is greater than 16 Megabyte")
-		} else if length < header.PacketLength { // relocate buffer if required
-			buffer = nil // garbage collection help
-			length = header.PacketLength
-			buffer = make([]byte, length)
+		err = conn.Hello()
+		if err == nil {
+			markHelloPeer(onion)
+			return conn, nil
+		}
+		conn.Close()
+		if err != peer.ErrHelloRejected || !markLegacyPeer(onion) {
+			return conn, err
 		}
+		logger.Info(fmt.Sprintf("%s does not understand HELLO, using protocol version 0", onion))
+	}
+	return dialOnion(onion)
+}
 
-		if header.PacketType == protocol.SUCCESS {
-			// finished, no more replies
-			return posts, profiles, nil
-		} else if header.PacketType == protocol.PUSH_POST {
+// time between two looks into the outbox for TRIGGERs to retry
+const OUTBOX_INTERVAL = 15 * time.Second
 
-			_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
-			post, err := protocol.DecodePushPost(
-				buffer[:header.PacketLength],
-				conn.Onion)
-			if err != nil {
-				return posts,
-					profiles,
-					errors.New("decode of post failed: " + err.Error())
-			}
-			posts = append(posts, post)
-
-		} else if header.PacketType == protocol.PUSH_PROFILE {
+// queues a TRIGGER to each of onions and sends all due ones
+func TriggerHandling(dbconn *db.SSNDB, onions []db.Onion) {
+	dbconn.QueueTriggers(onions)
+	DeliverTriggers(dbconn)
+}
 
-			_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
-			profile, err := protocol.DecodePushProfile(
-				buffer[:header.PacketLength],
-				conn.Onion)
+// sends the due TRIGGERs of the outbox, at most SyncWorkers at the same
+// time. Failed ones stay in the outbox and are retried later.
+func DeliverTriggers(dbconn *db.SSNDB) {
+	id := dbconn.GetIdentity()
+	slots := make(chan bool, SyncWorkers)
+	var wg sync.WaitGroup
+	for _, delivery := range dbconn.ClaimDueTriggers() {
+		var onion db.Onion
+		dbconn.First(&onion, delivery.OnionId)
+
+		wg.Add(1)
+		slots <- true
+		go func(delivery db.Delivery, onion db.Onion) {
+			err := sendTrigger(id, dbconn, onion)
 			if err != nil {
-				return posts,
-					profiles,
-					errors.New("decode of post failed: " + err.Error())
+				logger.Warning(fmt.Sprintf("could not send a TRIGGER to %s addr, retrying later: %s", onion.Onion, err))
 			}
-			profiles = append(profiles, profile)
-
-		} else {
-			return posts,
-				profiles,
-				fmt.Errorf("expected push post, but got %s\n", header.PacketType)
-		}
+			dbconn.TriggerAttempted(&delivery, err)
+			<-slots
+			wg.Done()
+		}(delivery, onion)
 	}
+	wg.Wait()
 }
 
-func (conn OnionConnection) Trigger() error {
-	//logger.Debug("sending TRIGGER")
-	conn.Write(protocol.EncodeTrigger())
-	header, err := protocol.ReadHeader(conn)
-	if err != nil {
-		return errors.New("error while waiting for SUCCESS: " + err.Error())
-	} else if header.PacketType != protocol.SUCCESS {
-		return errors.New("expected SUCCESS, but got " + string(header.PacketType))
+func sendTrigger(id *crypto.Identity, dbconn *db.SSNDB, onion db.Onion) error {
+	if onion.Id == 0 {
+		return errors.New("onion does not exist anymore")
 	}
-	return nil
-}
-
-func (conn OnionConnection) ContactRequest(cr protocol.ContactRequest) error {
-	//logger.Debug("sending contact request")
-	conn.Write(protocol.EncodeContactRequest(cr))
-	header, err := protocol.ReadHeader(conn)
+	onionconn, err := ConnectAuthenticated(id, dbconn, onion.Onion)
 	if err != nil {
-		return errors.New("error while waiting for SUCCESS message " + err.Error())
-	} else if header.PacketType != protocol.SUCCESS {
-		return errors.New("expected success message but received " + string(header.PacketType))
+		return err
 	}
-	return nil
-}
+	defer onionconn.Close()
 
-func TriggerHandling(dbconn *db.SSNDB, onions []db.Onion) {
-	key := dbconn.GetKey()
-	for _, onion := range onions {
-		onionconn, err := ConnectToOnion(onion.Onion)
-		/*if err != nil {
-		logger.Warning(fmt.Sprintf("could not conect to %s addr (TRIGGER)", onion.Onion))
-		*/
-		if err == nil {
-			err = onionconn.Auth(key)
-			if err != nil {
-				logger.Warning(fmt.Sprintf("authentication fail: to %s addr (TRIGGER)", onion.Onion))
-			} else {
-				err = onionconn.Trigger()
-				if err != nil {
-					logger.Warning(fmt.Sprintf("could not send a TRIGGER to %s addr", onion.Onion))
-				}
-			}
-			onionconn.Close()
+	if onionconn.Supports(protocol.FEATURE_PUSH) {
+		if contact := dbconn.GetContactByOnion(onion.Onion); contact != nil {
+			return onionconn.Push(dbconn, contact)
 		}
 	}
+	return onionconn.Trigger()
 }
 
-func ContactRequestHandling(contact *db.Contact, myOnion *db.Onion) error {
+// sends our contact request to contact, signed by id if we have a key for
+// myOnion
+func ContactRequestHandling(contact *db.Contact, myOnion *db.Onion, id *crypto.Identity) error {
 	if contact == nil {
 		return errors.New("nil argument")
 	}
@@ -244,164 +189,130 @@ func ContactRequestHandling(contact *db.Contact, myOnion *db.Onion) error {
 		Message: contact.RequestMessage,
 		Onion:   myOnion.Onion,
 	}
+	if id != nil && id.Onion() == myOnion.Onion {
+		err = cr.Sign(id, contact.Onion.Onion)
+		if logger.ConditionalWarning(err, "could not sign contact request") {
+			return err
+		}
+	}
+	work, err := onionconn.ContactRequestWork()
+	if err != nil {
+		return err
+	}
+	cr.SolveWork(work)
 
+	if err = onionconn.Secure(); err != nil {
+		return err
+	}
 	return onionconn.ContactRequest(cr)
 }
 
-func PullHandling(dbconn *db.SSNDB, lastActivity int64, contact *db.Contact, key *rsa.PrivateKey) ([]db.Post, []db.Profile, error) {
-	posts := []db.Post{}
-	profiles := []db.Profile{}
-	if contact == nil || key == nil {
-		return posts, profiles, errors.New("nil argument")
+// sends our decision on the contact request of contact. Peers without
+// FEATURE_RESPONSE learn about an acceptance on our next AUTH only.
+func ContactResponseHandling(contact *db.Contact, id *crypto.Identity) error {
+	if contact == nil || id == nil {
+		return errors.New("nil argument")
 	}
-	//logger.Debug(fmt.Sprintf("SEND PULL REQUEST (%s): timestamp %d\n", contact.Alias, lastActivity))
+	logger.Debug(fmt.Sprint("SEND CONTACT RESPONSE (", contact.Alias, ")"))
 
 	onionconn, err := ConnectToOnion(contact.Onion.Onion)
-	if err != nil { //logger.ConditionalWarning(err, fmt.Sprintf("could not conect to %s addr", contact.Onion.Onion)) {
-		return posts, profiles, err
+	if err != nil {
+		return err
 	}
 	defer onionconn.Close()
 
-	err = onionconn.Auth(key)
-	if logger.ConditionalWarning(err, "(authentication fail, trying to PULL without AUTH..)") {
-		onionconn, err = ConnectToOnion(contact.Onion.Onion) // needed for PULL request
-		if logger.ConditionalWarning(err, "could not conect to onion addr") {
-			return posts, profiles, err
-		}
-	} else {
-		// auth successful, set contact's status to SUCCESS
-		if contact.Status != db.SUCCESS {
-			SetContactToSuccess(contact, dbconn)
-		}
+	if !onionconn.Supports(protocol.FEATURE_RESPONSE) {
+		return nil
 	}
-
-	posts, profiles, err = onionconn.Pull(lastActivity)
-	if logger.ConditionalWarning(err, "client could not PULL") {
-		return posts, profiles, err
+	if err = onionconn.Secure(); err != nil {
+		return err
 	}
 
-	logger.Debug(fmt.Sprint("RECEIVED(", len(posts), " POSTS, ", len(profiles), " PROFILES) from ", contact.Alias))
-
-	return posts, profiles, nil
+	cr := protocol.ContactResponse{
+		Decision: contact.Response,
+		Message:  contact.ResponseMessage,
+	}
+	err = cr.Sign(id, contact.Onion.Onion)
+	if logger.ConditionalWarning(err, "could not sign contact response") {
+		return err
+	}
+	return onionconn.ContactResponse(cr)
 }
 
-func SyncAllContacts(key *rsa.PrivateKey) {
-
-	dbconn := db.SSNDB{}
-	dbconn.Init()
-	//dbconn.LogMode(true)
-	contacts := []db.Contact{}
-	dbconn.Where(db.Contact{Status: db.SUCCESS}).Or(db.Contact{Status: db.PENDING}).Or(db.Contact{Status: db.FOLLOWING}).Find(&contacts)
-	myOnion := dbconn.GetSelfOnion()
-	// A WaitGroup waits for a collection of goroutines to finish.
-	var wg sync.WaitGroup
-	wg.Add(len(contacts)) // set the WaitGroup counter.
-
-	for _, contact := range contacts {
-		go func(dbconn *db.SSNDB, key *rsa.PrivateKey, contact db.Contact, wg *sync.WaitGroup) {
-			dbconn.Model(&contact).Related(&contact.Onion, "OnionId")
-			lastActivity := dbconn.GetContactsLastActivity(&contact)
-			posts, profiles, err := PullHandling(dbconn, lastActivity, &contact, key)
-			if err == nil {
-				dbconn.AddOrUpdateProfiles(profiles)
-				dbconn.AddOrUpdatePosts(posts)
-
-				for _, post := range posts {
-					TriggerOnReceivingComment(dbconn, &post)
-				}
-
-			}
-			if db.PENDING == contact.Status {
-				ContactRequestHandling(&contact, &myOnion)
-				/*if err != nil {
-					logger.Warning(fmt.Sprint(err))
-				} */
-			}
-			wg.Done() // decrements the WaitGroup counter.
-		}(&dbconn, key, contact, &wg)
+// pulls everything new from contact and stores it. Peers which support
+// cursors are pulled in batches, an interrupted sync resumes after the last
+// stored batch.
+func PullHandling(dbconn *db.SSNDB, contact *db.Contact, id *crypto.Identity) error {
+	if contact == nil || id == nil {
+		return errors.New("nil argument")
 	}
 
-	wg.Wait() // blocks until the WaitGroup counter is zero.
+	if contact.Status == db.COMPROMISED {
+		return errors.New(contact.Alias + " is compromised, re-pin its key to sync again")
+	}
 
-	dbconn.Close()
-}
+	onionconn, err := ConnectAuthenticated(id, dbconn, contact.Onion.Onion)
+	if err == db.ErrKeyMismatch {
+		// not the peer we pinned, nothing it sends may be stored
+		dbconn.SetContactToCompromised(contact)
+		return err
+	} else if err == ErrAuthentication {
+		logger.Warning("(authentication fail, trying to PULL without AUTH..)")
+		onionconn, err = ConnectToOnion(contact.Onion.Onion) // needed for PULL request
+		if logger.ConditionalWarning(err, "could not conect to onion addr") {
+			return err
+		}
+		defer onionconn.Close()
+		if err = onionconn.Secure(); err != nil {
+			return err
+		}
+	} else if err != nil { //logger.ConditionalWarning(err, fmt.Sprintf("could not conect to %s addr", contact.Onion.Onion)) {
+		return err
+	} else {
+		defer onionconn.Close()
 
-func TriggerOnReceivingComment(dbconn *db.SSNDB, comment *db.Post) {
-	if comment.ParentId == 0 {
-		return
+		// auth successful, set contact's status to SUCCESS
+		if contact.Status != db.SUCCESS {
+			dbconn.SetContactToSuccess(contact)
+		}
 	}
 
-	var parentPost db.Post
-	dbconn.First(&parentPost, comment.ParentId)
+	if onionconn.Supports(protocol.FEATURE_CURSOR) {
+		// without a cursor, start where the old PULL would have
+		state := dbconn.GetSyncState(contact.Onion)
+		err = onionconn.PullBatches(state.Cursor, state.Since, peer.StoreBatch(dbconn, contact, onionconn))
+		logger.ConditionalWarning(err, "client could not PULL")
+		go DeliverTriggers(dbconn)
+		return err
+	}
 
-	if parentPost.OriginatorId != dbconn.GetSelfOnion().Id {
-		return
+	posts, profiles, err := onionconn.Pull(dbconn.GetContactsLastActivity(contact))
+	if logger.ConditionalWarning(err, "client could not PULL") {
+		return err
 	}
 
-	comment.PublishedAt = time.Now()
-	comment.Published = true
-	dbconn.Save(comment)
+	logger.Debug(fmt.Sprint("RECEIVED(", len(posts), " POSTS, ", len(profiles), " PROFILES) from ", contact.Alias))
+	peer.StorePulled(dbconn, posts, profiles, false)
+	go DeliverTriggers(dbconn)
 
-	circles := dbconn.GetPostCircles(comment)
-	TriggerCircles(dbconn, circles)
+	return nil
 }
 
-func SetContactToSuccess(contact *db.Contact, dbconn *db.SSNDB) {
-	// set contact status to success
-	logger.Info("Updating status of contact " + contact.Alias + " to \"success\"")
-	contact.Status = db.SUCCESS
-	dbconn.Save(contact)
-
-	// add circle for new contact
-	circle := db.Circle{Name: contact.Alias, Creator: db.CREATOR_APP}
-	dbconn.Find(&circle, circle)
-	if circle.Id != 0 {
-		logger.Warning("circle \"" + circle.Name + "\" already exists")
-		return
-	}
-	logger.Debug("adding circle \"" + circle.Name + "\"")
-	dbconn.Create(&circle)
+// syncs every contact we follow or are friends with, at most SyncWorkers at
+// the same time
+func SyncAllContacts(id *crypto.Identity) {
+	scheduler := GetSyncScheduler(id)
 
-	// add contact to circle
-	logger.Debug("adding user " + contact.Alias + " (" + contact.Nickname + ") to circle \"" + circle.Name + "\"\n")
-	dbconn.Model(&circle).Association("Contacts").Append(*contact)
-
-	var p db.Pending
-	dbconn.Find(&p, 1)
-	p.Contacts = true
-	dbconn.Save(&p)
+	contacts := []db.Contact{}
+	scheduler.dbconn.Where(db.Contact{Status: db.SUCCESS}).Or(db.Contact{Status: db.PENDING}).Or(db.Contact{Status: db.FOLLOWING}).Find(&contacts)
+	// and those we owe a response
+	answers := []db.Contact{}
+	scheduler.dbconn.Where("response != ?", db.NO_DECISION).Find(&answers)
+	scheduler.SyncAll(append(contacts, answers...))
 }
 
+// sends a TRIGGER to every contact in circles but us
 func TriggerCircles(dbconn *db.SSNDB, circles []db.Circle) {
-	// sync trigger
-	// we abuse map type as set here, since golang does not have sets...
-	// we are only interested in the KEY, we ignore  the value
-	self := dbconn.GetSelfOnion()
-	onionMap := map[db.Onion]bool{}
-	for _, circle := range circles {
-		// we need all onions in circle for trigger
-		var contacts []db.Contact
-		if circle.Name == "Public" {
-			dbconn.Find(&contacts)
-		} else {
-			dbconn.Model(&circle).Related(&circle.Contacts, "Contacts")
-			contacts = circle.Contacts
-		}
-		for _, contact := range contacts {
-			var onion db.Onion
-			dbconn.Model(&contact).Related(&onion, "Onion")
-			if onion.Id != self.Id {
-				onionMap[onion] = true
-			}
-		}
-	}
-
-	var onionsToTrigger []db.Onion
-	for onionKey, _ := range onionMap {
-		onionsToTrigger = append(onionsToTrigger, onionKey)
-	}
-
-	logger.Debug("I am going to trigger the following onions in a goroutine now: ")
-	logger.Debug(fmt.Sprint(onionsToTrigger))
-	go TriggerHandling(dbconn, onionsToTrigger)
+	dbconn.QueueCircleTriggers(circles)
+	go DeliverTriggers(dbconn)
 }
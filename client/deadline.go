@@ -34,24 +34,24 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package client
 
 import (
-	"crypto/rsa"
+	"../core/crypto"
 	"time"
 )
 
-type CallbackFunc func(key *rsa.PrivateKey)
+type CallbackFunc func(id *crypto.Identity)
 
 type Deadline struct {
 	ticker     *time.Ticker
-	key        rsa.PrivateKey
+	id         *crypto.Identity
 	interval   time.Duration
 	callback   CallbackFunc
 	executions uint64
 }
 
-func NewDeadline(key *rsa.PrivateKey, interval time.Duration, callback CallbackFunc, executions uint64) Deadline {
-	callback(key)
+func NewDeadline(id *crypto.Identity, interval time.Duration, callback CallbackFunc, executions uint64) Deadline {
+	callback(id)
 	deadline := Deadline{}
-	deadline.key = *key
+	deadline.id = id
 	deadline.interval = interval
 	deadline.callback = callback
 	deadline.executions = executions
@@ -73,7 +73,7 @@ func (this *Deadline) exec() {
 	for {
 		select {
 		case <-tickerChan:
-			this.callback(&this.key)
+			this.callback(this.id)
 			if !constantly && 0 == this.executions {
 				return
 			} else {
@@ -0,0 +1,306 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package client
+
+import (
+	"../core/crypto"
+	"../core/db"
+	"../logger"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// contacts synced at the same time by default, each sync holds a Tor circuit
+const DEFAULT_SYNC_WORKERS = 8
+
+// contacts which triggered us within this time are synced first
+const RECENT_TRIGGER = 10 * time.Minute
+
+// number of workers of the scheduler of this process, set before its first use
+var SyncWorkers = DEFAULT_SYNC_WORKERS
+
+/* Sync Scheduler
+ *
+ * Syncs contacts with a fixed number of workers. A contact is synced by one
+ * worker at a time: a contact which is queued already is not queued again,
+ * one which triggers us while it is synced is synced once more afterwards
+ * (it might have published something after we pulled). Triggered contacts
+ * are taken before those of the periodic sync.
+ */
+type SyncScheduler struct {
+	dbconn    db.SSNDB
+	id        *crypto.Identity
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	triggered []*syncJob         // contacts which triggered us, first in first out
+	periodic  []*syncJob         // contacts of the periodic sync
+	jobs      map[int64]*syncJob // queued or running jobs by contact id
+	lastSeen  map[int64]time.Time
+	workers   sync.WaitGroup
+	stopped   bool
+}
+
+type syncJob struct {
+	contactId int64
+	request   bool // resend our contact request if the contact is still PENDING
+	triggered bool
+	running   bool
+	again     bool // triggered while running
+	waiting   []*sync.WaitGroup
+}
+
+// the schedulers of this process by the onion of their identity, usually
+// there is only the one of our node
+var schedulers = struct {
+	sync.Mutex
+	byOnion map[string]*SyncScheduler
+}{byOnion: map[string]*SyncScheduler{}}
+
+// the scheduler of id, started on the database of the user on first use
+func GetSyncScheduler(id *crypto.Identity) *SyncScheduler {
+	schedulers.Lock()
+	defer schedulers.Unlock()
+	if schedulers.byOnion[id.Onion()] == nil {
+		schedulers.byOnion[id.Onion()] = NewSyncScheduler(id, db.GetDBName(), SyncWorkers)
+	}
+	return schedulers.byOnion[id.Onion()]
+}
+
+// makes GetSyncScheduler return scheduler for its identity, for nodes which
+// do not use the database of the user
+func SetSyncScheduler(scheduler *SyncScheduler) {
+	schedulers.Lock()
+	schedulers.byOnion[scheduler.id.Onion()] = scheduler
+	schedulers.Unlock()
+}
+
+// a scheduler syncing the contacts in the database dbname
+func NewSyncScheduler(id *crypto.Identity, dbname string, workers int) *SyncScheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	this := &SyncScheduler{
+		id:       id,
+		jobs:     map[int64]*syncJob{},
+		lastSeen: map[int64]time.Time{},
+	}
+	this.cond = sync.NewCond(&this.mutex)
+	this.dbconn.Open(dbname)
+	this.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go this.worker()
+	}
+	return this
+}
+
+// lets the running syncs finish, drops the queued ones and closes the
+// database. GetSyncScheduler starts a new scheduler afterwards.
+func (this *SyncScheduler) Stop() {
+	this.mutex.Lock()
+	if this.stopped {
+		this.mutex.Unlock()
+		return
+	}
+	this.stopped = true
+	for _, queued := range [][]*syncJob{this.triggered, this.periodic} {
+		for _, job := range queued {
+			for _, wg := range job.waiting {
+				wg.Done()
+			}
+			delete(this.jobs, job.contactId)
+		}
+	}
+	this.triggered, this.periodic = nil, nil
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+	this.workers.Wait()
+
+	schedulers.Lock()
+	if schedulers.byOnion[this.id.Onion()] == this {
+		delete(schedulers.byOnion, this.id.Onion())
+	}
+	schedulers.Unlock()
+	this.dbconn.Close()
+}
+
+// queues a sync of contact before the periodic ones
+func (this *SyncScheduler) Trigger(contact *db.Contact) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.lastSeen[contact.Id] = time.Now()
+	this.enqueue(contact.Id, false, true, nil)
+}
+
+// notes that contact was active, it is synced early by the next SyncAll
+func (this *SyncScheduler) Seen(contact *db.Contact) {
+	this.mutex.Lock()
+	this.lastSeen[contact.Id] = time.Now()
+	this.mutex.Unlock()
+}
+
+// queues a sync of contacts and waits for those which were not queued
+// already. Contacts which recently triggered us come first.
+func (this *SyncScheduler) SyncAll(contacts []db.Contact) {
+	var wg sync.WaitGroup
+	this.mutex.Lock()
+	recent := time.Now().Add(-RECENT_TRIGGER)
+	for _, first := range []bool{true, false} {
+		for _, contact := range contacts {
+			if this.lastSeen[contact.Id].After(recent) == first {
+				this.enqueue(contact.Id, true, first, &wg)
+			}
+		}
+	}
+	this.mutex.Unlock()
+	wg.Wait()
+}
+
+// expects the mutex to be locked
+func (this *SyncScheduler) enqueue(contactId int64, request bool, triggered bool, wg *sync.WaitGroup) {
+	if this.stopped {
+		return
+	}
+	if job, ok := this.jobs[contactId]; ok {
+		job.request = job.request || request
+		if job.running && triggered {
+			job.again = true
+		} else if !job.running && triggered && !job.triggered {
+			// move it to the front
+			for i, queued := range this.periodic {
+				if queued == job {
+					this.periodic = append(this.periodic[:i], this.periodic[i+1:]...)
+					break
+				}
+			}
+			job.triggered = true
+			this.triggered = append(this.triggered, job)
+		}
+		return
+	}
+
+	job := &syncJob{contactId: contactId, request: request, triggered: triggered}
+	if wg != nil {
+		wg.Add(1)
+		job.waiting = append(job.waiting, wg)
+	}
+	this.jobs[contactId] = job
+	if triggered {
+		this.triggered = append(this.triggered, job)
+	} else {
+		this.periodic = append(this.periodic, job)
+	}
+	this.cond.Signal()
+}
+
+// blocks until there is a job, nil once the scheduler is stopped
+func (this *SyncScheduler) next() *syncJob {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for !this.stopped && len(this.triggered) == 0 && len(this.periodic) == 0 {
+		this.cond.Wait()
+	}
+	if this.stopped {
+		return nil
+	}
+	var job *syncJob
+	if len(this.triggered) > 0 {
+		job, this.triggered = this.triggered[0], this.triggered[1:]
+	} else {
+		job, this.periodic = this.periodic[0], this.periodic[1:]
+	}
+	job.running = true
+	return job
+}
+
+func (this *SyncScheduler) done(job *syncJob) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, wg := range job.waiting {
+		wg.Done()
+	}
+	delete(this.jobs, job.contactId)
+	if job.again {
+		this.enqueue(job.contactId, false, true, nil)
+	}
+}
+
+func (this *SyncScheduler) worker() {
+	defer this.workers.Done()
+	for {
+		job := this.next()
+		if job == nil {
+			return
+		}
+		this.sync(job)
+		this.done(job)
+	}
+}
+
+func (this *SyncScheduler) sync(job *syncJob) {
+	var contact db.Contact
+	if this.dbconn.First(&contact, job.contactId).Error != nil {
+		logger.Warning(fmt.Sprint("contact ", job.contactId, " to sync does not exist anymore"))
+		return
+	}
+	this.dbconn.Model(&contact).Related(&contact.Onion, "OnionId")
+
+	if contact.Response != db.NO_DECISION {
+		err := ContactResponseHandling(&contact, this.id)
+		if !logger.ConditionalWarning(err, "could not send contact response") {
+			contact.Response = db.NO_DECISION
+			this.dbconn.Save(&contact)
+		}
+	}
+
+	switch contact.Status {
+	case db.SUCCESS, db.PENDING, db.FOLLOWING:
+		PullHandling(&this.dbconn, &contact, this.id)
+	default:
+		return
+	}
+
+	if job.request && db.PENDING == contact.Status {
+		contact.RequestAttempts++
+		if int(contact.RequestAttempts) > db.MaxContactRequestAttempts {
+			logger.Info(fmt.Sprint("contact request to ", contact.Alias, " expired after ", db.MaxContactRequestAttempts, " attempts"))
+			contact.Status = db.EXPIRED
+			this.dbconn.Save(&contact)
+			return
+		}
+		this.dbconn.Save(&contact)
+		myOnion := this.dbconn.GetSelfOnion()
+		ContactRequestHandling(&contact, &myOnion, this.id)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"../core/crypto"
+	"../core/db"
+	"../logger"
+	"../sync/peer"
+	"../sync/protocol"
+)
+
+var ErrAuthentication = errors.New("authentication failed")
+
+/* Session Cache
+ *
+ * The sessions we opened, by our identity and the onion of the peer (a
+ * simulation runs several nodes in one process). A request to a peer which
+ * supports sessions reuses the live one instead of building a new Tor
+ * circuit.
+ */
+var sessions = struct {
+	sync.Mutex
+	byPeers map[string]*peer.Session
+}{byPeers: map[string]*peer.Session{}}
+
+func sessionKey(id *crypto.Identity, onion string) string {
+	return id.Onion() + " " + onion
+}
+
+// a connection to onion on which we are authenticated. It is a stream of
+// our session with onion if the peer supports sessions, a connection of its
+// own otherwise. Either way, closing it ends the request only.
+// ErrAuthentication is returned if onion did not accept our AUTH,
+// db.ErrKeyMismatch if onion is not the peer we pinned.
+func ConnectAuthenticated(id *crypto.Identity, dbconn *db.SSNDB, onion string) (peer.OnionConnection, error) {
+	key := sessionKey(id, onion)
+	sessions.Lock()
+	session := sessions.byPeers[key]
+	sessions.Unlock()
+	if session != nil {
+		conn, err := session.Open()
+		if err == nil {
+			return conn, nil
+		}
+		// closed meanwhile, forget it
+		sessions.Lock()
+		if sessions.byPeers[key] == session {
+			delete(sessions.byPeers, key)
+		}
+		sessions.Unlock()
+	}
+
+	conn, err := ConnectToOnion(onion)
+	if err != nil {
+		return conn, err
+	}
+	if err = conn.Auth(id, dbconn); err != nil {
+		logger.Warning(fmt.Sprint("authentication to ", onion, " failed: ", err))
+		conn.Close()
+		if err == db.ErrKeyMismatch {
+			return conn, err
+		}
+		return conn, ErrAuthentication
+	}
+	if !conn.Supports(protocol.FEATURE_SESSION) {
+		return conn, nil
+	}
+
+	conn.Write(protocol.EncodeSession())
+	if err = conn.AwaitSuccess(); err != nil {
+		conn.Close()
+		return conn, errors.New("could not open session: " + err.Error())
+	}
+	session = peer.OpenSession(conn)
+
+	// replaces one opened at the same time, which closes once idle
+	sessions.Lock()
+	sessions.byPeers[key] = session
+	sessions.Unlock()
+
+	return session.Open()
+}
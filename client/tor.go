@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package client
+
+import (
+	"../core/crypto"
+	"../core/db"
+	"../external/torcontrol"
+	"../logger"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* Our onion through the control port of tor
+ *
+ * Instead of a HiddenServiceDir in the torrc, syncerd hands the key of the
+ * SSNDB to tor with ADD_ONION. Tor keeps the onion as long as the control
+ * connection stays open, so it disappears together with syncerd.
+ */
+
+// time between two looks at the bootstrap and onion of tor
+const TOR_STATUS_INTERVAL = 30 * time.Second
+
+// connects to the control port at addr and authenticates with password, or
+// with the cookie of tor if there is none
+func ConnectTorControl(addr, password, cookieFile string) (*torcontrol.Conn, error) {
+	control, err := torcontrol.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := control.Authenticate(password, cookieFile); err != nil {
+		control.Close()
+		return nil, err
+	}
+	return control, nil
+}
+
+// the key of id in the form ADD_ONION takes it
+func TorControlKey(id *crypto.Identity) (string, error) {
+	if id.Ed25519 != nil {
+		return "ED25519-V3:" + base64.StdEncoding.EncodeToString(crypto.ExpandEd25519Key(id.Ed25519)), nil
+	}
+	if id.RSA != nil {
+		return "RSA1024:" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PrivateKey(id.RSA)), nil
+	}
+	return "", errors.New("identity has no key")
+}
+
+// makes tor serve the onion of id, forwarding it to ListenAddr
+func (tor *TorTransport) AddOnion(control *torcontrol.Conn, id *crypto.Identity) error {
+	key, err := TorControlKey(id)
+	if err != nil {
+		return err
+	}
+	// before ADD_ONION, the first descriptor upload may follow right away
+	if err := control.SetEvents("HS_DESC"); err != nil {
+		return err
+	}
+	serviceID, err := control.AddOnion(key, tor.Port, tor.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if serviceID+".onion" != id.Onion() {
+		return fmt.Errorf("tor added %s.onion instead of %s", serviceID, id.Onion())
+	}
+	return nil
+}
+
+// stores the status of tor and onion every interval, until the control
+// connection fails
+func MonitorTor(control *torcontrol.Conn, dbconn *db.SSNDB, onion string, interval time.Duration) error {
+	status := db.TorStatus{Onion: onion}
+	for {
+		last := status
+		err := CheckTor(control, &status)
+		if err != nil {
+			status.Error = err.Error()
+			status.Reachable = false
+		}
+		status.CheckedAt = time.Now()
+		dbconn.SaveTorStatus(status)
+		if err != nil {
+			return err
+		}
+
+		if status.Bootstrap != last.Bootstrap {
+			logger.Info(fmt.Sprintf("tor bootstrapped %d%%: %s", status.Bootstrap, status.Phase))
+		}
+		if status.Reachable != last.Reachable {
+			if status.Reachable {
+				logger.Info(onion + " is reachable")
+			} else {
+				logger.Warning(onion + " is not reachable")
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// updates status with what tor reports, Published stays set once tor
+// uploaded a descriptor of status.Onion
+func CheckTor(control *torcontrol.Conn, status *db.TorStatus) error {
+	bootstrap, err := control.Bootstrap()
+	if err != nil {
+		return err
+	}
+	status.Bootstrap = bootstrap.Progress
+	status.Phase = bootstrap.Summary
+
+	status.Live, err = control.NetworkLive()
+	if err != nil {
+		return err
+	}
+
+	// HS_DESC UPLOADED <onion without .onion> <auth> <directory> ...
+	serviceID := strings.TrimSuffix(status.Onion, ".onion")
+	for _, event := range control.Events() {
+		fields := strings.Fields(event)
+		if len(fields) >= 3 && fields[0] == "HS_DESC" && fields[1] == "UPLOADED" && fields[2] == serviceID {
+			status.Published = true
+		}
+	}
+
+	status.Reachable = status.Bootstrap == 100 && status.Live && status.Published
+	status.Error = ""
+	return nil
+}
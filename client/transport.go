@@ -0,0 +1,163 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package client
+
+import (
+	"../external"
+	"errors"
+	"flag"
+	"net"
+	"sync"
+)
+
+// the port syncerd is reachable on, behind the onion and locally
+const SYNC_PORT = 3141
+
+// how nodes reach each other
+type Transport interface {
+	// opens a connection to the syncerd behind onion
+	Dial(onion string) (net.Conn, error)
+	// accepts the connections made to onion, which has to be ours
+	Listen(onion string) (net.Listener, error)
+}
+
+// the transport of ConnectToOnion and syncerd, set it before the first
+// connection is made
+var DefaultTransport Transport = NewTorTransport()
+
+/* Tor */
+
+// reaches onions through the SOCKS proxy of tor, tor forwards the hidden
+// service to ListenAddr
+type TorTransport struct {
+	Proxy      string // host:port of the SOCKS proxy
+	Port       int    // port of the hidden service
+	ListenAddr string
+	Isolate    bool // a circuit of its own for every onion, see socks.Auth
+	Socks4a    bool // for proxies without SOCKS5, never isolated
+}
+
+// the password of the credentials of Isolate, tor only compares them
+const ISOLATION_PASSWORD = "zwiebelnetz"
+
+func NewTorTransport() *TorTransport {
+	return &TorTransport{Proxy: "localhost:9050", Port: SYNC_PORT, ListenAddr: "localhost:3141", Isolate: true}
+}
+
+// registers the flags configuring how tor is dialed on the default flag
+// set, for the programs which reach other nodes
+func TorFlags(tor *TorTransport) {
+	flag.StringVar(&tor.Proxy, "socks", tor.Proxy, "address of the SOCKS proxy of tor")
+	flag.IntVar(&tor.Port, "sync-port", tor.Port, "port of syncerd behind the onions of contacts")
+	flag.BoolVar(&tor.Isolate, "isolate", tor.Isolate, "a tor circuit of its own for every contact")
+	flag.BoolVar(&tor.Socks4a, "socks4a", tor.Socks4a, "use SOCKS4a instead of SOCKS5, without isolation")
+}
+
+func (tor *TorTransport) Dial(onion string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", tor.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	// tell TOR proxy to connect to onion address
+	if tor.Socks4a {
+		err = socks.Connect(conn, onion, tor.Port)
+	} else if tor.Isolate {
+		err = socks.Connect5(conn, onion, tor.Port, &socks.Auth{Username: onion, Password: ISOLATION_PASSWORD})
+	} else {
+		err = socks.Connect5(conn, onion, tor.Port, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tor decides which onion ends up here, so onion is not checked
+func (tor *TorTransport) Listen(onion string) (net.Listener, error) {
+	return net.Listen("tcp", tor.ListenAddr)
+}
+
+/* Loopback */
+
+// a network of nodes in one process, every onion is a listener on a free
+// port of 127.0.0.1. Onions nobody listens on are unreachable, as they are
+// with tor.
+type LoopbackTransport struct {
+	mutex     sync.Mutex
+	listeners map[string]*loopbackListener
+}
+
+func NewLoopbackTransport() *LoopbackTransport {
+	return &LoopbackTransport{listeners: map[string]*loopbackListener{}}
+}
+
+type loopbackListener struct {
+	net.Listener
+	onion     string
+	transport *LoopbackTransport
+}
+
+func (lo *LoopbackTransport) Dial(onion string) (net.Conn, error) {
+	lo.mutex.Lock()
+	ln := lo.listeners[onion]
+	lo.mutex.Unlock()
+	if ln == nil {
+		return nil, errors.New("loopback: " + onion + " is unreachable")
+	}
+	return net.Dial("tcp", ln.Addr().String())
+}
+
+func (lo *LoopbackTransport) Listen(onion string) (net.Listener, error) {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+	if lo.listeners[onion] != nil {
+		return nil, errors.New("loopback: " + onion + " is in use")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	lo.listeners[onion] = &loopbackListener{Listener: ln, onion: onion, transport: lo}
+	return lo.listeners[onion], nil
+}
+
+// closing the listener takes the onion offline
+func (ln *loopbackListener) Close() error {
+	ln.transport.mutex.Lock()
+	if ln.transport.listeners[ln.onion] == ln {
+		delete(ln.transport.listeners, ln.onion)
+	}
+	ln.transport.mutex.Unlock()
+	return ln.Listener.Close()
+}
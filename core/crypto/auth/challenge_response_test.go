@@ -34,6 +34,7 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package auth
 
 import "testing"
+import "crypto/ed25519"
 import "crypto/sha256"
 import _ "fmt"
 import "../../crypto"
@@ -143,3 +144,81 @@ W90vDdM0H6z3hJdyrhPWcQxlkvrwVoXTsFvEQzZU2O7xSmo=
 		t.Fatal("invalid r was not detected!")
 	}
 }
+
+func TestChallengeResponseV3(t *testing.T) {
+	A, err := crypto.GenerateEd25519Key()
+	if err != nil {
+		t.Fatalf("could not generate key a: error: %s\n", err.Error())
+	}
+	B, err := crypto.GenerateEd25519Key()
+	if err != nil {
+		t.Fatalf("could not generate key b: error: %s\n", err.Error())
+	}
+	A_Pub := A.Public().(ed25519.PublicKey)
+	B_Pub := B.Public().(ed25519.PublicKey)
+	B_Onion := crypto.GetOnionAddressV3(B_Pub)
+
+	// test successful challenge response
+	challenge, err := GenerateChallengeV3(B_Pub)
+	if err != nil {
+		t.Fatalf("could not generate challenge: error: %s\n", err.Error())
+	}
+
+	response, err := GenerateResponseV3(challenge, A, B_Onion)
+	if err != nil {
+		t.Fatalf("could not generate response, error: %s\n", err.Error())
+	}
+
+	if !VerifyResponseV3(challenge, response, A_Pub) {
+		t.Fatal("valid response was rejected")
+	}
+
+	// a response is only valid for the r it was made for
+	otherChallenge, _ := GenerateChallengeV3(B_Pub)
+	if VerifyResponseV3(otherChallenge, response, A_Pub) {
+		t.Fatal("response to another challenge was accepted!")
+	}
+}
+
+func TestWrongRemoteV3(t *testing.T) {
+	A, _ := crypto.GenerateEd25519Key()
+	B, _ := crypto.GenerateEd25519Key()
+	M, _ := crypto.GenerateEd25519Key()
+	B_Onion := crypto.GetOnionAddressV3(B.Public().(ed25519.PublicKey))
+
+	// M answers for B's onion with its own key
+	challenge, err := GenerateChallengeV3(M.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatalf("could not generate challenge: error: %s\n", err.Error())
+	}
+
+	_, err = GenerateResponseV3(challenge, A, B_Onion)
+	if err != nil {
+		t.Logf("good, wrong B was detected: %s\n", err.Error())
+	} else {
+		t.Fatal("wrong B was not detected!")
+	}
+}
+
+func TestWrongResponseV3(t *testing.T) {
+	A, _ := crypto.GenerateEd25519Key()
+	B, _ := crypto.GenerateEd25519Key()
+	M, _ := crypto.GenerateEd25519Key()
+	B_Pub := B.Public().(ed25519.PublicKey)
+	B_Onion := crypto.GetOnionAddressV3(B_Pub)
+
+	challenge, err := GenerateChallengeV3(B_Pub)
+	if err != nil {
+		t.Fatalf("could not generate challenge: error: %s\n", err.Error())
+	}
+
+	// M signs the challenge but claims to be A
+	response, err := GenerateResponseV3(challenge, M, B_Onion)
+	if err != nil {
+		t.Fatalf("could not generate response, error: %s\n", err.Error())
+	}
+
+	if VerifyResponseV3(challenge, response, A.Public().(ed25519.PublicKey)) {
+		t.Fatal("response signed by another key was accepted!")
+	}
+}
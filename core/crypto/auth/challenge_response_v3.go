@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package auth
+
+import "crypto/ed25519"
+import "crypto/rand"
+import "bytes"
+import "errors"
+import "../../crypto"
+
+/* Challenge-response for ed25519 identities (v3 onions).
+
+   Ed25519 keys cannot decrypt, so instead of decrypting P_A(r,B) A proves
+   possession of its key by signing the fresh random number r of B:
+       A -> B: P_A                    (1)
+       A <- B: r,P_B                  (2)
+       A -> B: S_A(r,P_B)             (3)
+
+   (Before (3), A verifies that P_B is the key of the onion it connected to,
+    B verifies S_A with P_A whose onion B looks up as contact)
+*/
+
+type ChallengeV3 struct {
+	R      [32]byte // the random number r
+	PubKey [32]byte // the public key of B
+}
+
+type ResponseV3 struct {
+	Sig [64]byte // S_A(r,P_B)
+}
+
+func signedChallengeV3(challenge ChallengeV3) []byte {
+	buf := append([]byte("zwiebelnetz auth v3\n"), challenge.R[:]...)
+	return append(buf, challenge.PubKey[:]...)
+}
+
+func GenerateChallengeV3(B ed25519.PublicKey) (ChallengeV3, error) {
+	var challenge ChallengeV3
+	if len(B) != ed25519.PublicKeySize {
+		return challenge, errors.New("Auth.GenerateChallengeV3: invalid public key b")
+	}
+	copy(challenge.PubKey[:], B)
+
+	_, err := rand.Read(challenge.R[:])
+	if err != nil {
+		return challenge, errors.New("Auth.GenerateChallengeV3: cannot get secure random number, error: " + err.Error())
+	}
+	return challenge, nil
+}
+
+func GenerateResponseV3(challenge ChallengeV3, A_PrivK ed25519.PrivateKey, B_Onion string) (ResponseV3, error) {
+	var response ResponseV3
+
+	// check that onion of B == the host which we connected to in the first place!
+	b, err := crypto.OnionV3PublicKey(B_Onion)
+	if err != nil {
+		return response, errors.New("invalid B given by remote!")
+	}
+	if !bytes.Equal(b, challenge.PubKey[:]) {
+		return response, errors.New("wrong B given by remote!")
+	}
+
+	copy(response.Sig[:], ed25519.Sign(A_PrivK, signedChallengeV3(challenge)))
+	return response, nil
+}
+
+func VerifyResponseV3(challenge ChallengeV3, response ResponseV3, A ed25519.PublicKey) bool {
+	if len(A) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(A, signedChallengeV3(challenge), response.Sig[:])
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package auth
+
+import "crypto/ecdh"
+import "crypto/hkdf"
+import "crypto/rand"
+import "crypto/sha256"
+import "errors"
+import "../../crypto"
+
+/* Key exchange for the secure channel.
+
+   Once A authenticated to B, they agree on the keys of an encrypted channel
+   with ephemeral X25519 keys. Each side signs its ephemeral key with the
+   identity key of its onion, together with both onions and what was sent
+   before:
+       A -> B: E_A, S_A(A,B,E_A)              (1)
+       A <- B: E_B, S_B(A,B,E_A,E_B)          (2)
+
+   Both derive one key per direction from DH(e_A,E_B) and the transcript
+   with HKDF. e_A and e_B are thrown away afterwards: traffic recorded today
+   stays secret even if an identity key is lost later.
+
+   A which did not authenticate sends (1) with an empty A and without
+   signature, it only learns that it talks to B.
+*/
+
+type KeyExchange struct {
+	Ephemeral [32]byte // X25519 public key
+	PubKey    []byte   // identity key of the sender, pkcs1 for v2 onions, empty for an anonymous A
+	Signature []byte
+	Responder string `json:",omitempty"` // B as A knows it, in (1) only
+}
+
+// the keys of the channel, one per direction
+type ChannelKeys struct {
+	Initiator []byte // A -> B
+	Responder []byte // B -> A
+}
+
+const CHANNEL_KEY_SIZE = 32
+
+func keyExchangeTranscript(A string, B string, E_A []byte, E_B []byte) []byte {
+	buf := []byte("zwiebelnetz key exchange\n" + A + "\n" + B + "\n")
+	buf = append(buf, E_A...)
+	return append(buf, E_B...)
+}
+
+// builds (1), signed with the key of A unless A is empty
+func InitiateKeyExchange(id *crypto.Identity, A string, B string) (KeyExchange, *ecdh.PrivateKey, error) {
+	var initiation KeyExchange
+	e_A, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return initiation, nil, errors.New("Auth.InitiateKeyExchange: cannot generate ephemeral key, error: " + err.Error())
+	}
+	copy(initiation.Ephemeral[:], e_A.PublicKey().Bytes())
+	initiation.Responder = B
+
+	if A != "" {
+		initiation.Signature, initiation.PubKey, err = id.SignAs(A, keyExchangeTranscript(A, B, initiation.Ephemeral[:], nil))
+		if err != nil {
+			return initiation, nil, errors.New("Auth.InitiateKeyExchange: cannot sign, error: " + err.Error())
+		}
+	}
+	return initiation, e_A, nil
+}
+
+// checks (1) and builds (2), signed with the key of B
+func RespondKeyExchange(id *crypto.Identity, A string, B string, initiation KeyExchange) (KeyExchange, ChannelKeys, error) {
+	var response KeyExchange
+	var keys ChannelKeys
+	if A != "" {
+		err := crypto.VerifyOnionSignature(A, initiation.PubKey,
+			keyExchangeTranscript(A, B, initiation.Ephemeral[:], nil), initiation.Signature)
+		if err != nil {
+			return response, keys, errors.New("Auth.RespondKeyExchange: invalid signature of a, error: " + err.Error())
+		}
+	}
+
+	e_B, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return response, keys, errors.New("Auth.RespondKeyExchange: cannot generate ephemeral key, error: " + err.Error())
+	}
+	copy(response.Ephemeral[:], e_B.PublicKey().Bytes())
+
+	transcript := keyExchangeTranscript(A, B, initiation.Ephemeral[:], response.Ephemeral[:])
+	response.Signature, response.PubKey, err = id.SignAs(B, transcript)
+	if err != nil {
+		return response, keys, errors.New("Auth.RespondKeyExchange: cannot sign, error: " + err.Error())
+	}
+
+	keys, err = deriveChannelKeys(e_B, initiation.Ephemeral, transcript)
+	return response, keys, err
+}
+
+// checks (2) and derives the keys A uses
+func CompleteKeyExchange(e_A *ecdh.PrivateKey, A string, B string, initiation KeyExchange, response KeyExchange) (ChannelKeys, error) {
+	transcript := keyExchangeTranscript(A, B, initiation.Ephemeral[:], response.Ephemeral[:])
+	if err := crypto.VerifyOnionSignature(B, response.PubKey, transcript, response.Signature); err != nil {
+		return ChannelKeys{}, errors.New("Auth.CompleteKeyExchange: invalid signature of b, error: " + err.Error())
+	}
+	return deriveChannelKeys(e_A, response.Ephemeral, transcript)
+}
+
+func deriveChannelKeys(private *ecdh.PrivateKey, peer [32]byte, transcript []byte) (ChannelKeys, error) {
+	var keys ChannelKeys
+	public, err := ecdh.X25519().NewPublicKey(peer[:])
+	if err != nil {
+		return keys, errors.New("Auth.deriveChannelKeys: invalid ephemeral key, error: " + err.Error())
+	}
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return keys, errors.New("Auth.deriveChannelKeys: key agreement failed, error: " + err.Error())
+	}
+	salt := sha256.Sum256(transcript)
+	material, err := hkdf.Key(sha256.New, secret, salt[:], "zwiebelnetz channel", 2*CHANNEL_KEY_SIZE)
+	if err != nil {
+		return keys, errors.New("Auth.deriveChannelKeys: cannot derive keys, error: " + err.Error())
+	}
+	keys.Initiator = material[:CHANNEL_KEY_SIZE]
+	keys.Responder = material[CHANNEL_KEY_SIZE:]
+	return keys, nil
+}
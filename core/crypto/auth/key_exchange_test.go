@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package auth
+
+import "testing"
+import "bytes"
+import "crypto/ed25519"
+import "../../crypto"
+
+func newTestIdentity(t *testing.T) (*crypto.Identity, string) {
+	key, err := crypto.GenerateEd25519Key()
+	if err != nil {
+		t.Fatalf("could not generate key: error: %s\n", err.Error())
+	}
+	return &crypto.Identity{Ed25519: key}, crypto.GetOnionAddressV3(key.Public().(ed25519.PublicKey))
+}
+
+func TestKeyExchange(t *testing.T) {
+	A, A_Onion := newTestIdentity(t)
+	B, B_Onion := newTestIdentity(t)
+	initiation, e_A, err := InitiateKeyExchange(A, A_Onion, B_Onion)
+	if err != nil {
+		t.Fatalf("could not initiate key exchange: error: %s\n", err.Error())
+	}
+	response, B_Keys, err := RespondKeyExchange(B, A_Onion, B_Onion, initiation)
+	if err != nil {
+		t.Fatalf("could not respond to key exchange: error: %s\n", err.Error())
+	}
+	A_Keys, err := CompleteKeyExchange(e_A, A_Onion, B_Onion, initiation, response)
+	if err != nil {
+		t.Fatalf("could not complete key exchange: error: %s\n", err.Error())
+	}
+	if !bytes.Equal(A_Keys.Initiator, B_Keys.Initiator) || !bytes.Equal(A_Keys.Responder, B_Keys.Responder) {
+		t.Fatal("a and b derived different keys")
+	}
+	if bytes.Equal(A_Keys.Initiator, A_Keys.Responder) {
+		t.Fatal("both directions use the same key")
+	}
+	// an anonymous a only authenticates b
+	initiation, e_A, _ = InitiateKeyExchange(nil, "", B_Onion)
+	response, _, err = RespondKeyExchange(B, "", B_Onion, initiation)
+	if err != nil {
+		t.Fatalf("could not respond to anonymous key exchange: error: %s\n", err.Error())
+	}
+	if _, err = CompleteKeyExchange(e_A, "", B_Onion, initiation, response); err != nil {
+		t.Fatalf("could not complete anonymous key exchange: error: %s\n", err.Error())
+	}
+}
+
+func TestWrongKeyExchange(t *testing.T) {
+	A, A_Onion := newTestIdentity(t)
+	B, B_Onion := newTestIdentity(t)
+	M, _ := newTestIdentity(t)
+	// M signs for the onion of A
+	initiation, _, err := InitiateKeyExchange(M, A_Onion, B_Onion)
+	if err == nil {
+		if _, _, err = RespondKeyExchange(B, A_Onion, B_Onion, initiation); err == nil {
+			t.Fatal("key exchange signed by the wrong key was accepted!")
+		}
+	}
+	// M answers in place of B
+	initiation, e_A, _ := InitiateKeyExchange(A, A_Onion, B_Onion)
+	if response, _, err := RespondKeyExchange(M, A_Onion, B_Onion, initiation); err == nil {
+		if _, err = CompleteKeyExchange(e_A, A_Onion, B_Onion, initiation, response); err == nil {
+			t.Fatal("response signed by the wrong key was accepted!")
+		}
+	}
+	// a tampered ephemeral key breaks the signature
+	initiation, _, _ = InitiateKeyExchange(A, A_Onion, B_Onion)
+	initiation.Ephemeral[0] ^= 1
+	if _, _, err = RespondKeyExchange(B, A_Onion, B_Onion, initiation); err == nil {
+		t.Fatal("tampered ephemeral key was accepted!")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package auth
+
+import "container/heap"
+import "crypto/rand"
+import "encoding/binary"
+import "errors"
+import "sync"
+import "time"
+import "../../crypto"
+
+/* Mutual authentication.
+
+   The challenge-responses above only prove A to B, A trusts B because of
+   the key B puts into the challenge. Here both sides sign the transcript of
+   the exchange, which holds a fresh nonce and the time of each side and the
+   binding of the connection (a hash of the HELLOs both sent):
+       A -> B: A,B,N_A,T_A                    (1)
+       A <- B: N_B,T_B,P_B,S_B("b",H)         (2)
+       A -> B: P_A,S_A("a",H)                 (3)
+   with H = (binding,A,B,N_A,T_A,N_B,T_B).
+
+   Each signature covers the nonce of the other side and the binding, so it
+   is worthless on any other connection. The role in front of H keeps the
+   signature of one side from being reflected as one of the other. B also
+   refuses (1) if T_A is off by more than MAX_CLOCK_SKEW or if it saw N_A
+   before, see ReplayCache.
+*/
+
+type MutualInit struct {
+	Initiator string // A
+	Responder string // B as A knows it
+	Nonce     [32]byte
+	Timestamp int64 // unix seconds
+}
+
+type MutualChallenge struct {
+	Nonce     [32]byte
+	Timestamp int64
+	PubKey    []byte // identity key of B, pkcs1 for v2 onions
+	Signature []byte
+}
+
+type MutualProof struct {
+	PubKey    []byte // identity key of A, pkcs1 for v2 onions
+	Signature []byte
+}
+
+// how far the clocks of two peers may be apart
+const MAX_CLOCK_SKEW = 10 * time.Minute
+
+func mutualTranscript(role string, binding []byte, init MutualInit, nonce [32]byte, timestamp int64) []byte {
+	buf := []byte("zwiebelnetz mutual auth\n" + role + "\n")
+	buf = append(buf, binding...)
+	buf = append(buf, []byte("\n"+init.Initiator+"\n"+init.Responder+"\n")...)
+	buf = append(buf, init.Nonce[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(init.Timestamp))
+	buf = append(buf, nonce[:]...)
+	return binary.BigEndian.AppendUint64(buf, uint64(timestamp))
+}
+
+func checkTimestamp(timestamp int64) error {
+	return checkTimestampAt(timestamp, time.Now())
+}
+
+func checkTimestampAt(timestamp int64, now time.Time) error {
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > MAX_CLOCK_SKEW || skew < -MAX_CLOCK_SKEW {
+		return errors.New("timestamp is off by " + skew.String())
+	}
+	return nil
+}
+
+// builds (1) for A authenticating to B
+func InitiateMutualAuth(A string, B string) (MutualInit, error) {
+	init := MutualInit{Initiator: A, Responder: B, Timestamp: time.Now().Unix()}
+	_, err := rand.Read(init.Nonce[:])
+	if err != nil {
+		return init, errors.New("Auth.InitiateMutualAuth: cannot get secure random number, error: " + err.Error())
+	}
+	return init, nil
+}
+
+// checks (1) for replays and builds (2), signed with the key of B
+func RespondMutualAuth(id *crypto.Identity, binding []byte, init MutualInit, replays *ReplayCache) (MutualChallenge, error) {
+	var challenge MutualChallenge
+	if err := replays.Check(init.Nonce, init.Timestamp); err != nil {
+		return challenge, errors.New("Auth.RespondMutualAuth: " + err.Error())
+	}
+
+	challenge.Timestamp = time.Now().Unix()
+	_, err := rand.Read(challenge.Nonce[:])
+	if err != nil {
+		return challenge, errors.New("Auth.RespondMutualAuth: cannot get secure random number, error: " + err.Error())
+	}
+	challenge.Signature, challenge.PubKey, err = id.SignAs(init.Responder,
+		mutualTranscript("b", binding, init, challenge.Nonce, challenge.Timestamp))
+	if err != nil {
+		return challenge, errors.New("Auth.RespondMutualAuth: cannot sign, error: " + err.Error())
+	}
+	return challenge, nil
+}
+
+// checks that (2) comes from B and builds (3), signed with the key of A
+func ProveMutualAuth(id *crypto.Identity, binding []byte, init MutualInit, challenge MutualChallenge) (MutualProof, error) {
+	var proof MutualProof
+	if err := checkTimestamp(challenge.Timestamp); err != nil {
+		return proof, errors.New("Auth.ProveMutualAuth: " + err.Error())
+	}
+	err := crypto.VerifyOnionSignature(init.Responder, challenge.PubKey,
+		mutualTranscript("b", binding, init, challenge.Nonce, challenge.Timestamp), challenge.Signature)
+	if err != nil {
+		return proof, errors.New("Auth.ProveMutualAuth: invalid signature of b, error: " + err.Error())
+	}
+	proof.Signature, proof.PubKey, err = id.SignAs(init.Initiator,
+		mutualTranscript("a", binding, init, challenge.Nonce, challenge.Timestamp))
+	if err != nil {
+		return proof, errors.New("Auth.ProveMutualAuth: cannot sign, error: " + err.Error())
+	}
+	return proof, nil
+}
+
+// checks that (3) comes from A
+func VerifyMutualAuth(binding []byte, init MutualInit, challenge MutualChallenge, proof MutualProof) error {
+	err := crypto.VerifyOnionSignature(init.Initiator, proof.PubKey,
+		mutualTranscript("a", binding, init, challenge.Nonce, challenge.Timestamp), proof.Signature)
+	if err != nil {
+		return errors.New("Auth.VerifyMutualAuth: invalid signature of a, error: " + err.Error())
+	}
+	return nil
+}
+
+// nonces a ReplayCache holds at most. (1) is checked before A is
+// authenticated, so anyone may fill it.
+const MAX_REPLAY_CACHE = 65536
+
+// remembers the nonces of (1) as long as their timestamp would be accepted
+type ReplayCache struct {
+	mutex   sync.Mutex
+	seen    map[[32]byte]bool
+	expires replayQueue // the nonces of seen, the first to expire first
+	limit   int
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: map[[32]byte]bool{}, limit: MAX_REPLAY_CACHE}
+}
+
+// fails if timestamp is too far off, nonce was seen before or the cache is
+// full
+func (cache *ReplayCache) Check(nonce [32]byte, timestamp int64) error {
+	return cache.check(nonce, timestamp, time.Now())
+}
+
+func (cache *ReplayCache) check(nonce [32]byte, timestamp int64, now time.Time) error {
+	if err := checkTimestampAt(timestamp, now); err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.seen[nonce] {
+		return errors.New("nonce was used before")
+	}
+
+	// a nonce whose timestamp would be rejected anyway can be forgotten
+	for len(cache.expires) > 0 && cache.expires[0].at < now.Add(-MAX_CLOCK_SKEW).Unix() {
+		delete(cache.seen, heap.Pop(&cache.expires).(replayEntry).nonce)
+	}
+	if len(cache.seen) >= cache.limit {
+		// forgetting one before it expires would allow to replay it
+		return errors.New("too many authentications, try again later")
+	}
+	cache.seen[nonce] = true
+	heap.Push(&cache.expires, replayEntry{nonce: nonce, at: timestamp})
+	return nil
+}
+
+type replayEntry struct {
+	nonce [32]byte
+	at    int64 // the timestamp of the nonce
+}
+
+// a heap of nonces by their timestamp
+type replayQueue []replayEntry
+
+func (queue replayQueue) Len() int           { return len(queue) }
+func (queue replayQueue) Less(i, j int) bool { return queue[i].at < queue[j].at }
+func (queue replayQueue) Swap(i, j int)      { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *replayQueue) Push(x interface{}) {
+	*queue = append(*queue, x.(replayEntry))
+}
+
+func (queue *replayQueue) Pop() interface{} {
+	old := *queue
+	entry := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return entry
+}
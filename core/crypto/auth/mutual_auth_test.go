@@ -0,0 +1,175 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package auth
+
+import "testing"
+import "crypto/rand"
+import "crypto/rsa"
+import "time"
+import "../../crypto"
+
+// runs (1) to (3) between A and B, returns the error of the first step
+// which failed
+func mutualAuth(A *crypto.Identity, A_Onion string, B *crypto.Identity, B_Onion string,
+	binding []byte, replays *ReplayCache) error {
+	init, err := InitiateMutualAuth(A_Onion, B_Onion)
+	if err != nil {
+		return err
+	}
+	challenge, err := RespondMutualAuth(B, binding, init, replays)
+	if err != nil {
+		return err
+	}
+	proof, err := ProveMutualAuth(A, binding, init, challenge)
+	if err != nil {
+		return err
+	}
+	return VerifyMutualAuth(binding, init, challenge, proof)
+}
+
+func TestMutualAuth(t *testing.T) {
+	A, A_Onion := newTestIdentity(t)
+	B, B_Onion := newTestIdentity(t)
+	if err := mutualAuth(A, A_Onion, B, B_Onion, []byte("hello"), NewReplayCache()); err != nil {
+		t.Fatalf("mutual authentication failed: error: %s\n", err.Error())
+	}
+	// a v2 onion authenticating to a v3 onion
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("could not generate rsa key: error: %s\n", err.Error())
+	}
+	V2 := &crypto.Identity{RSA: key}
+	if err = mutualAuth(V2, crypto.GetOnionAddress(&key.PublicKey), B, B_Onion, nil, NewReplayCache()); err != nil {
+		t.Fatalf("mutual authentication of v2 onion failed: error: %s\n", err.Error())
+	}
+}
+
+func TestWrongMutualAuth(t *testing.T) {
+	A, A_Onion := newTestIdentity(t)
+	B, B_Onion := newTestIdentity(t)
+	M, _ := newTestIdentity(t)
+	// M answers in place of B
+	if err := mutualAuth(A, A_Onion, M, B_Onion, nil, NewReplayCache()); err == nil {
+		t.Fatal("M was accepted as B!")
+	}
+	// M claims to be A
+	if err := mutualAuth(M, A_Onion, B, B_Onion, nil, NewReplayCache()); err == nil {
+		t.Fatal("M was accepted as A!")
+	}
+}
+
+func TestMutualAuthBinding(t *testing.T) {
+	A, A_Onion := newTestIdentity(t)
+	B, B_Onion := newTestIdentity(t)
+	init, _ := InitiateMutualAuth(A_Onion, B_Onion)
+	challenge, err := RespondMutualAuth(B, []byte("connection 1"), init, NewReplayCache())
+	if err != nil {
+		t.Fatalf("could not respond: error: %s\n", err.Error())
+	}
+	// a challenge of one connection relayed into another one
+	if _, err = ProveMutualAuth(A, []byte("connection 2"), init, challenge); err == nil {
+		t.Fatal("challenge of another connection was accepted!")
+	}
+	proof, err := ProveMutualAuth(A, []byte("connection 1"), init, challenge)
+	if err != nil {
+		t.Fatalf("could not prove: error: %s\n", err.Error())
+	}
+	if err = VerifyMutualAuth([]byte("connection 2"), init, challenge, proof); err == nil {
+		t.Fatal("proof of another connection was accepted!")
+	}
+	// a proof only fits the nonce of B it was made for
+	other, _ := RespondMutualAuth(B, []byte("connection 1"), init, NewReplayCache())
+	if err = VerifyMutualAuth([]byte("connection 1"), init, other, proof); err == nil {
+		t.Fatal("proof for another challenge was accepted!")
+	}
+	// the signature of B reflected as one of A
+	reflected := MutualProof{PubKey: challenge.PubKey, Signature: challenge.Signature}
+	init.Initiator = B_Onion
+	if err = VerifyMutualAuth([]byte("connection 1"), init, challenge, reflected); err == nil {
+		t.Fatal("reflected signature of b was accepted!")
+	}
+}
+
+func TestMutualAuthReplay(t *testing.T) {
+	A_Onion := "aaaaaaaaaaaaaaaa"
+	B, B_Onion := newTestIdentity(t)
+	replays := NewReplayCache()
+	init, _ := InitiateMutualAuth(A_Onion, B_Onion)
+	if _, err := RespondMutualAuth(B, nil, init, replays); err != nil {
+		t.Fatalf("could not respond: error: %s\n", err.Error())
+	}
+	if _, err := RespondMutualAuth(B, nil, init, replays); err == nil {
+		t.Fatal("replayed init was accepted!")
+	}
+	// too old and from the future
+	for _, offset := range []time.Duration{-2 * MAX_CLOCK_SKEW, 2 * MAX_CLOCK_SKEW} {
+		init, _ = InitiateMutualAuth(A_Onion, B_Onion)
+		init.Timestamp = time.Now().Add(offset).Unix()
+		if _, err := RespondMutualAuth(B, nil, init, replays); err == nil {
+			t.Fatalf("init with timestamp off by %s was accepted!", offset)
+		}
+	}
+	// B does not answer for onions which are not its own
+	init, _ = InitiateMutualAuth(A_Onion, A_Onion)
+	if _, err := RespondMutualAuth(B, nil, init, replays); err == nil {
+		t.Fatal("b answered for a foreign onion!")
+	}
+}
+
+func TestReplayCacheLimit(t *testing.T) {
+	replays := NewReplayCache()
+	replays.limit = 2
+	now := time.Now()
+	for i := byte(0); i < 2; i++ {
+		if err := replays.check([32]byte{i}, now.Unix(), now); err != nil {
+			t.Fatalf("could not check nonce %d: error: %s\n", i, err.Error())
+		}
+	}
+	if err := replays.check([32]byte{2}, now.Unix(), now); err == nil {
+		t.Fatal("full replay cache accepted a nonce!")
+	}
+
+	// once the first ones expired, there is room again
+	later := now.Add(MAX_CLOCK_SKEW + time.Minute)
+	if err := replays.check([32]byte{2}, later.Unix(), later); err != nil {
+		t.Fatalf("could not check nonce after the others expired: error: %s\n", err.Error())
+	}
+	if len(replays.seen) != 1 || len(replays.expires) != 1 {
+		t.Fatalf("%d nonces left in the replay cache instead of 1\n", len(replays.seen))
+	}
+	// the remaining one is still refused
+	if err := replays.check([32]byte{2}, later.Unix(), later); err == nil {
+		t.Fatal("replayed nonce was accepted!")
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha3"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* Tor v3 onion addresses
+ *
+ * onion    = base32(pubkey | checksum | version) + ".onion"
+ * checksum = sha3_256(".onion checksum" | pubkey | version)[:2]
+ * version  = 0x03
+ *
+ * The address contains the whole ed25519 public key, a v3 onion therefore
+ * identifies its key without any lookup.
+ */
+
+const (
+	ONION_V2_LENGTH  = 16
+	ONION_V3_LENGTH  = 56
+	ONION_V3_VERSION = 0x03
+)
+
+func onionV3Checksum(key ed25519.PublicKey) []byte {
+	buf := append([]byte(".onion checksum"), key...)
+	buf = append(buf, ONION_V3_VERSION)
+	sum := sha3.Sum256(buf)
+	return sum[:2]
+}
+
+func GetOnionAddressV3(key ed25519.PublicKey) string {
+	buf := append(append([]byte{}, key...), onionV3Checksum(key)...)
+	buf = append(buf, ONION_V3_VERSION)
+	onion := base32.StdEncoding.EncodeToString(buf)
+	return strings.ToLower(onion) + ".onion"
+}
+
+// extracts the public key of a v3 onion and checks version and checksum
+func OnionV3PublicKey(onion string) (ed25519.PublicKey, error) {
+	name := strings.TrimSuffix(onion, ".onion")
+	if len(name) != ONION_V3_LENGTH {
+		return nil, errors.New("not a v3 onion address: " + onion)
+	}
+	buf, err := base32.StdEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil {
+		return nil, errors.New("could not decode onion address: " + err.Error())
+	}
+	key := ed25519.PublicKey(buf[0:ed25519.PublicKeySize])
+	if buf[34] != ONION_V3_VERSION {
+		return nil, errors.New("unknown onion version")
+	}
+	checksum := onionV3Checksum(key)
+	if buf[32] != checksum[0] || buf[33] != checksum[1] {
+		return nil, errors.New("onion address checksum mismatch")
+	}
+	return key, nil
+}
+
+// returns 2 or 3 for well formed onion addresses and 0 otherwise
+func OnionVersion(onion string) int {
+	name := strings.TrimSuffix(onion, ".onion")
+	if name == onion {
+		return 0
+	}
+	switch len(name) {
+	case ONION_V2_LENGTH:
+		return 2
+	case ONION_V3_LENGTH:
+		if _, err := OnionV3PublicKey(onion); err == nil {
+			return 3
+		}
+	}
+	return 0
+}
+
+/* Tor key files
+ *
+ * Tor stores the key of a v3 hidden service in its "expanded" form: the
+ * clamped scalar and the prefix derived from the seed with sha512. The seed
+ * cannot be recovered from it, so we generate the key ourselves and hand the
+ * expanded form to Tor instead of importing the one Tor generated.
+ */
+
+func ExpandEd25519Key(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:]
+}
+
+func WriteTorV3Keys(dir string, key ed25519.PrivateKey) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	secret := append([]byte("== ed25519v1-secret: type0 ==\x00\x00\x00"), ExpandEd25519Key(key)...)
+	public := append([]byte("== ed25519v1-public: type0 ==\x00\x00\x00"), key.Public().(ed25519.PublicKey)...)
+	hostname := []byte(GetOnionAddressV3(key.Public().(ed25519.PublicKey)) + "\n")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), secret, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hs_ed25519_public_key"), public, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "hostname"), hostname, 0600)
+}
+
+func GenerateEd25519Key() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+func Ed25519Key2Pem(key ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func Pem2Ed25519Key(pemKey []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no pkcs8 private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("pkcs8 key is not an ed25519 key")
+	}
+	return edKey, nil
+}
+
+/* Identity
+ *
+ * The keys a node authenticates and signs with. Nodes with an ed25519 key
+ * live on a v3 onion. Nodes set up before v3 only have the RSA key of their
+ * v2 onion, nodes which migrated keep it to prove to their old contacts that
+ * the new onion is theirs.
+ */
+
+type Identity struct {
+	RSA     *rsa.PrivateKey
+	Ed25519 ed25519.PrivateKey
+}
+
+// reads a pem file holding either an RSA (v2) or an ed25519 (v3) key
+func ReadIdentity(path string) (*Identity, error) {
+	pemKey, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseIdentity(pemKey)
+}
+
+func ParseIdentity(pemKey []byte) (*Identity, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{RSA: key}, nil
+	case "PRIVATE KEY":
+		key, err := Pem2Ed25519Key(pemKey)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Ed25519: key}, nil
+	}
+	return nil, errors.New("unknown key type " + block.Type)
+}
+
+func (id *Identity) Onion() string {
+	if id.Ed25519 != nil {
+		return GetOnionAddressV3(id.Ed25519.Public().(ed25519.PublicKey))
+	}
+	if id.RSA != nil {
+		return GetOnionAddress(&id.RSA.PublicKey)
+	}
+	return ""
+}
+
+// signs data with the key of our onion, returns the signature and the
+// public key to check it with (ed25519 or pkcs1)
+func (id *Identity) Sign(data []byte) ([]byte, []byte, error) {
+	if id.Ed25519 != nil {
+		return ed25519.Sign(id.Ed25519, data), []byte(id.Ed25519.Public().(ed25519.PublicKey)), nil
+	}
+	if id.RSA != nil {
+		sig, err := Sign(id.RSA, data)
+		return sig, MarshalPKCS1PublicKey(&id.RSA.PublicKey), err
+	}
+	return nil, nil, errors.New("identity without key")
+}
+
+// signs data with the key of onion, which has to be one of ours. Nodes
+// which moved to a v3 onion still answer on their v2 onion with the RSA key.
+func (id *Identity) SignAs(onion string, data []byte) ([]byte, []byte, error) {
+	if id.Ed25519 != nil && GetOnionAddressV3(id.Ed25519.Public().(ed25519.PublicKey)) == onion {
+		return ed25519.Sign(id.Ed25519, data), []byte(id.Ed25519.Public().(ed25519.PublicKey)), nil
+	}
+	if id.RSA != nil && GetOnionAddress(&id.RSA.PublicKey) == onion {
+		sig, err := Sign(id.RSA, data)
+		return sig, MarshalPKCS1PublicKey(&id.RSA.PublicKey), err
+	}
+	return nil, nil, errors.New("no key for " + onion)
+}
+
+func MigrationStatement(newOnion string) []byte {
+	return []byte("zwiebelnetz onion migration\n" + newOnion)
+}
+
+// for nodes which moved from a v2 to a v3 onion: the old RSA key (pkcs1) and
+// its signature over the new onion, nil if there is nothing to prove
+func (id *Identity) LegacyProof() ([]byte, []byte) {
+	if id.RSA == nil || id.Ed25519 == nil {
+		return nil, nil
+	}
+	sig, err := Sign(id.RSA, MigrationStatement(id.Onion()))
+	if err != nil {
+		return nil, nil
+	}
+	return MarshalPKCS1PublicKey(&id.RSA.PublicKey), sig
+}
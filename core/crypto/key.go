@@ -35,8 +35,13 @@ package crypto
 
 import (
 	"../../logger"
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base32"
@@ -100,3 +105,38 @@ func GetOnionAddress(key *rsa.PublicKey) string {
 	onion := base32.StdEncoding.EncodeToString(sha[:])
 	return fmt.Sprintf("%s.onion", strings.ToLower(onion)[0:16])
 }
+
+// signs the SHA-256 hash of data with PKCS#1 v1.5
+func Sign(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, key, stdcrypto.SHA256, hash[:])
+}
+
+// checks that pubKey is the key of onion and that sig is its signature over
+// data. pubKey is pkcs1 for v2 onions, for v3 onions it may be empty since
+// the address contains the ed25519 key
+func VerifyOnionSignature(onion string, pubKey []byte, data []byte, sig []byte) error {
+	if OnionVersion(onion) == 3 {
+		key, err := OnionV3PublicKey(onion)
+		if err != nil {
+			return err
+		}
+		if len(pubKey) > 0 && !bytes.Equal(pubKey, key) {
+			return errors.New("public key does not belong to " + onion)
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	}
+
+	key, err := UnmarshalPKCS1PublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	if GetOnionAddress(&key) != onion {
+		return errors.New("public key does not belong to " + onion)
+	}
+	hash := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(&key, stdcrypto.SHA256, hash[:], sig)
+}
@@ -36,13 +36,30 @@ package db
 type RelationStatus uint8
 
 const (
-	BLOCKED   RelationStatus = 0
-	OPEN                     = 1
-	PENDING                  = 2
-	SUCCESS                  = 3
-	FOLLOWING                = 4
+	BLOCKED     RelationStatus = 0
+	OPEN                       = 1
+	PENDING                    = 2
+	SUCCESS                    = 3
+	FOLLOWING                  = 4
+	DECLINED                   = 5 // the contact request was declined, by us or the contact
+	EXPIRED                    = 6 // our request was never answered
+	COMPROMISED                = 7 // presented a key which differs from the pinned one, not synced until it is re-pinned
 )
 
+// the answer to a contact request
+type ContactDecision uint8
+
+const (
+	NO_DECISION      ContactDecision = 0
+	ACCEPTED                         = 1
+	DECLINED_REQUEST                 = 2
+	BLOCKED_REQUEST                  = 3
+)
+
+// number of times we send a contact request before it expires, set before
+// the first sync
+var MaxContactRequestAttempts = 100
+
 type Contact struct {
 	Id             int64          `json:"id"`
 	Onion          Onion          `json:"-"`
@@ -52,7 +69,17 @@ type Contact struct {
 	Trust          int            `json:"trust" sql:"not null;default:0"`
 	Status         RelationStatus `json:"status" sql:"not null"`
 	RequestMessage string         `json:"request_message"`
-	Circles        []Circle       `json:"-" gorm:"many2many:circle_contacts;"`
+	// the contact request was signed by the owner of the onion, unsigned
+	// ones come from peers before signatures and may be forged
+	RequestVerified bool   `json:"request_verified" sql:"not null;default:0"`
+	RequestAttempts uint32 `json:"request_attempts" sql:"not null;default:0"` // times we sent our request
+	// the decision we still have to send for the request of the contact
+	Response        ContactDecision `json:"-" sql:"not null;default:0"`
+	ResponseMessage string          `json:"response_message"`
+	// the status of a compromised contact before, it goes back to it once
+	// the key is re-pinned
+	StatusBeforeCompromise RelationStatus `json:"-" sql:"not null;default:0"`
+	Circles                []Circle       `json:"-" gorm:"many2many:circle_contacts;"`
 }
 
 type EmberContactResponse struct {
@@ -71,6 +98,34 @@ type EmberContactRequest struct {
 	EmberCircles   []string       `json:"circles"`
 }
 
+// marks contact compromised and remembers its status for the re-pin
+func (contact *Contact) compromise() {
+	if contact.Status != COMPROMISED {
+		contact.StatusBeforeCompromise = contact.Status
+	}
+	contact.Status = COMPROMISED
+}
+
+// the status a compromised contact goes back to once its key is re-pinned
+func (contact *Contact) statusAfterRepin() RelationStatus {
+	if contact.StatusBeforeCompromise == BLOCKED {
+		// compromised before the status was kept, only contacts we synced
+		// with can be compromised
+		return SUCCESS
+	}
+	return contact.StatusBeforeCompromise
+}
+
+// whether a contact with status may authenticate to us and sync. Declined,
+// expired and compromised contacts may not, though their status is higher.
+func IsFriendly(rs RelationStatus) bool {
+	switch rs {
+	case PENDING, SUCCESS, FOLLOWING:
+		return true
+	}
+	return false
+}
+
 func StatusString(rs RelationStatus) string {
 	switch rs {
 	case BLOCKED:
@@ -81,6 +136,12 @@ func StatusString(rs RelationStatus) string {
 		return "pending"
 	case SUCCESS:
 		return "success"
+	case DECLINED:
+		return "declined"
+	case EXPIRED:
+		return "expired"
+	case COMPROMISED:
+		return "compromised"
 	}
 	return ""
 }
@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package db
+
+import "testing"
+
+func TestFriendlyStatus(t *testing.T) {
+	statuses := map[RelationStatus]bool{
+		BLOCKED:     false,
+		OPEN:        false,
+		PENDING:     true,
+		SUCCESS:     true,
+		FOLLOWING:   true,
+		DECLINED:    false,
+		EXPIRED:     false,
+		COMPROMISED: false,
+	}
+	for status, friendly := range statuses {
+		if IsFriendly(status) != friendly {
+			t.Fatalf("contact with status %d may authenticate: %v instead of %v\n", status, !friendly, friendly)
+		}
+	}
+}
+
+func TestRepinRestoresStatus(t *testing.T) {
+	for _, status := range []RelationStatus{PENDING, SUCCESS, FOLLOWING} {
+		contact := Contact{Status: status}
+		contact.compromise()
+		contact.compromise() // a second mismatch keeps the status from before
+		if contact.Status != COMPROMISED {
+			t.Fatalf("contact with status %s was not compromised\n", StatusString(status))
+		}
+		if restored := contact.statusAfterRepin(); restored != status {
+			t.Fatalf("contact with status %s went back to %s\n", StatusString(status), StatusString(restored))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package db
+
+import (
+	"time"
+)
+
+type DeliveryState uint8
+
+const (
+	DELIVERY_PENDING   DeliveryState = 0
+	DELIVERY_DELIVERED               = 1
+	DELIVERY_FAILED                  = 2 // given up after OUTBOX_MAX_ATTEMPTS
+)
+
+// first retry of a failed delivery, doubled on every further attempt
+const OUTBOX_BACKOFF = 30 * time.Second
+const OUTBOX_MAX_BACKOFF = time.Hour
+const OUTBOX_MAX_ATTEMPTS = 12
+
+// time a claimed delivery is left to its sender before others may retry it
+const OUTBOX_LEASE = 5 * time.Minute
+
+// a TRIGGER we owe an onion. There is at most one per onion, a new one
+// replaces the last.
+type Delivery struct {
+	Id          int64         `json:"id"`
+	OnionId     int64         `json:"onion" sql:"not null;unique"`
+	ContactId   int64         `json:"contact" sql:"-"`
+	State       DeliveryState `json:"state" sql:"not null;default:0"`
+	Attempts    uint32        `json:"attempts" sql:"not null;default:0"`
+	NextAttempt int64         `json:"next_attempt"` // unix seconds
+	LastError   string        `json:"last_error"`
+	QueuedAt    time.Time     `json:"queued_at"`
+	DeliveredAt time.Time     `json:"delivered_at"`
+}
+
+func DeliveryStateString(state DeliveryState) string {
+	switch state {
+	case DELIVERY_PENDING:
+		return "pending"
+	case DELIVERY_DELIVERED:
+		return "delivered"
+	case DELIVERY_FAILED:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// time to wait after the given number of failed attempts
+func deliveryBackoff(attempts uint32) time.Duration {
+	backoff := OUTBOX_BACKOFF
+	for i := uint32(1); i < attempts && backoff < OUTBOX_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > OUTBOX_MAX_BACKOFF {
+		backoff = OUTBOX_MAX_BACKOFF
+	}
+	return backoff
+}
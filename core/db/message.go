@@ -0,0 +1,68 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// the direct messages between us and one onion
+type Conversation struct {
+	Id            int64     `json:"id"`
+	OnionId       int64     `json:"onion" sql:"not null;unique"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	Unread        int       `json:"unread" sql:"-"` // filled for the REST API
+	ContactId     int64     `json:"contact" sql:"-"`
+}
+
+// a direct message, only ever sent to the other party of its conversation
+type Message struct {
+	Id             int64     `json:"id"`
+	ConversationId int64     `json:"conversation" sql:"not null"`
+	Hash           string    `json:"hash" sql:"not null"`
+	Outgoing       bool      `json:"outgoing" sql:"not null;default:0"`
+	Body           string    `json:"body"`
+	SentAt         time.Time `json:"sent_at"`
+	Read           bool      `json:"read" sql:"not null;default:0"`
+	Seq            int64     `json:"-" sql:"-"` // position in our sync stream, kept by the database
+}
+
+// identifies a message within its conversation, peers send it along so
+// messages pulled twice are stored once
+func (msg *Message) CalcHash(sender string, recipient string) {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%d\n%s", sender, recipient, msg.SentAt.UnixNano(), msg.Body)))
+	msg.Hash = hex.EncodeToString(hash[:])
+}
@@ -33,9 +33,17 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package db
 
+import (
+	"time"
+)
+
 type Onion struct {
-	Id    int64  `json:"id"`
-	Onion string `json:"onion",sql:"unique; not null"`
+	Id          int64     `json:"id"`
+	Onion       string    `json:"onion",sql:"unique; not null"`
+	Version     uint8     `json:"version"`      // 2 or 3, see crypto.OnionVersion
+	LegacyOnion string    `json:"legacy_onion"` // v2 onion this peer used before it moved to a v3 onion
+	PublicKey   string    `json:"-"`            // pinned public key (pkcs1 or ed25519), base64, empty until first auth
+	PinnedAt    time.Time `json:"pinned_at"`
 }
 
 type EmberOnion struct {
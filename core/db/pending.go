@@ -37,4 +37,5 @@ type Pending struct {
 	Id       int64
 	Posts    bool
 	Contacts bool
+	Security bool
 }
@@ -36,10 +36,13 @@ package db
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"../../logger"
+	"../crypto"
 )
 
 type Post struct {
@@ -60,15 +63,82 @@ type Post struct {
 	Hash              string    `json:"hash" sql:"unique; not null" `
 	ParentId          int64     `json:"parent"`
 	ParentHash        string    `sql:"-"`
+	Signature         string    `json:"-"`                                 // author's signature over SignedData, base64
+	AuthorKey         string    `json:"-"`                                 // author's public key (pkcs1), base64
+	Verified          bool      `json:"verified" sql:"not null;default:0"` // signature checked on receipt
+	DeleteSignature   string    `json:"-"`                                 // author's signature over DeletionData, base64
+	Revision          uint32    `json:"revision" sql:"not null;default:0"` // incremented on every edit, the hash stays the one of revision 0
+	EditedAt          time.Time `json:"edited_at"`
+	Seq               int64     `json:"-" sql:"-"`                   // position in our sync stream, kept by the database
+	ReshareChain      string    `json:"-" sql:"not null;default:''"` // onions which reshared the post between author and us, space separated
 	Circles           []Circle  `json:"-" gorm:"many2many:circle_posts;"`
 }
 
+// longest reshare chain we keep, the frontend offers a TTL of up to 5
+const MAX_RESHARE_HOPS = 16
+
+// the onions which reshared the post, the one nearest to the author first
+func (post *Post) Resharers() []string {
+	return strings.Fields(post.ReshareChain)
+}
+
+func (post *Post) SetResharers(onions []string) {
+	post.ReshareChain = strings.Join(onions, " ")
+}
+
 func (post *Post) CalcHash() {
 	if post.Author.Onion == "" {
 		logger.Error("Post.CalcHash: Author onion not set!")
 	}
 
-	bin := append(append([]byte(post.Message), []byte(fmt.Sprintf("%ld", post.PostedAt.Unix()))...), []byte(post.Author.Onion)...)
+	// what the verb %ld always printed, hashes of existing posts depend on it
+	posted := fmt.Sprintf("%%!l(int64=%d)d", post.PostedAt.Unix())
+	bin := append(append([]byte(post.Message), []byte(posted)...), []byte(post.Author.Onion)...)
 	hash := sha256.Sum256(bin)
 	post.Hash = base64.StdEncoding.EncodeToString(hash[:])
 }
+
+// the bytes the author signs, the hash already covers message, posted at and
+// author of the first revision. Edits sign their revision and message as well.
+func (post *Post) SignedData() []byte {
+	data := "post\n" + post.Hash + "\n" + post.ParentHash
+	if post.Revision > 0 {
+		data += fmt.Sprintf("\n%d\n%s", post.Revision, post.Message)
+	}
+	return []byte(data)
+}
+
+// the bytes the author signs to delete the post
+func (post *Post) DeletionData() []byte {
+	return []byte("delete\n" + post.Hash)
+}
+
+func (post *Post) IsDeleted() bool {
+	return !post.DeletedAt.IsZero()
+}
+
+func (post *Post) VerifySignature() error {
+	if post.Signature == "" {
+		return errors.New("post is not signed")
+	}
+	return post.verify(post.Signature, post.SignedData())
+}
+
+func (post *Post) VerifyDeletion() error {
+	if post.DeleteSignature == "" {
+		return errors.New("deletion is not signed")
+	}
+	return post.verify(post.DeleteSignature, post.DeletionData())
+}
+
+func (post *Post) verify(signature string, data []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("could not decode signature: " + err.Error())
+	}
+	key, err := base64.StdEncoding.DecodeString(post.AuthorKey)
+	if err != nil {
+		return errors.New("could not decode author key: " + err.Error())
+	}
+	return crypto.VerifyOnionSignature(post.Author.Onion, key, data, sig)
+}
@@ -45,5 +45,20 @@ type Profile struct {
 	ChangedAt time.Time `json:"changed_at"`
 	OnionId   int64     `json:"-"`
 	Onion     Onion     `json:"-"`
+	Seq       int64     `json:"-" sql:"-"` // position in our sync stream, kept by the database
 	Circles   []Circle  `json:"-" gorm:"many2many:circle_profiles;"`
 }
+
+// a key of our profile a contact got a value for. Only these contacts get
+// tombstones for the key, the others never learn it existed. ContactId 0
+// stands for the peers pulling without AUTH.
+type ProfileShare struct {
+	Id        int64
+	ContactId int64  `sql:"not null"`
+	Key       string `sql:"not null"`
+}
+
+// tombstones of profile entries are sent with DeletedAt set
+func (prof *Profile) IsDeleted() bool {
+	return !prof.DeletedAt.IsZero()
+}
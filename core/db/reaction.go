@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package db
+
+import (
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the reaction most clients offer
+const REACTION_LIKE = "like"
+
+// longest reaction in bytes, enough for emoji sequences
+const MAX_REACTION_LEN = 32
+
+// a reaction of author to a post or comment. Removed reactions stay as
+// tombstones so the originator of the post learns about it.
+type Reaction struct {
+	Id        int64     `json:"id"`
+	PostId    int64     `json:"post" sql:"not null"`
+	PostHash  string    `json:"-" sql:"-"`
+	AuthorId  int64     `json:"author" sql:"not null"`
+	Kind      string    `json:"kind" sql:"not null"`
+	ChangedAt time.Time `json:"changed_at"`
+	DeletedAt time.Time `json:"-"`
+	Seq       int64     `json:"-" sql:"-"` // position in our sync stream, kept by the database
+}
+
+func (reaction *Reaction) IsDeleted() bool {
+	return !reaction.DeletedAt.IsZero()
+}
+
+// the reactions to a post counted by its originator, we store the counts of
+// posts others originated
+type ReactionCount struct {
+	Id     int64  `json:"id"`
+	PostId int64  `json:"post" sql:"not null"`
+	Kind   string `json:"kind" sql:"not null"`
+	Count  int    `json:"count"`
+}
+
+// the counts of the reactions to a post as the originator sends them
+type PostReactions struct {
+	PostHash string
+	Counts   map[string]int
+}
+
+// "like" or an emoji: short, printable and without spaces
+func ValidReactionKind(kind string) bool {
+	if kind == "" || len(kind) > MAX_REACTION_LEN || !utf8.ValidString(kind) {
+		return false
+	}
+	for _, r := range kind {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
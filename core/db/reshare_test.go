@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package db
+
+import "testing"
+import "time"
+
+const testSelf = 1
+
+func newResharablePost() *Post {
+	return &Post{AuthorId: 2, TTL: 3, Verified: true}
+}
+
+func TestReshare(t *testing.T) {
+	if err := reshareError(newResharablePost(), testSelf); err != nil {
+		t.Fatalf("could not reshare post: error: %s\n", err.Error())
+	}
+}
+
+func TestReshareUnverified(t *testing.T) {
+	post := newResharablePost()
+	post.Verified = false
+	if reshareError(post, testSelf) == nil {
+		t.Fatalf("post without a verified signature was reshared\n")
+	}
+}
+
+func TestWrongReshare(t *testing.T) {
+	own := newResharablePost()
+	own.AuthorId = testSelf
+	comment := newResharablePost()
+	comment.ParentId = 4
+	deleted := newResharablePost()
+	deleted.DeletedAt = time.Now()
+	expired := newResharablePost()
+	expired.TTL = 0
+
+	for _, post := range []*Post{own, comment, deleted, expired} {
+		if reshareError(post, testSelf) == nil {
+			t.Fatalf("post %+v was reshared\n", post)
+		}
+	}
+}
@@ -37,13 +37,17 @@ import (
 	"../../logger"
 	"../crypto"
 	"container/list"
-	"crypto/rsa"
+	"crypto/ed25519"
 	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -52,12 +56,18 @@ type SSNDB struct {
 	gorm.DB
 
 	// prepared statements:
-	getPostsStmt            *sql.Stmt // prepared statemtn to get all post for a given user newer than a specified timestamp
-	getCommentsStmt         *sql.Stmt
-	getProfileStmt          *sql.Stmt // prepared statemtn to get all profile (key, value) pairs for a given user newer than a specified timestamp
-	getPublicPostsStmt      *sql.Stmt // get all public posts
-	getPublicProfileStmt    *sql.Stmt // get public profile (key, value) pairs
-	getContactsLastActivity *sql.Stmt
+	getPostsStmt             *sql.Stmt // prepared statemtn to get all post for a given user newer than a specified timestamp
+	getCommentsStmt          *sql.Stmt
+	getProfileStmt           *sql.Stmt // prepared statemtn to get all profile (key, value) pairs for a given user newer than a specified timestamp
+	getPublicPostsStmt       *sql.Stmt // get all public posts
+	getPublicProfileStmt     *sql.Stmt // get public profile (key, value) pairs
+	getContactsLastActivity  *sql.Stmt
+	getTombstonesStmt        *sql.Stmt // deleted posts a given contact could see, deleted after a specified timestamp
+	getPublicTombstonesStmt  *sql.Stmt // deleted public posts
+	getCommentTombstonesStmt *sql.Stmt // our deleted comments on posts of a given originator
+	getPostsSeqStmt          *sql.Stmt // posts and tombstones a given contact could see, after a sequence number
+	getPublicPostsSeqStmt    *sql.Stmt // public posts and tombstones after a sequence number
+	getCommentsSeqStmt       *sql.Stmt // our comments and their tombstones on posts of a given originator, after a sequence number
 	// getContactByOnionStmt     *sql.Stmt // get contact by onion address
 }
 
@@ -76,11 +86,41 @@ func (this *SSNDB) GetUser() User {
 	return user
 }
 
-func (this *SSNDB) GetKey() *rsa.PrivateKey {
+func (this *SSNDB) GetIdentity() *crypto.Identity {
 	user := this.GetUser()
-	key := crypto.Pem2Key([]byte(user.PemKey))
-	logger.AssertError(key != nil, "CRITICAL: Could not get user Key!")
-	return key
+	id, err := crypto.ParseIdentity([]byte(user.PemKey))
+	logger.ConditionalError(err, "CRITICAL: Could not get user Key!")
+	if user.LegacyPem != "" {
+		id.RSA = crypto.Pem2Key([]byte(user.LegacyPem))
+		logger.AssertError(id.RSA != nil, "CRITICAL: Could not get legacy user Key!")
+	}
+	return id
+}
+
+// moves the main user to the v3 onion of key, the RSA key of the old v2
+// onion is kept to prove the move to our contacts
+func (this *SSNDB) MigrateIdentity(key ed25519.PrivateKey) error {
+	user := this.GetUser()
+	id := this.GetIdentity()
+	if id.Ed25519 != nil {
+		return errors.New("identity is already a v3 identity")
+	}
+	pemKey, err := crypto.Ed25519Key2Pem(key)
+	if err != nil {
+		return err
+	}
+
+	self := this.GetSelfOnion()
+	self.LegacyOnion = self.Onion
+	self.Onion = crypto.GetOnionAddressV3(key.Public().(ed25519.PublicKey))
+	self.Version = 3
+	if err := this.Save(&self).Error; err != nil {
+		return err
+	}
+
+	user.LegacyPem = user.PemKey
+	user.PemKey = string(pemKey)
+	return this.Save(&user).Error
 }
 
 func GetDBName() string {
@@ -101,8 +141,13 @@ func GetDBName() string {
 }
 
 func (this *SSNDB) Init() {
+	this.Open(GetDBName())
+}
+
+// opens the database in the file dbname, for nodes besides the one of the
+// user, like those of a simulation
+func (this *SSNDB) Open(dbname string) {
 	var err error
-	dbname := GetDBName()
 	this.DB, err = gorm.Open("sqlite3", dbname)
 	logger.ConditionalError(err, "Could not open database '"+dbname+"'")
 
@@ -116,6 +161,28 @@ func (this *SSNDB) Init() {
 	this.AutoMigrate(User{})
 	this.AutoMigrate(Profile{})
 	this.AutoMigrate(Pending{})
+	this.AutoMigrate(SecurityEvent{})
+	this.AutoMigrate(PostRevision{})
+	this.AutoMigrate(SyncState{})
+	this.AutoMigrate(Delivery{})
+	this.AutoMigrate(Conversation{})
+	this.AutoMigrate(Message{})
+	this.AutoMigrate(Reaction{})
+	this.AutoMigrate(ReactionCount{})
+	this.AutoMigrate(TorStatus{})
+	this.profileShares()
+
+	if this.sequence() {
+		this.migrateSyncStates()
+	}
+
+	// profile entries which only announced deletions, tombstones replaced them
+	this.Exec("DELETE FROM circle_profiles WHERE profile_id IN (SELECT id FROM profiles WHERE key = '')")
+	this.Exec("DELETE FROM profiles WHERE key = ''")
+
+	// onions stored before v3 support have no version yet
+	this.Exec("UPDATE onions SET version = 2 WHERE version = 0 AND length(onion) = ?", ONION_V2_LEN)
+	this.Exec("UPDATE onions SET version = 3 WHERE version = 0 AND length(onion) = ?", ONION_V3_LEN)
 
 	var p Pending
 	this.Find(&p, 1)
@@ -141,7 +208,8 @@ func (this *SSNDB) Init() {
 func (this *SSNDB) prepare() {
 	var err error
 	postColumns := "P.id, P.message, P.created_at, P.updated_at, P.deleted_at, P.t_t_l-1, P.published, " +
-		"P.originator_id, P.author_id, P.posted_at, P.published_at, P.remote_published_at, P.hash, P.parent_id "
+		"P.originator_id, P.author_id, P.posted_at, P.published_at, P.remote_published_at, P.hash, P.parent_id, " +
+		"P.signature, P.author_key, P.delete_signature, P.revision, P.edited_at, P.seq, P.reshare_chain "
 	this.getPostsStmt, err = this.DB.DB().Prepare(
 		"SELECT DISTINCT " + postColumns +
 			"FROM posts AS P JOIN circle_posts ON P.id = circle_posts.post_id " +
@@ -161,8 +229,65 @@ func (this *SSNDB) prepare() {
 
 	logger.ConditionalError(err, "Failed to create prepared statement")
 
+	// tombstones: the same posts, but deleted. published_at is set to the
+	// time of deletion, see DeletePost
+	this.getTombstonesStmt, err = this.DB.DB().Prepare(
+		"SELECT DISTINCT " + postColumns +
+			"FROM posts AS P JOIN circle_posts ON P.id = circle_posts.post_id " +
+			"JOIN circles ON circle_posts.circle_id = circles.id              " +
+			"JOIN circle_contacts ON circle_contacts.circle_id = circles.id   " +
+			"WHERE circle_contacts.contact_id = ? AND P.published_at > ? AND P.published = 1 " +
+			"AND p.deleted_at != datetime('0001-01-01 00:00:00') ORDER BY P.id")
+
+	logger.ConditionalError(err, "Failed to create prepared statement")
+
+	this.getPublicTombstonesStmt, err = this.DB.DB().Prepare(
+		"SELECT DISTINCT " + postColumns +
+			"FROM posts AS P JOIN circle_posts ON P.id = circle_posts.post_id " +
+			"JOIN circles ON circle_posts.circle_id = circles.id              " +
+			"WHERE circles.name = 'Public' AND P.published_at > ? AND P.published = 1 " +
+			"AND p.deleted_at != datetime('0001-01-01 00:00:00') ORDER BY P.id")
+
+	logger.ConditionalError(err, "Failed to create prepared statement")
+
+	this.getCommentTombstonesStmt, err = this.DB.DB().Prepare(
+		"SELECT " + postColumns +
+			"FROM posts AS P " +
+			"WHERE P.originator_id = ? AND P.author_id = ? AND p.parent_id != 0 AND p.published_at > ? AND P.published = 1 " +
+			"AND p.deleted_at != datetime('0001-01-01 00:00:00') ORDER BY P.id")
+
+	logger.ConditionalError(err, "Failed to create prepared statement")
+
+	// the sync stream: live posts and tombstones in the order of their
+	// sequence number, see sequence()
+	this.getPostsSeqStmt, err = this.DB.DB().Prepare(
+		"SELECT DISTINCT " + postColumns +
+			"FROM posts AS P JOIN circle_posts ON P.id = circle_posts.post_id " +
+			"JOIN circles ON circle_posts.circle_id = circles.id              " +
+			"JOIN circle_contacts ON circle_contacts.circle_id = circles.id   " +
+			"WHERE circle_contacts.contact_id = ? AND P.seq > ? AND P.published = 1 " +
+			"AND (p.t_t_l > 0 OR p.deleted_at != datetime('0001-01-01 00:00:00')) ORDER BY P.seq LIMIT ?")
+
+	logger.ConditionalError(err, "Failed to create prepared statement")
+
+	this.getPublicPostsSeqStmt, err = this.DB.DB().Prepare(
+		"SELECT DISTINCT " + postColumns +
+			"FROM posts AS P JOIN circle_posts ON P.id = circle_posts.post_id " +
+			"JOIN circles ON circle_posts.circle_id = circles.id              " +
+			"WHERE circles.name = 'Public' AND P.seq > ? AND P.published = 1 ORDER BY P.seq LIMIT ?")
+
+	logger.ConditionalError(err, "Failed to create prepared statement")
+
+	this.getCommentsSeqStmt, err = this.DB.DB().Prepare(
+		"SELECT " + postColumns +
+			"FROM posts AS P " +
+			"WHERE P.originator_id = ? AND P.author_id = ? AND p.parent_id != 0 AND P.seq > ? AND P.published = 1 " +
+			"AND (p.t_t_l > 0 OR p.deleted_at != datetime('0001-01-01 00:00:00')) ORDER BY P.seq LIMIT ?")
+
+	logger.ConditionalError(err, "Failed to create prepared statement")
+
 	this.getProfileStmt, err = this.DB.DB().Prepare(
-		"SELECT DISTINCT P.id, P.key, P.value, P.changed_at, P.onion_id " +
+		"SELECT DISTINCT P.id, P.key, P.value, P.changed_at, P.onion_id, P.seq " +
 			"FROM profiles AS P JOIN circle_profiles ON P.id = circle_profiles.profile_id " +
 			"JOIN circles ON circle_profiles.circle_id = circles.id              " +
 			"JOIN circle_contacts ON circle_contacts.circle_id = circles.id   " +
@@ -177,7 +302,7 @@ func (this *SSNDB) prepare() {
 			"WHERE circles.name = 'Public' AND P.published_at > ? AND P.published = 1 AND p.deleted_at = datetime('0001-01-01 00:00:00') ORDER BY P.id  ")
 
 	this.getPublicProfileStmt, err = this.DB.DB().Prepare(
-		"SELECT DISTINCT  P.id, P.key, P.value, P.changed_at, P.onion_id " +
+		"SELECT DISTINCT  P.id, P.key, P.value, P.changed_at, P.onion_id, P.seq " +
 			"FROM profiles AS P JOIN circle_profiles ON P.id = circle_profiles.profile_id " +
 			"JOIN circles ON circle_profiles.circle_id = circles.id              " +
 			"WHERE circles.name = 'Public' AND P.onion_id=? AND p.deleted_at = datetime('0001-01-01 00:00:00') ORDER BY P.id  ")
@@ -196,6 +321,99 @@ func (this *SSNDB) prepare() {
 	logger.ConditionalError(err, "Failed to create prepared statement")
 }
 
+/* Sync Sequence
+ *
+ * Every insert of a post or profile and every change a peer has to learn
+ * about takes the next number of one sequence, the sync stream is
+ * ordered by it. Unlike timestamps it neither depends on the clock nor on
+ * its resolution. Triggers keep it, so it does not matter which process
+ * writes.
+ *
+ * returns true if the sequence was just added to an existing database
+ */
+func (this *SSNDB) sequence() bool {
+	this.Exec("CREATE TABLE IF NOT EXISTS sequences (id INTEGER PRIMARY KEY, value INTEGER NOT NULL)")
+	this.Exec("INSERT OR IGNORE INTO sequences (id, value) VALUES (1, 0)")
+
+	migrate := false
+	for _, table := range []string{"posts", "profiles", "messages", "reactions"} {
+		if this.hasColumn(table, "seq") {
+			continue
+		}
+		this.Exec("ALTER TABLE " + table + " ADD COLUMN seq INTEGER NOT NULL DEFAULT 0")
+		if table == "posts" {
+			migrate = true
+		}
+	}
+
+	if migrate {
+		// number the rows we have in the order they were published
+		logger.Info("adding sync sequence numbers")
+		this.Exec("UPDATE posts SET seq = (SELECT COUNT(*) FROM posts AS O " +
+			"WHERE O.published_at < posts.published_at OR (O.published_at = posts.published_at AND O.id <= posts.id))")
+		this.Exec("UPDATE profiles SET seq = (SELECT COUNT(*) FROM posts) + (SELECT COUNT(*) FROM profiles AS O " +
+			"WHERE O.changed_at < profiles.changed_at OR (O.changed_at = profiles.changed_at AND O.id <= profiles.id))")
+		this.Exec("UPDATE sequences SET value = (SELECT COUNT(*) FROM posts) + (SELECT COUNT(*) FROM profiles) WHERE id = 1")
+	}
+
+	// everything a peer has to learn about again
+	changes := map[string][]string{
+		"posts":     {"published_at", "deleted_at", "revision"},
+		"profiles":  {"changed_at"},
+		"messages":  {}, // never change
+		"reactions": {"changed_at"},
+	}
+	for table, columns := range changes {
+		when := []string{}
+		for _, column := range columns {
+			when = append(when, "NEW."+column+" IS NOT OLD."+column)
+		}
+		next := "UPDATE sequences SET value = value + 1 WHERE id = 1; " +
+			"UPDATE " + table + " SET seq = (SELECT value FROM sequences WHERE id = 1) WHERE id = NEW.id; "
+		this.Exec("CREATE TRIGGER IF NOT EXISTS " + table + "_seq_insert AFTER INSERT ON " + table +
+			" BEGIN " + next + "END;")
+		if len(columns) > 0 {
+			this.Exec("CREATE TRIGGER IF NOT EXISTS " + table + "_seq_update AFTER UPDATE OF " + strings.Join(columns, ", ") +
+				" ON " + table + " WHEN " + strings.Join(when, " OR ") + " BEGIN " + next + "END;")
+		}
+	}
+	return migrate
+}
+
+// whether table has column, columns gorm does not know about are added
+// by hand
+func (this *SSNDB) hasColumn(table string, column string) bool {
+	rows, err := this.DB.DB().Query("PRAGMA table_info(" + table + ")")
+	if logger.ConditionalWarning(err, "could not read the columns of "+table) {
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// contacts we synced with timestamps resume with a cursor from their last activity
+func (this *SSNDB) migrateSyncStates() {
+	contacts := []Contact{}
+	this.Find(&contacts)
+	for _, contact := range contacts {
+		state := this.GetSyncState(Onion{Id: contact.OnionId})
+		if state.Id == 0 {
+			state.OnionId = contact.OnionId
+			state.Since = this.GetContactsLastActivity(&contact)
+			this.Save(&state)
+		}
+	}
+}
+
 func (this *SSNDB) view() {
 	this.DB.Exec("CREATE VIEW IF NOT EXISTS persons AS " +
 		"SELECT ifnull(O.id, 0) AS onion_id," +
@@ -215,9 +433,14 @@ func (this *SSNDB) getOnionById(id int64) Onion {
 	return addr
 }
 
+const (
+	ONION_V2_LEN = crypto.ONION_V2_LENGTH + len(".onion")
+	ONION_V3_LEN = crypto.ONION_V3_LENGTH + len(".onion")
+)
+
 func IsValidOnion(onion string) bool {
-	b, _ := regexp.MatchString("^[a-z2-7]{16}\\.onion$", onion)
-	return b
+	b, _ := regexp.MatchString("^([a-z2-7]{16}|[a-z2-7]{56})\\.onion$", onion)
+	return b && crypto.OnionVersion(onion) != 0
 }
 
 func (this *SSNDB) scanPosts(posts *list.List, rows *sql.Rows) {
@@ -238,7 +461,14 @@ func (this *SSNDB) scanPosts(posts *list.List, rows *sql.Rows) {
 			&post.PublishedAt,
 			&post.RemotePublishedAt,
 			&post.Hash,
-			&post.ParentId)
+			&post.ParentId,
+			&post.Signature,
+			&post.AuthorKey,
+			&post.DeleteSignature,
+			&post.Revision,
+			&post.EditedAt,
+			&post.Seq,
+			&post.ReshareChain)
 
 		post.ParentHash, _ = this.GetPostHashById(post.ParentId)
 		post.Originator = this.getOnionById(post.OriginatorId)
@@ -276,6 +506,581 @@ func (this *SSNDB) GetPosts(contact *Contact, timestamp int64) *list.List {
 	return posts
 }
 
+// the tombstones of posts a contact could see, which were deleted after
+// timestamp. Only sent to peers which negotiated protocol.FEATURE_TOMBSTONES
+func (this *SSNDB) GetTombstones(contact *Contact, timestamp int64) *list.List {
+	tombstones := new(list.List)
+
+	rows, err := this.getPublicTombstonesStmt.Query(time.Unix(timestamp+1, 0))
+	if logger.ConditionalWarning(err, "Failed to execute pepared statement: getPublicTombstonesStmt") {
+		return tombstones
+	}
+
+	this.scanPosts(tombstones, rows)
+	rows.Close()
+
+	if contact != nil {
+		rows, err := this.getTombstonesStmt.Query(contact.Id, time.Unix(timestamp+1, 0))
+		if logger.ConditionalWarning(err, "Failed to execute pepared statement: getTombstonesStmt") {
+			return tombstones
+		}
+
+		this.scanPosts(tombstones, rows)
+		rows.Close()
+
+		selfOnion := this.GetSelfOnion()
+		rows, err = this.getCommentTombstonesStmt.Query(contact.OnionId, selfOnion.Id, time.Unix(timestamp+1, 0))
+		if logger.ConditionalWarning(err, "Failed to execute pepared statement: getCommentTombstonesStmt") {
+			return tombstones
+		}
+		this.scanPosts(tombstones, rows)
+		rows.Close()
+	}
+
+	return tombstones
+}
+
+// the next batch of at most limit messages of ours to contact after cursor,
+// more is set if there are messages left for another batch
+func (this *SSNDB) GetMessageBatch(contact *Contact, cursor SyncCursor, limit int) ([]*Message, SyncCursor, bool) {
+	next := cursor
+	if contact == nil || contact.Status != SUCCESS {
+		return []*Message{}, next, false
+	}
+	msgs := this.getOutgoingMessages(contact, cursor.MessageSeq, limit)
+	more := len(msgs) > limit
+	if more {
+		msgs = msgs[:limit]
+	}
+	for _, msg := range msgs {
+		next.MessageSeq = msg.Seq
+	}
+	return msgs, next, more
+}
+
+// the next batch of at most limit posts after cursor in the order of their
+// sequence number, and the profile entries changed since cursor. Peers with
+// profileDelta get only those, the others the whole profile. more is set
+// if there are posts left for another batch.
+func (this *SSNDB) GetSyncBatch(contact *Contact, cursor SyncCursor, limit int, tombstones bool, profileDelta bool) ([]*Post, *list.List, SyncCursor, bool) {
+	next := cursor
+
+	changes := this.profileChanges(contact, func(prof *Profile) bool {
+		return prof.Seq > cursor.ProfileSeq
+	})
+	for _, prof := range changes {
+		next.ProfileSeq = prof.Seq
+	}
+	var profiles *list.List
+	if profileDelta {
+		profiles = new(list.List)
+		for _, prof := range changes {
+			profiles.PushBack(prof)
+		}
+	} else {
+		profiles = this.profileSnapshot(contact, changes)
+	}
+
+	// each query returns its first limit+1 posts, the first limit+1 of all
+	// posts are among them
+	candidates := new(list.List)
+	rows, err := this.getPublicPostsSeqStmt.Query(cursor.Seq, limit+1)
+	if !logger.ConditionalWarning(err, "Failed to execute pepared statement: getPublicPostsSeqStmt") {
+		this.scanPosts(candidates, rows)
+		rows.Close()
+	}
+	if contact != nil {
+		rows, err = this.getPostsSeqStmt.Query(contact.Id, cursor.Seq, limit+1)
+		if !logger.ConditionalWarning(err, "Failed to execute pepared statement: getPostsSeqStmt") {
+			this.scanPosts(candidates, rows)
+			rows.Close()
+		}
+		rows, err = this.getCommentsSeqStmt.Query(contact.OnionId, this.GetSelfOnion().Id, cursor.Seq, limit+1)
+		if !logger.ConditionalWarning(err, "Failed to execute pepared statement: getCommentsSeqStmt") {
+			this.scanPosts(candidates, rows)
+			rows.Close()
+		}
+	}
+
+	batch := []*Post{}
+	seen := map[int64]bool{}
+	for itr := candidates.Front(); itr != nil; itr = itr.Next() {
+		post := itr.Value.(*Post)
+		if !seen[post.Id] {
+			seen[post.Id] = true
+			batch = append(batch, post)
+		}
+	}
+	sort.Sort(postsBySeq(batch))
+
+	more := len(batch) > limit
+	if more {
+		batch = batch[:limit]
+	}
+
+	posts := []*Post{}
+	for _, post := range batch {
+		next.Seq = post.Seq
+		// peers without tombstones would store them as empty posts, they
+		// only move the cursor
+		if tombstones || !post.IsDeleted() {
+			posts = append(posts, post)
+		}
+	}
+	return posts, profiles, next, more
+}
+
+// the cursor for a peer which only tells us the timestamp of the old PULL,
+// used when a contact moves from timestamps to cursors
+func (this *SSNDB) LegacySyncCursor(timestamp int64) SyncCursor {
+	var cursor SyncCursor
+	if timestamp == 0 {
+		return cursor
+	}
+	row := this.DB.DB().QueryRow("SELECT ifnull(MAX(seq), 0) FROM posts WHERE published_at <= ?", time.Unix(timestamp+1, 0))
+	row.Scan(&cursor.Seq)
+	row = this.DB.DB().QueryRow("SELECT ifnull(MAX(seq), 0) FROM profiles WHERE changed_at <= ?", time.Unix(timestamp, 0))
+	row.Scan(&cursor.ProfileSeq)
+	return cursor
+}
+
+// where to resume the sync with onion from: the cursor of the last batch,
+// or for contacts we never synced with cursors the timestamp of the old PULL
+func (this *SSNDB) GetSyncState(onion Onion) SyncState {
+	var state SyncState
+	this.Where(&SyncState{OnionId: onion.Id}).First(&state)
+	return state
+}
+
+func (this *SSNDB) SaveSyncCursor(onion Onion, cursor string) error {
+	var state SyncState
+	this.Where(&SyncState{OnionId: onion.Id}).First(&state)
+	state.OnionId = onion.Id
+	state.Cursor = cursor
+	return this.Save(&state).Error
+}
+
+/* Direct Messages
+ *
+ * A conversation holds the messages between us and one onion. Our messages
+ * are pulled by the other party like posts, with the sequence number as
+ * cursor, but only by that party.
+ */
+
+// the conversation with onion, created if there is none yet
+func (this *SSNDB) GetConversation(onion Onion) Conversation {
+	var conversation Conversation
+	this.Where(&Conversation{OnionId: onion.Id}).First(&conversation)
+	if conversation.Id == 0 {
+		conversation.OnionId = onion.Id
+		this.Create(&conversation)
+	}
+	return conversation
+}
+
+// conversations with the latest first, with their unread messages and
+// contact
+func (this *SSNDB) GetConversations() []Conversation {
+	conversations := []Conversation{}
+	this.Order("last_message_at desc").Find(&conversations)
+	for i := range conversations {
+		this.fillConversation(&conversations[i])
+	}
+	return conversations
+}
+
+func (this *SSNDB) fillConversation(conversation *Conversation) {
+	row := this.DB.DB().QueryRow("SELECT COUNT(*) FROM messages WHERE conversation_id = ? AND outgoing = 0 AND read = 0", conversation.Id)
+	row.Scan(&conversation.Unread)
+	conversation.ContactId = this.GetContactIdByOnionId(conversation.OnionId)
+}
+
+// the id of the contact with onion, 0 if there is none
+func (this *SSNDB) GetContactIdByOnionId(onionId int64) int64 {
+	var contact Contact
+	this.Where(&Contact{OnionId: onionId}).First(&contact)
+	return contact.Id
+}
+
+// stores a message of ours to contact, it is delivered on its next pull
+func (this *SSNDB) SendMessage(contact *Contact, body string) (Message, error) {
+	onion := this.getOnionById(contact.OnionId)
+	conversation := this.GetConversation(onion)
+
+	msg := Message{
+		ConversationId: conversation.Id,
+		Outgoing:       true,
+		Body:           body,
+		SentAt:         time.Now(),
+		Read:           true,
+	}
+	msg.CalcHash(this.GetSelfOnion().Onion, onion.Onion)
+	if err := this.Create(&msg).Error; err != nil {
+		return msg, err
+	}
+
+	conversation.LastMessageAt = msg.SentAt
+	return msg, this.Save(&conversation).Error
+}
+
+// stores the messages onion sent us, those we have already are skipped
+func (this *SSNDB) AddMessages(onion Onion, msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	conversation := this.GetConversation(onion)
+	for i := range msgs {
+		msg := &msgs[i]
+		var existing Message
+		this.Where(&Message{ConversationId: conversation.Id, Hash: msg.Hash}).First(&existing)
+		if existing.Id != 0 {
+			continue
+		}
+		msg.Id = 0
+		msg.ConversationId = conversation.Id
+		msg.Outgoing = false
+		msg.Read = false
+		this.Create(msg)
+		if msg.SentAt.After(conversation.LastMessageAt) {
+			conversation.LastMessageAt = msg.SentAt
+		}
+	}
+	this.Save(&conversation)
+}
+
+// marks the messages of a conversation as read
+func (this *SSNDB) MarkConversationRead(conversation *Conversation) error {
+	return this.Exec("UPDATE messages SET read = 1 WHERE conversation_id = ?", conversation.Id).Error
+}
+
+// our messages to contact after seq in the order of their sequence number,
+// at most limit+1 so the caller knows if there are more
+func (this *SSNDB) getOutgoingMessages(contact *Contact, seq int64, limit int) []*Message {
+	msgs := []*Message{}
+	rows, err := this.DB.DB().Query(
+		"SELECT M.id, M.conversation_id, M.hash, M.body, M.sent_at, M.seq FROM messages AS M "+
+			"JOIN conversations AS C ON M.conversation_id = C.id "+
+			"WHERE C.onion_id = ? AND M.outgoing = 1 AND M.seq > ? ORDER BY M.seq LIMIT ?",
+		contact.OnionId, seq, limit+1)
+	if logger.ConditionalWarning(err, "Failed to query outgoing messages") {
+		return msgs
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg := new(Message)
+		rows.Scan(&msg.Id, &msg.ConversationId, &msg.Hash, &msg.Body, &msg.SentAt, &msg.Seq)
+		msg.Outgoing = true
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+/* Reactions
+ *
+ * Like comments, reactions go to the originator of the post. It counts them
+ * and sends the counts to everyone who may see the post, nobody but the
+ * originator learns who reacted.
+ */
+
+// reacts to post, or takes the reaction back if remove is set
+func (this *SSNDB) React(post *Post, kind string, remove bool) error {
+	if !ValidReactionKind(kind) {
+		return errors.New("invalid reaction")
+	}
+	self := this.GetSelfOnion()
+	var reaction Reaction
+	this.Unscoped().Where(&Reaction{PostId: post.Id, AuthorId: self.Id, Kind: kind}).First(&reaction)
+	if reaction.Id == 0 && remove {
+		return nil
+	}
+	reaction.PostId = post.Id
+	reaction.AuthorId = self.Id
+	reaction.Kind = kind
+	reaction.ChangedAt = time.Now()
+	reaction.DeletedAt = time.Time{}
+	if remove {
+		reaction.DeletedAt = reaction.ChangedAt
+	}
+	return this.Unscoped().Save(&reaction).Error
+}
+
+// stores the reactions sender sent us to posts we originated, returns the
+// posts whose counts changed
+func (this *SSNDB) AddReactions(sender Onion, reactions []Reaction) []Post {
+	changed := []Post{}
+	contact := this.GetContactByOnion(sender.Onion)
+	if contact == nil || contact.Status != SUCCESS {
+		return changed
+	}
+	self := this.GetSelfOnion()
+	seen := map[int64]bool{}
+	for i := range reactions {
+		reaction := &reactions[i]
+		post, err := this.GetPostByHash(reaction.PostHash)
+		if err != nil || post.OriginatorId != self.Id || !ValidReactionKind(reaction.Kind) {
+			continue
+		}
+		if !this.isPostVisible(contact, post.Id) {
+			logger.Security(fmt.Sprintf("%s reacted to post %s which it cannot see", sender.Onion, post.Hash))
+			continue
+		}
+
+		var dbReaction Reaction
+		this.Unscoped().Where(&Reaction{PostId: post.Id, AuthorId: sender.Id, Kind: reaction.Kind}).First(&dbReaction)
+		if dbReaction.Id != 0 && !reaction.ChangedAt.After(dbReaction.ChangedAt) {
+			continue
+		}
+		dbReaction.PostId = post.Id
+		dbReaction.AuthorId = sender.Id
+		dbReaction.Kind = reaction.Kind
+		dbReaction.ChangedAt = reaction.ChangedAt
+		dbReaction.DeletedAt = reaction.DeletedAt
+		this.Unscoped().Save(&dbReaction)
+
+		if !seen[post.Id] {
+			seen[post.Id] = true
+			changed = append(changed, *post)
+		}
+	}
+	return changed
+}
+
+// stores the counts sender sent for the posts it originated
+func (this *SSNDB) SetReactionCounts(sender Onion, counts []PostReactions) {
+	for _, postCounts := range counts {
+		post, err := this.GetPostByHash(postCounts.PostHash)
+		if err != nil || post.OriginatorId != sender.Id {
+			continue
+		}
+		this.Where(&ReactionCount{PostId: post.Id}).Delete(ReactionCount{})
+		for kind, count := range postCounts.Counts {
+			if ValidReactionKind(kind) && count > 0 {
+				this.Create(&ReactionCount{PostId: post.Id, Kind: kind, Count: count})
+			}
+		}
+	}
+}
+
+// the reactions to post by kind, counted by us if we originated it
+func (this *SSNDB) GetReactionCounts(post *Post) map[string]int {
+	counts := map[string]int{}
+	if post.OriginatorId != this.GetSelfOnion().Id {
+		rows := []ReactionCount{}
+		this.Where(&ReactionCount{PostId: post.Id}).Find(&rows)
+		for _, row := range rows {
+			counts[row.Kind] = row.Count
+		}
+		return counts
+	}
+
+	rows, err := this.DB.DB().Query("SELECT kind, COUNT(*) FROM reactions "+
+		"WHERE post_id = ? AND deleted_at = datetime('0001-01-01 00:00:00') GROUP BY kind", post.Id)
+	if logger.ConditionalWarning(err, "Failed to count reactions") {
+		return counts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var count int
+		rows.Scan(&kind, &count)
+		counts[kind] = count
+	}
+	return counts
+}
+
+// the kinds of our reactions to post
+func (this *SSNDB) GetOwnReactions(post *Post) []string {
+	reactions := []Reaction{}
+	this.Where(&Reaction{PostId: post.Id, AuthorId: this.GetSelfOnion().Id}).Find(&reactions)
+	kinds := []string{}
+	for _, reaction := range reactions {
+		kinds = append(kinds, reaction.Kind)
+	}
+	return kinds
+}
+
+// whether contact may see post: it is public or shared with a circle of
+// contact
+func (this *SSNDB) isPostVisible(contact *Contact, postId int64) bool {
+	var count int
+	row := this.DB.DB().QueryRow("SELECT COUNT(*) FROM circle_posts "+
+		"JOIN circles ON circle_posts.circle_id = circles.id "+
+		"LEFT JOIN circle_contacts ON circle_contacts.circle_id = circles.id "+
+		"WHERE circle_posts.post_id = ? AND (circles.name = 'Public' OR circle_contacts.contact_id = ?)",
+		postId, contact.Id)
+	row.Scan(&count)
+	return count > 0
+}
+
+// what contact gets to know about reactions after cursor: our reactions to
+// posts it originated, and the counts of posts we originated that it may
+// see. At most limit reactions are looked at, more is set if there are
+// more.
+func (this *SSNDB) GetReactionBatch(contact *Contact, cursor SyncCursor, limit int) ([]*Reaction, []PostReactions, SyncCursor, bool) {
+	next := cursor
+	reactions := []*Reaction{}
+	counts := []PostReactions{}
+	if contact == nil || contact.Status != SUCCESS {
+		return reactions, counts, next, false
+	}
+
+	rows, err := this.DB.DB().Query("SELECT R.id, R.post_id, R.author_id, R.kind, R.changed_at, R.deleted_at, R.seq, "+
+		"P.hash, P.originator_id FROM reactions AS R JOIN posts AS P ON R.post_id = P.id "+
+		"WHERE R.seq > ? ORDER BY R.seq LIMIT ?", cursor.ReactionSeq, limit+1)
+	if logger.ConditionalWarning(err, "Failed to query reactions") {
+		return reactions, counts, next, false
+	}
+	changed := []*Reaction{}
+	originators := map[int64]int64{}
+	for rows.Next() {
+		reaction := new(Reaction)
+		var originatorId int64
+		rows.Scan(&reaction.Id, &reaction.PostId, &reaction.AuthorId, &reaction.Kind, &reaction.ChangedAt,
+			&reaction.DeletedAt, &reaction.Seq, &reaction.PostHash, &originatorId)
+		changed = append(changed, reaction)
+		originators[reaction.Id] = originatorId
+	}
+	rows.Close()
+
+	more := len(changed) > limit
+	if more {
+		changed = changed[:limit]
+	}
+
+	self := this.GetSelfOnion()
+	counted := map[int64]bool{}
+	for _, reaction := range changed {
+		next.ReactionSeq = reaction.Seq
+		originator := originators[reaction.Id]
+		if reaction.AuthorId == self.Id && originator == contact.OnionId {
+			reactions = append(reactions, reaction)
+		} else if originator == self.Id && !counted[reaction.PostId] && this.isPostVisible(contact, reaction.PostId) {
+			counted[reaction.PostId] = true
+			post := Post{Id: reaction.PostId, OriginatorId: self.Id}
+			counts = append(counts, PostReactions{PostHash: reaction.PostHash, Counts: this.GetReactionCounts(&post)})
+		}
+	}
+	return reactions, counts, next, more
+}
+
+/* Outbox
+ *
+ * TRIGGERs are queued here before they are sent, so those to offline
+ * contacts are retried with exponential backoff, by any process working on
+ * this database and after restarts.
+ */
+
+// queues a TRIGGER to onion, due now
+func (this *SSNDB) QueueTrigger(onion Onion) error {
+	var delivery Delivery
+	this.Where(&Delivery{OnionId: onion.Id}).First(&delivery)
+	delivery.OnionId = onion.Id
+	delivery.State = DELIVERY_PENDING
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now().Unix()
+	delivery.LastError = ""
+	delivery.QueuedAt = time.Now()
+	return this.Save(&delivery).Error
+}
+
+func (this *SSNDB) QueueTriggers(onions []Onion) {
+	for _, onion := range onions {
+		logger.ConditionalWarning(this.QueueTrigger(onion), fmt.Sprintf("could not queue TRIGGER to %s", onion.Onion))
+	}
+}
+
+// queues a TRIGGER to every contact in circles but us
+func (this *SSNDB) QueueCircleTriggers(circles []Circle) {
+	// sync trigger
+	// we abuse map type as set here, since golang does not have sets...
+	// we are only interested in the KEY, we ignore  the value
+	self := this.GetSelfOnion()
+	onionMap := map[Onion]bool{}
+	for _, circle := range circles {
+		// we need all onions in circle for trigger
+		var contacts []Contact
+		if circle.Name == "Public" {
+			this.Find(&contacts)
+		} else {
+			this.Model(&circle).Related(&circle.Contacts, "Contacts")
+			contacts = circle.Contacts
+		}
+		for _, contact := range contacts {
+			var onion Onion
+			this.Model(&contact).Related(&onion, "Onion")
+			if onion.Id != self.Id {
+				onionMap[onion] = true
+			}
+		}
+	}
+
+	var onionsToTrigger []Onion
+	for onionKey, _ := range onionMap {
+		onionsToTrigger = append(onionsToTrigger, onionKey)
+	}
+
+	logger.Debug("I am going to trigger the following onions: ")
+	logger.Debug(fmt.Sprint(onionsToTrigger))
+	this.QueueTriggers(onionsToTrigger)
+}
+
+// the due TRIGGERs, each leased to the caller for OUTBOX_LEASE so no other
+// process sends it meanwhile
+func (this *SSNDB) ClaimDueTriggers() []Delivery {
+	now := time.Now()
+	due := []Delivery{}
+	this.Where("state = ? AND next_attempt <= ?", DELIVERY_PENDING, now.Unix()).Find(&due)
+
+	claimed := []Delivery{}
+	for _, delivery := range due {
+		res, err := this.DB.DB().Exec("UPDATE deliveries SET next_attempt = ? WHERE id = ? AND next_attempt = ?",
+			now.Add(OUTBOX_LEASE).Unix(), delivery.Id, delivery.NextAttempt)
+		if logger.ConditionalWarning(err, "could not claim delivery") {
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			claimed = append(claimed, delivery)
+		}
+	}
+	return claimed
+}
+
+// records the outcome of sending a claimed TRIGGER
+func (this *SSNDB) TriggerAttempted(delivery *Delivery, sendErr error) {
+	var current Delivery
+	this.First(&current, delivery.Id)
+	if current.Id == 0 || current.QueuedAt.After(delivery.QueuedAt) {
+		// queued again while we were sending, the new one is still due
+		return
+	}
+
+	current.Attempts++
+	if sendErr == nil {
+		current.State = DELIVERY_DELIVERED
+		current.LastError = ""
+		current.DeliveredAt = time.Now()
+	} else if current.Attempts >= OUTBOX_MAX_ATTEMPTS {
+		current.State = DELIVERY_FAILED
+		current.LastError = sendErr.Error()
+	} else {
+		current.LastError = sendErr.Error()
+		current.NextAttempt = time.Now().Add(deliveryBackoff(current.Attempts)).Unix()
+	}
+	logger.ConditionalWarning(this.Save(&current).Error, "could not save delivery")
+}
+
+// the outbox with the contact of each onion
+func (this *SSNDB) GetDeliveries() []Delivery {
+	deliveries := []Delivery{}
+	this.Order("id").Find(&deliveries)
+	for i := range deliveries {
+		var contact Contact
+		this.Where(&Contact{OnionId: deliveries[i].OnionId}).First(&contact)
+		deliveries[i].ContactId = contact.Id
+	}
+	return deliveries
+}
+
 func (this *SSNDB) scanProfile(profs *list.List, rows *sql.Rows) {
 	for rows.Next() {
 		prof := new(Profile)
@@ -285,12 +1090,14 @@ func (this *SSNDB) scanProfile(profs *list.List, rows *sql.Rows) {
 			&prof.Key,
 			&prof.Value,
 			&prof.ChangedAt,
-			&prof.OnionId)
+			&prof.OnionId,
+			&prof.Seq)
 		profs.PushBack(prof)
 	}
 }
 
-func (this *SSNDB) GetProfiles(contact *Contact, timestamp int64) *list.List {
+// the entries of our profile contact may see
+func (this *SSNDB) getVisibleProfiles(contact *Contact) *list.List {
 	profs := new(list.List)
 	self := this.GetSelfOnion()
 
@@ -311,15 +1118,167 @@ func (this *SSNDB) GetProfiles(contact *Contact, timestamp int64) *list.List {
 		this.scanProfile(profs, rows)
 		rows.Close()
 	}
+	return profs
+}
+
+// creates the table of ProfileShare. On a database from before it, the
+// keys contacts may see now are taken as the ones they got.
+func (this *SSNDB) profileShares() {
+	var exists int
+	this.DB.DB().QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'profile_shares'").Scan(&exists)
+	this.AutoMigrate(ProfileShare{})
+	this.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_profile_shares ON profile_shares (contact_id, key)")
+	if exists != 0 {
+		return
+	}
+
+	this.Exec("INSERT OR IGNORE INTO profile_shares (contact_id, key) SELECT DISTINCT circle_contacts.contact_id, P.key " +
+		"FROM profiles AS P JOIN circle_profiles ON P.id = circle_profiles.profile_id " +
+		"JOIN circle_contacts ON circle_contacts.circle_id = circle_profiles.circle_id " +
+		"WHERE P.key != '' AND P.onion_id = (SELECT onion_id FROM users LIMIT 1)")
+	this.Exec("INSERT OR IGNORE INTO profile_shares (contact_id, key) SELECT DISTINCT contacts.id, P.key " +
+		"FROM profiles AS P JOIN circle_profiles ON P.id = circle_profiles.profile_id " +
+		"JOIN circles ON circle_profiles.circle_id = circles.id, contacts " +
+		"WHERE circles.name = 'Public' AND P.key != '' AND P.onion_id = (SELECT onion_id FROM users LIMIT 1)")
+	this.Exec("INSERT OR IGNORE INTO profile_shares (contact_id, key) SELECT DISTINCT 0, P.key " +
+		"FROM profiles AS P JOIN circle_profiles ON P.id = circle_profiles.profile_id " +
+		"JOIN circles ON circle_profiles.circle_id = circles.id " +
+		"WHERE circles.name = 'Public' AND P.key != '' AND P.onion_id = (SELECT onion_id FROM users LIMIT 1)")
+}
+
+// the keys of our profile contact got a value for, see ProfileShare
+func (this *SSNDB) getProfileShares(contact *Contact) map[string]bool {
+	shares := []ProfileShare{}
+	this.Where("contact_id = ?", contactIdOrZero(contact)).Find(&shares)
+	keys := map[string]bool{}
+	for _, share := range shares {
+		keys[share.Key] = true
+	}
+	return keys
+}
+
+func (this *SSNDB) shareProfileKey(contact *Contact, key string) {
+	this.Exec("INSERT OR IGNORE INTO profile_shares (contact_id, key) VALUES (?, ?)", contactIdOrZero(contact), key)
+}
+
+func contactIdOrZero(contact *Contact) int64 {
+	if contact == nil {
+		return 0
+	}
+	return contact.Id
+}
+
+// the entries of our profile for which changed holds, in the order of
+// their sequence number. Entries contact may see are returned as they are,
+// the others as tombstones if contact got a value for their key before:
+// they were deleted or are no longer shared with contact. Keys contact
+// never saw are left out.
+func (this *SSNDB) profileChanges(contact *Contact, changed func(*Profile) bool) []*Profile {
+	visible := this.getVisibleProfiles(contact)
+	if visible == nil {
+		return nil
+	}
+	shared := this.getProfileShares(contact)
+	byId := map[int64]*Profile{}
+	for itr := visible.Front(); itr != nil; itr = itr.Next() {
+		prof := itr.Value.(*Profile)
+		byId[prof.Id] = prof
+	}
+
+	rows, err := this.DB.DB().Query("SELECT id, key, changed_at, onion_id, seq FROM profiles WHERE onion_id = ? ORDER BY seq",
+		this.GetSelfOnion().Id)
+	if logger.ConditionalWarning(err, "Failed to query profile changes") {
+		return nil
+	}
+
+	changes := []*Profile{}
+	newShares := []string{}
+	for rows.Next() {
+		var prof Profile
+		rows.Scan(&prof.Id, &prof.Key, &prof.ChangedAt, &prof.OnionId, &prof.Seq)
+		if prof.Key == "" || !changed(&prof) {
+			continue
+		}
+		if visible, ok := byId[prof.Id]; ok {
+			if !shared[visible.Key] {
+				newShares = append(newShares, visible.Key)
+				shared[visible.Key] = true
+			}
+			changes = append(changes, visible)
+		} else if shared[prof.Key] {
+			prof.DeletedAt = prof.ChangedAt
+			changes = append(changes, &prof)
+		}
+	}
+	rows.Close()
+
+	for _, key := range newShares {
+		this.shareProfileKey(contact, key)
+	}
+	return changes
+}
 
-	for prof := profs.Front(); prof != nil; prof = prof.Next() {
-		p := prof.Value.(*Profile)
-		if p.ChangedAt.Unix() > timestamp {
-			return profs
+// the whole profile contact may see if anything in changes, empty
+// otherwise. Peers without profile deltas replace the profile they have
+// with it, a removed entry is announced to them by an entry with an empty
+// key.
+func (this *SSNDB) profileSnapshot(contact *Contact, changes []*Profile) *list.List {
+	if len(changes) == 0 {
+		return new(list.List)
+	}
+	profs := this.getVisibleProfiles(contact)
+	if profs == nil {
+		return new(list.List)
+	}
+	for _, prof := range changes {
+		if prof.IsDeleted() {
+			profs.PushBack(&Profile{Value: "Deleted", ChangedAt: prof.ChangedAt, OnionId: prof.OnionId})
+			break
 		}
 	}
+	return profs
+}
 
-	return new(list.List)
+// the whole profile contact may see if any entry changed after timestamp,
+// for peers using the old PULL
+func (this *SSNDB) GetProfiles(contact *Contact, timestamp int64) *list.List {
+	return this.profileSnapshot(contact, this.profileChanges(contact, func(prof *Profile) bool {
+		return prof.ChangedAt.Unix() > timestamp
+	}))
+}
+
+// deletes an entry of a profile. Our own entries stay as tombstones, so
+// contacts learn about it on their next sync.
+func (this *SSNDB) DeleteProfile(prof *Profile) error {
+	if prof.OnionId != this.GetSelfOnion().Id {
+		return this.Unscoped().Delete(prof).Error
+	}
+	this.Model(prof).Association("Circles").Clear()
+	prof.Onion = this.GetSelfOnion()
+	prof.Value = ""
+	prof.ChangedAt = time.Now()
+	prof.DeletedAt = prof.ChangedAt
+	return this.Unscoped().Save(prof).Error
+}
+
+// renames an entry of our profile, contacts get a tombstone for the old key
+func (this *SSNDB) RenameProfile(prof *Profile, key string) {
+	if old := this.getProfileByKey(prof.OnionId, key); old.Id != 0 && old.IsDeleted() {
+		this.Unscoped().Delete(&old)
+	}
+	if prof.OnionId == this.GetSelfOnion().Id {
+		now := time.Now()
+		this.Unscoped().Save(&Profile{Key: prof.Key, ChangedAt: now, DeletedAt: now, Onion: this.GetSelfOnion(), OnionId: prof.OnionId})
+	}
+	prof.Key = key
+}
+
+// marks the entries of our profile shared with circle as changed, contacts
+// which lost access to them get tombstones on their next sync
+func (this *SSNDB) TouchCircleProfiles(circle *Circle) {
+	this.Exec("UPDATE profiles SET changed_at = ? WHERE onion_id = ? AND id IN "+
+		"(SELECT profile_id FROM circle_profiles WHERE circle_id = ?)",
+		time.Now(), this.GetSelfOnion().Id, circle.Id)
 }
 
 func (this *SSNDB) GetSelf() Contact {
@@ -341,6 +1300,53 @@ func (this *SSNDB) GetSelfOnion() Onion {
 	return onion
 }
 
+func (this *SSNDB) SetContactToSuccess(contact *Contact) {
+	// set contact status to success
+	logger.Info("Updating status of contact " + contact.Alias + " to \"success\"")
+	contact.Status = SUCCESS
+	this.Save(contact)
+
+	// add circle for new contact
+	circle := Circle{Name: contact.Alias, Creator: CREATOR_APP}
+	this.Find(&circle, circle)
+	if circle.Id != 0 {
+		logger.Warning("circle \"" + circle.Name + "\" already exists")
+		return
+	}
+	logger.Debug("adding circle \"" + circle.Name + "\"")
+	this.Create(&circle)
+
+	// add contact to circle
+	logger.Debug("adding user " + contact.Alias + " (" + contact.Nickname + ") to circle \"" + circle.Name + "\"\n")
+	this.Model(&circle).Association("Contacts").Append(*contact)
+
+	var p Pending
+	this.Find(&p, 1)
+	p.Contacts = true
+	this.Save(&p)
+}
+
+// stops syncing contact until the user accepts its new key, see
+// RepinPublicKey
+func (this *SSNDB) SetContactToCompromised(contact *Contact) {
+	logger.Security("Updating status of contact " + contact.Alias + " to \"compromised\"")
+	contact.compromise()
+	this.Save(contact)
+
+	var p Pending
+	this.Find(&p, 1)
+	p.Contacts = true
+	this.Save(&p)
+}
+
+// number of contact requests we did not answer yet
+func (this *SSNDB) CountOpenContacts() int {
+	var count int
+	row := this.DB.DB().QueryRow("SELECT COUNT(*) FROM contacts WHERE status = ?", OPEN)
+	logger.ConditionalWarning(row.Scan(&count), "could not count open contacts")
+	return count
+}
+
 func (this *SSNDB) GetContactByOnion(onionstr string) *Contact {
 	var onion Onion
 	contact := new(Contact)
@@ -358,7 +1364,7 @@ func (this *SSNDB) GetContactByOnion(onionstr string) *Contact {
 	return contact
 }
 
-// only gets you SUCCESSFUL contacts (most likely friends)
+// only gets you contacts which may authenticate, see IsFriendly
 func (this *SSNDB) GetFriendlyContactByOnion(onionstr string) *Contact {
 	var onion Onion
 	contact := new(Contact)
@@ -369,8 +1375,8 @@ func (this *SSNDB) GetFriendlyContactByOnion(onionstr string) *Contact {
 		return nil
 	}
 
-	this.Where(&Contact{OnionId: onion.Id}).Where("Status >= ?", PENDING).First(contact)
-	if contact.Id == 0 {
+	this.Where(&Contact{OnionId: onion.Id}).Where("status IN (?, ?, ?)", PENDING, SUCCESS, FOLLOWING).First(contact)
+	if contact.Id == 0 || !IsFriendly(contact.Status) {
 		logger.Security(fmt.Sprintf("can't find unblocked contact for onion address: %s", onionstr))
 		return nil
 	}
@@ -384,11 +1390,172 @@ func (this *SSNDB) GetOnion(onion string) Onion {
 	return addr
 }
 
+var ErrKeyMismatch = errors.New("public key differs from the pinned key")
+
+// trust on first use: the first key a peer authenticates with is pinned,
+// every later key for the same onion must be the pinned one. key is pkcs1
+// for v2 onions and the raw ed25519 key for v3 onions.
+func (this *SSNDB) PinPublicKey(onionstr string, key []byte) error {
+	onion := this.GetOnion(onionstr)
+	if onion.Id == 0 {
+		return errors.New("unknown onion address: " + onionstr)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(key)
+	if onion.PublicKey == "" {
+		logger.Info("pinning public key of " + onionstr)
+		onion.PublicKey = encoded
+		onion.PinnedAt = time.Now()
+		this.Save(&onion)
+		return nil
+	}
+	if onion.PublicKey == encoded {
+		return nil
+	}
+
+	logger.Security(fmt.Sprintf("%s presented a public key which differs from the pinned one", onionstr))
+	this.AddSecurityEvent(onion, KEY_MISMATCH,
+		fmt.Sprintf("%s presented a public key which differs from the one pinned on %s",
+			onionstr, onion.PinnedAt.Format(time.RFC1123)), encoded)
+	return ErrKeyMismatch
+}
+
+// checks a key (pkcs1, base64) against the pinned key of onion, onions
+// without a pinned key accept every key
+func (this *SSNDB) CheckPinnedKey(onion Onion, encodedKey string) error {
+	if onion.Id == 0 {
+		onion = this.GetOnion(onion.Onion)
+	} else if onion.PublicKey == "" {
+		onion = this.getOnionById(onion.Id)
+	}
+	if onion.PublicKey == "" || onion.PublicKey == encodedKey {
+		return nil
+	}
+	return ErrKeyMismatch
+}
+
+// accepts a changed key of a peer: pins the key of the latest key mismatch,
+// or forgets the pinned key if there is none so that the next one is pinned
+func (this *SSNDB) RepinPublicKey(onionId int64) error {
+	onion := this.getOnionById(onionId)
+	if onion.Id == 0 {
+		return errors.New("unknown onion")
+	}
+
+	var mismatch SecurityEvent
+	this.Where(&SecurityEvent{OnionId: onion.Id, Kind: KEY_MISMATCH}).Order("id desc").First(&mismatch)
+
+	onion.PublicKey = mismatch.PublicKey
+	if onion.PublicKey != "" {
+		onion.PinnedAt = time.Now()
+	} else {
+		onion.PinnedAt = time.Time{}
+	}
+	if err := this.Save(&onion).Error; err != nil {
+		return err
+	}
+
+	this.Model(&SecurityEvent{}).Where("onion_id = ? AND kind = ?", onion.Id, KEY_MISMATCH).
+		UpdateColumn("acknowledged", true)
+	var contact Contact
+	this.Where(&Contact{OnionId: onion.Id, Status: COMPROMISED}).First(&contact)
+	if contact.Id != 0 {
+		this.Model(&contact).UpdateColumn("status", contact.statusAfterRepin())
+	}
+	this.AddSecurityEvent(onion, KEY_REPINNED,
+		fmt.Sprintf("the public key of %s was re-pinned", onion.Onion), onion.PublicKey)
+	return nil
+}
+
+func (this *SSNDB) AddSecurityEvent(onion Onion, kind SecurityEventKind, message string, key string) {
+	event := SecurityEvent{
+		OnionId:   onion.Id,
+		Kind:      kind,
+		Message:   message,
+		PublicKey: key,
+		CreatedAt: time.Now(),
+	}
+	this.Create(&event)
+
+	var p Pending
+	this.Find(&p, 1)
+	p.Security = true
+	this.Save(&p)
+}
+
+// a contact moved from its v2 onion to newOnion and proved it with a
+// signature of its old RSA key (pkcs1) over crypto.MigrationStatement.
+// The onion row is rewritten in place, contact, circles and posts stay.
+func (this *SSNDB) MigrateLegacyOnion(newOnion string, legacyKey []byte, legacySig []byte) (Onion, error) {
+	var onion Onion
+
+	key, err := crypto.UnmarshalPKCS1PublicKey(legacyKey)
+	if err != nil {
+		return onion, err
+	}
+	legacyOnion := crypto.GetOnionAddress(&key)
+	err = crypto.VerifyOnionSignature(legacyOnion, legacyKey, crypto.MigrationStatement(newOnion), legacySig)
+	if err != nil {
+		logger.Security(fmt.Sprintf("invalid migration proof of %s for %s", legacyOnion, newOnion))
+		return onion, err
+	}
+
+	onion = this.GetOnion(legacyOnion)
+	if onion.Id == 0 {
+		return onion, errors.New("unknown legacy onion address: " + legacyOnion)
+	}
+	if this.CheckPinnedKey(onion, base64.StdEncoding.EncodeToString(legacyKey)) != nil {
+		logger.Security(fmt.Sprintf("migration proof of %s was made with an unpinned key", legacyOnion))
+		return onion, ErrKeyMismatch
+	}
+	if existing := this.GetOnion(newOnion); existing.Id != 0 {
+		return onion, errors.New("onion address exists already: " + newOnion)
+	}
+
+	err = this.moveOnion(onion, newOnion, "proved by its old key")
+	return this.getOnionById(onion.Id), err
+}
+
+// moves a contact to a new onion the user entered by hand, the new onion
+// gets pinned on the next authentication
+func (this *SSNDB) MigrateOnion(onionId int64, newOnion string) (Onion, error) {
+	onion := this.getOnionById(onionId)
+	if onion.Id == 0 {
+		return onion, errors.New("unknown onion")
+	}
+	if !IsValidOnion(newOnion) {
+		return onion, errors.New("invalid onion address: " + newOnion)
+	}
+	if existing := this.GetOnion(newOnion); existing.Id != 0 {
+		return onion, errors.New("onion address exists already: " + newOnion)
+	}
+	err := this.moveOnion(onion, newOnion, "changed by the user")
+	return this.getOnionById(onionId), err
+}
+
+func (this *SSNDB) moveOnion(onion Onion, newOnion string, reason string) error {
+	oldOnion := onion.Onion
+	onion.LegacyOnion = oldOnion
+	onion.Onion = newOnion
+	onion.Version = uint8(crypto.OnionVersion(newOnion))
+	onion.PublicKey = ""
+	onion.PinnedAt = time.Time{}
+	if err := this.Save(&onion).Error; err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("%s moved to %s", oldOnion, newOnion))
+	this.AddSecurityEvent(onion, ONION_MIGRATED,
+		fmt.Sprintf("%s moved to %s (%s)", oldOnion, newOnion, reason), "")
+	return nil
+}
+
 func (this *SSNDB) GetOrCreateOnion(onion string) Onion {
 	var addr Onion
 	this.DB.Where(&Onion{Onion: onion}).First(&addr)
 	if addr.Id == 0 {
 		addr.Onion = onion
+		addr.Version = uint8(crypto.OnionVersion(onion))
 		this.DB.Save(&addr)
 	}
 	return addr
@@ -400,34 +1567,351 @@ func (this *SSNDB) GetPostCircles(post *Post) []Circle {
 	return circles
 }
 
-func (this *SSNDB) AddOrUpdatePost(post *Post) {
+// signs a post we authored, sets its hash as a side effect
+func (this *SSNDB) SignPost(post *Post) {
+	if post.Revision == 0 {
+		post.CalcHash()
+	}
+	sig, pubKey, err := this.GetIdentity().Sign(post.SignedData())
+	logger.ConditionalError(err, "Could not sign post")
+	post.Signature = base64.StdEncoding.EncodeToString(sig)
+	post.AuthorKey = base64.StdEncoding.EncodeToString(pubKey)
+	post.Verified = true
+}
+
+func (this *SSNDB) AddOrUpdatePost(post *Post) error {
 	var dbPost Post
 
+	if post.IsDeleted() {
+		return this.applyTombstone(post)
+	}
+
 	post.Originator = this.GetOnion(post.Originator.Onion)
 	post.OriginatorId = post.Originator.Id
 
 	post.Author = this.GetOrCreateOnion(post.Author.Onion)
 	post.AuthorId = post.Author.Id
-	post.CalcHash()
+	if post.Revision == 0 {
+		post.CalcHash()
+	} else if post.Hash == "" {
+		return errors.New("edited post without hash")
+	}
 
-	this.DB.Where(&Post{Hash: post.Hash}).First(&dbPost)
+	this.DB.Unscoped().Where(&Post{Hash: post.Hash}).First(&dbPost)
+	if dbPost.IsDeleted() {
+		// a peer which did not get the tombstone yet must not bring it back
+		return nil
+	}
+	if dbPost.Id != 0 && dbPost.AuthorId != post.AuthorId {
+		// edits keep the hash, it does not cover the author of an edit
+		logger.Security(fmt.Sprintf("%s sent post %s by %s as post of %s",
+			post.Originator.Onion, post.Hash, this.getOnionById(dbPost.AuthorId).Onion, post.Author.Onion))
+		return errors.New("post hash belongs to another author")
+	}
+	if dbPost.Id != 0 && post.Revision < dbPost.Revision {
+		// we know a newer revision already
+		return nil
+	}
 	post.Id = dbPost.Id // wenn post bereits existiert wird upgedated (id != 0) sonst neu angelegt (id = 0)
+	if dbPost.Id != 0 {
+		this.keepReshare(post, &dbPost)
+	} else {
+		this.checkReshareChain(post)
+	}
+
+	if post.Signature == "" && dbPost.Signature != "" && post.Revision == dbPost.Revision {
+		// same hash, same content: do not let anyone strip a signature we checked before
+		post.Signature = dbPost.Signature
+		post.AuthorKey = dbPost.AuthorKey
+	}
+
+	if post.Signature == "" {
+		// peers from before signed posts, keep the post but flag it
+		logger.Info(fmt.Sprintf("post %s by %s is not signed", post.Hash, post.Author.Onion))
+		post.Verified = false
+	} else if err := post.VerifySignature(); err != nil {
+		logger.Security(fmt.Sprintf("rejecting post %s by %s from %s: %s",
+			post.Hash, post.Author.Onion, post.Originator.Onion, err))
+		return err
+	} else if err := this.CheckPinnedKey(post.Author, post.AuthorKey); err != nil {
+		logger.Security(fmt.Sprintf("rejecting post %s by %s from %s: signed with a key which is not pinned",
+			post.Hash, post.Author.Onion, post.Originator.Onion))
+		return err
+	} else {
+		post.Verified = true
+	}
+
+	if post.Revision > 0 && !post.Verified && post.OriginatorId != post.AuthorId {
+		logger.Security(fmt.Sprintf("rejecting unsigned edit of post %s by %s from %s",
+			post.Hash, post.Author.Onion, post.Originator.Onion))
+		return errors.New("unsigned edit")
+	}
 
 	if post.ParentId == 0 && post.ParentHash != "" {
 		parent, err := this.GetPostByHashUnscoped(post.ParentHash)
 		if err != nil {
 			logger.Warning(fmt.Sprintf("Can't find parent with hash: %s\n", post.ParentHash))
-			return
+			return err
 		}
 		post.ParentId = parent.Id
 		post.DeletedAt = parent.DeletedAt
 	}
 
+	if dbPost.Id != 0 && post.Revision > dbPost.Revision {
+		this.addRevision(&dbPost)
+	}
+
 	this.Save(post)
 
 	if post.ParentId != 0 {
 		this.RedirectComment(post)
 	}
+	return nil
+}
+
+// a post may reach us from its author and from those who reshared it. We
+// keep the shortest way, comments go back along it. Whether and where we
+// reshared it ourselves stays as it is.
+func (this *SSNDB) keepReshare(post *Post, dbPost *Post) {
+	if len(dbPost.Resharers()) <= len(post.Resharers()) || dbPost.AuthorId == this.GetSelfOnion().Id {
+		post.Originator = this.getOnionById(dbPost.OriginatorId)
+		post.OriginatorId = dbPost.OriginatorId
+		post.ReshareChain = dbPost.ReshareChain
+	} else {
+		this.checkReshareChain(post)
+	}
+	// the TTL is not signed, so a relayer may have raised it
+	if dbPost.TTL < post.TTL {
+		post.TTL = dbPost.TTL
+	}
+	post.Published = dbPost.Published
+	post.PublishedAt = dbPost.PublishedAt
+	if post.Published && post.Revision > dbPost.Revision {
+		// passes the edit on to the circles we reshared it with
+		post.PublishedAt = time.Now()
+	}
+}
+
+// drops a reshare chain which is not made of onions. Apart from the sender
+// itself, the hops are as the sender claims them.
+func (this *SSNDB) checkReshareChain(post *Post) {
+	chain := post.Resharers()
+	for _, onion := range chain {
+		if !IsValidOnion(onion) || len(chain) > MAX_RESHARE_HOPS {
+			logger.Security(fmt.Sprintf("%s sent post %s with an invalid reshare chain", post.Originator.Onion, post.Hash))
+			post.SetResharers(nil)
+			return
+		}
+	}
+	for _, onion := range chain {
+		this.GetOrCreateOnion(onion)
+	}
+}
+
+// the onions which reshared the post, see Post.Resharers
+func (this *SSNDB) GetResharers(post *Post) []Onion {
+	onions := []Onion{}
+	for _, onion := range post.Resharers() {
+		onions = append(onions, this.GetOnion(onion))
+	}
+	return onions
+}
+
+// shares a post of someone else with circles. The post keeps author, hash
+// and signature, the contacts in circles get it with the TTL decremented
+// once more.
+func (this *SSNDB) ResharePost(post *Post, circles []Circle) error {
+	if err := reshareError(post, this.GetSelfOnion().Id); err != nil {
+		return err
+	}
+
+	for _, circle := range circles {
+		if err := this.Model(&circle).Association("Posts").Append(post).Error; err != nil {
+			return err
+		}
+	}
+	post.Published = true
+	post.PublishedAt = time.Now()
+	return this.Save(post).Error
+}
+
+// why the onion self may not reshare post, nil if it may. Only posts whose
+// signature we checked are passed on in the name of their author.
+func reshareError(post *Post, self int64) error {
+	if post.AuthorId == self {
+		return errors.New("own posts are shared, not reshared")
+	}
+	if post.ParentId != 0 {
+		return errors.New("comments cannot be reshared")
+	}
+	if post.IsDeleted() {
+		return errors.New("deleted posts cannot be reshared")
+	}
+	if !post.Verified {
+		return errors.New("posts without a verified signature cannot be reshared")
+	}
+	if post.TTL == 0 {
+		return errors.New("the TTL of the post does not allow resharing")
+	}
+	return nil
+}
+
+// whether we reshared the post
+func (this *SSNDB) IsReshared(post *Post) bool {
+	return post.Published && post.ParentId == 0 && post.AuthorId != this.GetSelfOnion().Id
+}
+
+var ErrPostDeleted = errors.New("deleted posts cannot be edited")
+
+// edits a post we authored. The hash stays the one of the first revision so
+// that comments stay attached, the previous revision is kept as PostRevision
+func (this *SSNDB) EditPost(post *Post, message string) error {
+	self := this.GetSelfOnion()
+	if post.AuthorId != self.Id {
+		return errors.New("only the author can edit a post")
+	}
+	if post.IsDeleted() {
+		return ErrPostDeleted
+	}
+
+	this.addRevision(post)
+
+	post.Author = self
+	post.ParentHash, _ = this.GetPostHashById(post.ParentId)
+	post.Message = message
+	post.Revision++
+	post.EditedAt = time.Now()
+	post.PublishedAt = post.EditedAt
+	this.SignPost(post)
+	return this.Save(post).Error
+}
+
+func (this *SSNDB) addRevision(post *Post) {
+	revision := PostRevision{
+		PostId:    post.Id,
+		Revision:  post.Revision,
+		Message:   post.Message,
+		EditedAt:  post.EditedAt,
+		Signature: post.Signature,
+	}
+	if revision.EditedAt.IsZero() {
+		revision.EditedAt = post.PostedAt
+	}
+	this.Create(&revision)
+}
+
+// the previous revisions of a post, oldest first
+func (this *SSNDB) GetPostRevisions(postId int64) []PostRevision {
+	revisions := []PostRevision{}
+	this.Where(&PostRevision{PostId: postId}).Order("revision").Find(&revisions)
+	return revisions
+}
+
+// the first revision of an edited post, for peers which do not know edits.
+// The hash and its signature only cover the first revision.
+func (this *SSNDB) FirstRevision(post *Post) *Post {
+	var revision PostRevision
+	this.Where("post_id = ? AND revision = 0", post.Id).First(&revision)
+	if revision.Id == 0 {
+		return post
+	}
+	first := *post
+	first.Message = revision.Message
+	first.Signature = revision.Signature
+	first.Revision = 0
+	first.EditedAt = time.Time{}
+	return &first
+}
+
+// deletes a post and its comments. Posts we authored or which are comments
+// on our posts leave a tombstone, which everyone who could see them gets on
+// their next PULL, see GetTombstones
+func (this *SSNDB) DeletePost(post *Post) error {
+	now := time.Now()
+	self := this.GetSelfOnion()
+
+	if post.AuthorId == self.Id {
+		post.Author = self
+		sig, _, err := this.GetIdentity().Sign(post.DeletionData())
+		if err != nil {
+			return err
+		}
+		post.DeleteSignature = base64.StdEncoding.EncodeToString(sig)
+	}
+	if post.AuthorId == self.Id || post.OriginatorId == self.Id {
+		post.PublishedAt = now
+	}
+	post.DeletedAt = now
+
+	if err := this.Unscoped().Save(post).Error; err != nil {
+		return err
+	}
+	return this.deleteComments(post)
+}
+
+func (this *SSNDB) deleteComments(post *Post) error {
+	return this.Model(&Post{}).Where("parent_id = ?", post.Id).UpdateColumn("deleted_at", post.DeletedAt).Error
+}
+
+// applies the tombstone of a post deleted by a peer. On success tombstone
+// holds the deleted post.
+func (this *SSNDB) applyTombstone(tombstone *Post) error {
+	var dbPost Post
+	this.Unscoped().Where(&Post{Hash: tombstone.Hash}).First(&dbPost)
+	if dbPost.Id == 0 {
+		// we never got the post, nothing to delete
+		return nil
+	}
+	dbPost.Author = this.getOnionById(dbPost.AuthorId)
+	if dbPost.IsDeleted() {
+		*tombstone = dbPost
+		return nil
+	}
+
+	sender := this.GetOnion(tombstone.Originator.Onion)
+	if !this.mayDelete(&dbPost, sender, tombstone) {
+		logger.Security(fmt.Sprintf("%s sent a tombstone for post %s by %s without being allowed to",
+			tombstone.Originator.Onion, dbPost.Hash, dbPost.Author.Onion))
+		return errors.New("tombstone not allowed")
+	}
+
+	logger.Info(fmt.Sprintf("post %s was deleted by %s", dbPost.Hash, sender.Onion))
+	dbPost.DeletedAt = tombstone.DeletedAt
+	dbPost.DeleteSignature = tombstone.DeleteSignature
+	if dbPost.OriginatorId == sender.Id {
+		dbPost.RemotePublishedAt = tombstone.RemotePublishedAt
+	}
+	if err := this.Unscoped().Save(&dbPost).Error; err != nil {
+		return err
+	}
+	*tombstone = dbPost
+	return this.deleteComments(&dbPost)
+}
+
+// a post may be deleted by its author, by whoever relays a deletion signed
+// by the author, and for comments by the author of the commented post
+func (this *SSNDB) mayDelete(post *Post, sender Onion, tombstone *Post) bool {
+	if sender.Id != 0 && sender.Id == post.AuthorId {
+		return true
+	}
+
+	if tombstone.DeleteSignature != "" {
+		signed := *post
+		signed.DeleteSignature = tombstone.DeleteSignature
+		if signed.AuthorKey == "" {
+			signed.AuthorKey = tombstone.AuthorKey
+		}
+		if signed.VerifyDeletion() == nil && this.CheckPinnedKey(post.Author, signed.AuthorKey) == nil {
+			return true
+		}
+	}
+
+	if post.ParentId != 0 && sender.Id != 0 {
+		var parent Post
+		this.Unscoped().First(&parent, post.ParentId)
+		return parent.AuthorId == sender.Id
+	}
+	return false
 }
 
 func (this *SSNDB) RedirectComment(post *Post) {
@@ -458,17 +1942,24 @@ func (this *SSNDB) AddOrUpdatePosts(posts []Post) {
 	}
 }
 
-func (this *SSNDB) AddOrUpdateProfile(prof *Profile) {
-	var dbProf Profile
+// the entry of the profile with key, deleted ones included
+func (this *SSNDB) getProfileByKey(onionId int64, key string) Profile {
+	var prof Profile
+	this.Unscoped().Where(&Profile{Key: key, OnionId: onionId}).First(&prof)
+	return prof
+}
 
+func (this *SSNDB) AddOrUpdateProfile(prof *Profile) {
 	prof.Onion = this.GetOnion(prof.Onion.Onion)
 	prof.OnionId = prof.Onion.Id
 
-	this.DB.Where(&Profile{Key: prof.Key, OnionId: prof.OnionId}).First(&dbProf)
+	dbProf := this.getProfileByKey(prof.OnionId, prof.Key)
 	prof.Id = dbProf.Id // wenn prof bereits existiert wird upgedated (id != 0) sonst neu angelegt (id = 0)
-	this.Save(prof)
+	prof.DeletedAt = time.Time{}
+	this.Unscoped().Save(prof)
 }
 
+// replaces the profile of a peer without profile deltas as a whole
 func (this *SSNDB) AddOrUpdateProfiles(profs []Profile) {
 	length := len(profs)
 	// delete old profile entries => all profiles must have the same originator
@@ -478,10 +1969,32 @@ func (this *SSNDB) AddOrUpdateProfiles(profs []Profile) {
 	}
 
 	for i := 0; i < length; i++ {
+		// the entry which only announced a deletion
+		if profs[i].Key == "" {
+			continue
+		}
 		this.AddOrUpdateProfile(&profs[i])
 	}
 }
 
+// applies the changed entries of a profile in the order they were sent
+func (this *SSNDB) ApplyProfileChanges(profs []Profile) {
+	for i := range profs {
+		prof := &profs[i]
+		if prof.Key == "" {
+			continue
+		}
+		if !prof.IsDeleted() {
+			this.AddOrUpdateProfile(prof)
+			continue
+		}
+		onion := this.GetOnion(prof.Onion.Onion)
+		if dbProf := this.getProfileByKey(onion.Id, prof.Key); dbProf.Id != 0 {
+			this.Unscoped().Delete(&dbProf)
+		}
+	}
+}
+
 func (this *SSNDB) GetContactsLastActivity(contact *Contact) int64 {
 	rows, _ := this.getContactsLastActivity.Query(contact.OnionId, contact.OnionId)
 	rows.Next()
@@ -540,6 +2053,17 @@ func (this *SSNDB) ContactsPending() bool {
 	return false
 }
 
+func (this *SSNDB) SecurityPending() bool {
+	var p Pending
+	this.Find(&p, 1)
+	if p.Security {
+		p.Security = false
+		this.Save(&p)
+		return true
+	}
+	return false
+}
+
 func (this *SSNDB) GetProfilePictureId(onionId int64) int64 {
 	var profilePicture Profile
 	this.Where(&Profile{Key: "picture", OnionId: onionId}).First(&profilePicture)
@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// where the next sync with a contact resumes: the cursor of the last batch
+// we committed, or for contacts we synced with the old PULL the timestamp
+// of their last activity
+type SyncState struct {
+	Id        int64     `json:"id"`
+	OnionId   int64     `json:"onion" sql:"not null;unique"`
+	Cursor    string    `json:"-"`
+	Since     int64     `json:"since"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// the position of a peer in our stream of posts and profiles, as sequence
+// numbers of our database. Peers only get it encoded and hand it back
+// unchanged, so it may change any time.
+type SyncCursor struct {
+	Seq         int64 `json:"s"` // sequence number of the last post sent
+	ProfileSeq  int64 `json:"f"` // latest sequence number of the profile sent
+	MessageSeq  int64 `json:"m"` // sequence number of the last direct message sent
+	ReactionSeq int64 `json:"r"` // sequence number of the last reaction looked at
+}
+
+func (cursor SyncCursor) Encode() string {
+	buf, _ := json.Marshal(cursor)
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+func DecodeSyncCursor(encoded string) (SyncCursor, error) {
+	var cursor SyncCursor
+	buf, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(buf, &cursor)
+	return cursor, err
+}
+
+// posts in the order of the sync stream
+type postsBySeq []*Post
+
+func (p postsBySeq) Len() int           { return len(p) }
+func (p postsBySeq) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p postsBySeq) Less(i, j int) bool { return p[i].Seq < p[j].Seq }
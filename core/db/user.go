@@ -52,7 +52,8 @@ type User struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	Onion     Onion     `json:"-"`
 	OnionId   int64     `json:"contact_id"`
-	PemKey    string    `json:"-"`
+	PemKey    string    `json:"-"` // key of our onion, RSA (v2) or ed25519 (v3)
+	LegacyPem string    `json:"-"` // RSA key of our v2 onion after migrating to v3
 }
 
 func (user *User) SetPassword(password string) (err error) {
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// number of keys after which expired ones are dropped
+const PRUNE_THRESHOLD = 1024
+
+// allows each key at most Limit events within a sliding Window, a Limit of
+// 0 allows everything
+type RateLimiter struct {
+	mutex  sync.Mutex
+	Limit  int
+	Window time.Duration
+	events map[string][]time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Limit:  limit,
+		Window: window,
+		events: map[string][]time.Time{},
+	}
+}
+
+// records an event of key at now, false if key used up its limit already
+// (the event is not recorded then)
+func (this *RateLimiter) Allow(key string, now time.Time) bool {
+	if this.Limit <= 0 {
+		return true
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if len(this.events) > PRUNE_THRESHOLD {
+		for k, events := range this.events {
+			if len(this.recent(events, now)) == 0 {
+				delete(this.events, k)
+			}
+		}
+	}
+
+	events := this.recent(this.events[key], now)
+	if len(events) >= this.Limit {
+		this.events[key] = events
+		return false
+	}
+	this.events[key] = append(events, now)
+	return true
+}
+
+// the events of the last Window, events are in order
+func (this *RateLimiter) recent(events []time.Time, now time.Time) []time.Time {
+	start := now.Add(-this.Window)
+	for len(events) > 0 && !events[0].After(start) {
+		events = events[1:]
+	}
+	return events
+}
@@ -0,0 +1,92 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package ratelimit
+
+import "testing"
+import "fmt"
+import "time"
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter(2, time.Hour)
+	tests := []struct {
+		key     string
+		at      time.Duration // after start
+		allowed bool
+	}{
+		{"a", 0, true},
+		{"a", time.Minute, true},
+		{"a", 2 * time.Minute, false},         // limit used up
+		{"b", 2 * time.Minute, true},          // every key has its own
+		{"a", time.Hour - time.Second, false}, // the first event is still in the window
+		{"a", time.Hour, true},                // but not anymore
+		{"a", time.Hour + time.Second, false}, // the second one is
+		{"a", time.Hour + time.Minute, true},
+	}
+	for i, test := range tests {
+		if allowed := limiter.Allow(test.key, start.Add(test.at)); allowed != test.allowed {
+			t.Fatalf("event %d of %s after %s: allowed %v instead of %v\n", i, test.key, test.at, allowed, test.allowed)
+		}
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(0, time.Hour)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow("a", now) {
+			t.Fatalf("limiter without limit refused event %d\n", i)
+		}
+	}
+	if len(limiter.events) != 0 {
+		t.Fatalf("limiter without limit recorded %d keys\n", len(limiter.events))
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter(1, time.Hour)
+	for i := 0; i <= PRUNE_THRESHOLD; i++ {
+		limiter.Allow(fmt.Sprint("key", i), start)
+	}
+	limiter.Allow("recent", start.Add(time.Minute))
+
+	// the expired keys are dropped with the next event, the recent one stays
+	limiter.Allow("new", start.Add(time.Hour+time.Second))
+	if len(limiter.events) != 2 {
+		t.Fatalf("%d keys left after pruning instead of 2\n", len(limiter.events))
+	}
+	if limiter.Allow("recent", start.Add(time.Hour+2*time.Second)) {
+		t.Fatalf("pruning dropped the events of a recent key\n")
+	}
+}
@@ -37,23 +37,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"net"
 	_ "os"
 )
 
 type socket struct {
-	conn *net.TCPConn
+	conn net.Conn
 }
 
 // Connect provides functionality to connect to a socks server
 // socks response object. Byte order for resp is: 0x00(discard) 0xXX(status) 0xXX 0xXX(2 bytes to ignore) 0xXX 0xXX 0xXX 0xXX (4 bytes to ignore)
 // socks status codes: 0x5a(90) == granted ; 0x5b(91) == rejected/failed ; 0x5c(92) == failed because missing identd ; 0x5d(93) == identd couldn't confirm identity from user ID
-func Connect(conn *net.TCPConn, domain string) error {
+func Connect(conn net.Conn, domain string, port int) error {
 	sock := new(socket)
 	sock.conn = conn
 	version := []byte{0x04} // socks version 4
 	cmd := []byte{0x01}     // socks stream mode
-	port := 3141            // destination http port
 	buffer := bytes.NewBuffer([]byte{})
 	binary.Write(buffer, binary.BigEndian, version)
 	binary.Write(buffer, binary.BigEndian, cmd)
@@ -67,12 +67,12 @@ func Connect(conn *net.TCPConn, domain string) error {
 }
 
 func (this *socket) read() error {
-	data := make([]byte, 8) // socks responses are 8 bytes
-	count, err := this.conn.Read(data)
-	if err != nil {
-		return errors.New("unable to read bytes from data stream.\n")
-	} else if count == 0 {
+	data := make([]byte, 8) // socks responses are 8 bytes, maybe in several reads
+	_, err := io.ReadFull(this.conn, data)
+	if err == io.EOF {
 		return errors.New("socks host closed connection.\n")
+	} else if err != nil {
+		return errors.New("unable to read bytes from data stream.\n")
 	} else if data[1] == 0x5a { // success
 		return nil
 	} else if data[1] == 0x5b { // request failed
@@ -0,0 +1,204 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+/* SOCKS5 (RFC 1928), with username/password authentication (RFC 1929).
+ *
+ * Tor builds a circuit of its own for every distinct username/password
+ * (IsolateSOCKSAuth, on by default), so credentials per destination keep
+ * the traffic to different contacts apart.
+ */
+
+const (
+	socks5Version  = 0x05
+	authVersion    = 0x01
+	methodNoAuth   = 0x00
+	methodPassword = 0x02
+	methodNone     = 0xff
+	cmdConnect     = 0x01
+	atypIPv4       = 0x01
+	atypDomain     = 0x03
+	atypIPv6       = 0x04
+	replySucceeded = 0x00
+	maxSocks5Field = 255 // length of domains, usernames and passwords
+)
+
+type Auth struct {
+	Username string
+	Password string
+}
+
+// a reply of the proxy other than success
+type ReplyError struct {
+	Code byte
+}
+
+var replyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+	// extended errors of tor for onion services
+	0xf0: "onion service descriptor can not be found",
+	0xf1: "onion service descriptor is invalid",
+	0xf2: "onion service introduction failed",
+	0xf3: "onion service rendezvous failed",
+	0xf4: "onion service client authorization missing",
+	0xf5: "onion service client authorization wrong",
+	0xf6: "onion service address is invalid",
+	0xf7: "onion service introduction timed out",
+}
+
+func (this ReplyError) Error() string {
+	if message, ok := replyMessages[this.Code]; ok {
+		return "socks host: " + message
+	}
+	return fmt.Sprintf("socks host reports unknown error 0x%02x", this.Code)
+}
+
+// Connect5 asks the SOCKS5 server on conn to connect to domain:port. With
+// auth the proxy has to accept these credentials, without it no
+// authentication.
+func Connect5(conn net.Conn, domain string, port int, auth *Auth) error {
+	if len(domain) == 0 || len(domain) > maxSocks5Field {
+		return errors.New("invalid domain for socks5: " + domain)
+	}
+	if port <= 0 || port > 0xffff {
+		return fmt.Errorf("invalid port for socks5: %d", port)
+	}
+
+	// 1. choose the method, we offer a single one
+	method := byte(methodNoAuth)
+	if auth != nil {
+		method = methodPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.New("socks host did not answer the greeting: " + err.Error())
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks host speaks version %d instead of 5", reply[0])
+	}
+	if reply[1] == methodNone || reply[1] != method {
+		return errors.New("socks host accepts none of our authentication methods")
+	}
+
+	// 2. authenticate
+	if auth != nil {
+		if err := authenticate(conn, auth); err != nil {
+			return err
+		}
+	}
+
+	// 3. connect
+	request := []byte{socks5Version, cmdConnect, 0x00, atypDomain, byte(len(domain))}
+	request = append(request, domain...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	return readReply(conn)
+}
+
+func authenticate(conn net.Conn, auth *Auth) error {
+	if len(auth.Username) == 0 || len(auth.Username) > maxSocks5Field ||
+		len(auth.Password) == 0 || len(auth.Password) > maxSocks5Field {
+		return errors.New("socks5 username and password need 1 to 255 bytes")
+	}
+	request := []byte{authVersion, byte(len(auth.Username))}
+	request = append(request, auth.Username...)
+	request = append(request, byte(len(auth.Password)))
+	request = append(request, auth.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.New("socks host did not answer the authentication: " + err.Error())
+	}
+	if reply[0] != authVersion || reply[1] != 0x00 {
+		return errors.New("socks host rejected our credentials")
+	}
+	return nil
+}
+
+// reads the reply to CONNECT, the bound address it ends with has a length
+// depending on its type
+func readReply(conn net.Conn) error {
+	head := make([]byte, 4) // version, reply, reserved, address type
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return errors.New("socks host did not answer the connect: " + err.Error())
+	}
+	if head[0] != socks5Version {
+		return fmt.Errorf("socks host speaks version %d instead of 5", head[0])
+	}
+	if head[1] != replySucceeded {
+		return ReplyError{Code: head[1]}
+	}
+
+	var length int
+	switch head[3] {
+	case atypIPv4:
+		length = 4
+	case atypIPv6:
+		length = 16
+	case atypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return errors.New("could not read bound address: " + err.Error())
+		}
+		length = int(size[0])
+	default:
+		return fmt.Errorf("socks host sent unknown address type %d", head[3])
+	}
+	bound := make([]byte, length+2) // and the port
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		return errors.New("could not read bound address: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package socks
+
+import "testing"
+import "bytes"
+import "io"
+import "net"
+
+// a SOCKS5 proxy which answers one CONNECT, it remembers what the client
+// sent
+type fakeProxy struct {
+	method   byte   // the method it selects
+	accept   bool   // whether it accepts the credentials
+	reply    []byte // the reply to CONNECT and what follows on the connection
+	greeting []byte
+	username string
+	password string
+	request  []byte
+}
+
+// starts proxy on a pipe, done is closed once it answered or gave up
+func startFakeProxy(t *testing.T, proxy *fakeProxy) (net.Conn, chan struct{}) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		read := func(n int) []byte {
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(server, buf); err != nil {
+				return nil
+			}
+			return buf
+		}
+
+		if proxy.greeting = read(3); proxy.greeting == nil {
+			return
+		}
+		if _, err := server.Write([]byte{socks5Version, proxy.method}); err != nil || proxy.method == methodNone {
+			return
+		}
+
+		if proxy.method == methodPassword {
+			head := read(2)
+			if head == nil {
+				return
+			}
+			proxy.username = string(read(int(head[1])))
+			size := read(1)
+			if size == nil {
+				return
+			}
+			proxy.password = string(read(int(size[0])))
+			status := byte(0x01)
+			if proxy.accept {
+				status = 0x00
+			}
+			if _, err := server.Write([]byte{authVersion, status}); err != nil || !proxy.accept {
+				return
+			}
+		}
+
+		head := read(5) // version, command, reserved, address type, length
+		if head == nil {
+			return
+		}
+		rest := read(int(head[4]) + 2)
+		if rest == nil {
+			return
+		}
+		proxy.request = append(head, rest...)
+		server.Write(proxy.reply)
+	}()
+	t.Cleanup(func() { client.Close() })
+	return client, done
+}
+
+// the reply of a proxy which connected, bound to an IPv4 address
+func succeeded() []byte {
+	return []byte{socks5Version, replySucceeded, 0x00, atypIPv4, 127, 0, 0, 1, 0x23, 0x82}
+}
+
+func TestConnectWithoutAuth(t *testing.T) {
+	proxy := &fakeProxy{method: methodNoAuth, reply: succeeded()}
+	conn, done := startFakeProxy(t, proxy)
+	if err := Connect5(conn, "example.onion", 443, nil); err != nil {
+		t.Fatalf("could not connect: error: %s\n", err.Error())
+	}
+	<-done
+
+	if !bytes.Equal(proxy.greeting, []byte{socks5Version, 1, methodNoAuth}) {
+		t.Fatalf("wrong greeting: %v\n", proxy.greeting)
+	}
+	request := []byte{socks5Version, cmdConnect, 0x00, atypDomain, 13}
+	request = append(request, "example.onion"...)
+	request = append(request, 0x01, 0xbb)
+	if !bytes.Equal(proxy.request, request) {
+		t.Fatalf("wrong connect request: %v\n", proxy.request)
+	}
+}
+
+func TestConnectWithPassword(t *testing.T) {
+	proxy := &fakeProxy{method: methodPassword, accept: true, reply: succeeded()}
+	conn, done := startFakeProxy(t, proxy)
+	if err := Connect5(conn, "example.onion", 9878, &Auth{Username: "user", Password: "secret"}); err != nil {
+		t.Fatalf("could not connect: error: %s\n", err.Error())
+	}
+	<-done
+
+	if !bytes.Equal(proxy.greeting, []byte{socks5Version, 1, methodPassword}) {
+		t.Fatalf("wrong greeting: %v\n", proxy.greeting)
+	}
+	if proxy.username != "user" || proxy.password != "secret" {
+		t.Fatalf("wrong credentials: %s %s\n", proxy.username, proxy.password)
+	}
+	if len(proxy.request) != 5+13+2 || proxy.request[18] != 0x26 || proxy.request[19] != 0x96 {
+		t.Fatalf("wrong connect request: %v\n", proxy.request)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	proxy := &fakeProxy{method: methodPassword, accept: false}
+	conn, _ := startFakeProxy(t, proxy)
+	if err := Connect5(conn, "example.onion", 443, &Auth{Username: "user", Password: "wrong"}); err == nil {
+		t.Fatalf("connected with rejected credentials\n")
+	}
+}
+
+func TestNoAcceptableMethod(t *testing.T) {
+	// the proxy accepts none we offered
+	conn, _ := startFakeProxy(t, &fakeProxy{method: methodNone})
+	if err := Connect5(conn, "example.onion", 443, nil); err == nil {
+		t.Fatalf("connected although the proxy accepts no method\n")
+	}
+
+	// or one we did not offer
+	conn, _ = startFakeProxy(t, &fakeProxy{method: methodPassword})
+	if err := Connect5(conn, "example.onion", 443, nil); err == nil {
+		t.Fatalf("connected with a method we did not offer\n")
+	}
+}
+
+func TestBoundAddress(t *testing.T) {
+	replies := map[string][]byte{
+		"ipv4":   succeeded(),
+		"ipv6":   append([]byte{socks5Version, replySucceeded, 0x00, atypIPv6}, make([]byte, 16+2)...),
+		"domain": append([]byte{socks5Version, replySucceeded, 0x00, atypDomain, 9}, "localhost\x23\x82"...),
+	}
+	for name, reply := range replies {
+		// the data after the reply has to be left on the connection
+		proxy := &fakeProxy{method: methodNoAuth, reply: append(reply, "data"...)}
+		conn, _ := startFakeProxy(t, proxy)
+		if err := Connect5(conn, "example.onion", 443, nil); err != nil {
+			t.Fatalf("could not connect with %s address: error: %s\n", name, err.Error())
+		}
+		data := make([]byte, 4)
+		if _, err := io.ReadFull(conn, data); err != nil || string(data) != "data" {
+			t.Fatalf("%s address was not read exactly: %q %v\n", name, data, err)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	messages := map[byte]string{
+		0x05: "socks host: connection refused",
+		0xf0: "socks host: onion service descriptor can not be found",
+		0xf7: "socks host: onion service introduction timed out",
+		0x42: "socks host reports unknown error 0x42",
+	}
+	for code, message := range messages {
+		proxy := &fakeProxy{method: methodNoAuth, reply: []byte{socks5Version, code, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}}
+		conn, _ := startFakeProxy(t, proxy)
+		err := Connect5(conn, "example.onion", 443, nil)
+		replyError, ok := err.(ReplyError)
+		if !ok || replyError.Code != code {
+			t.Fatalf("wrong error for reply 0x%02x: %v\n", code, err)
+		}
+		if err.Error() != message {
+			t.Fatalf("wrong message for reply 0x%02x: %s\n", code, err.Error())
+		}
+	}
+}
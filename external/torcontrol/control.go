@@ -0,0 +1,435 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package torcontrol
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The control port of tor (control-spec.txt).
+ *
+ * Commands are lines, replies are lines of a status code followed by "-"
+ * (more lines follow), "+" (a data block ending with "." follows) or " "
+ * (the last line). Replies starting with 6 are events tor sends whenever
+ * they happen, they can arrive in between the lines of a reply.
+ */
+
+// how long tor may take to answer a command
+const COMMAND_TIMEOUT = 30 * time.Second
+
+const (
+	SERVER_TO_CONTROLLER = "Tor safe cookie authentication server-to-controller hash"
+	CONTROLLER_TO_SERVER = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// a reply of tor other than 250
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (this Error) Error() string {
+	return fmt.Sprintf("tor control: %d %s", this.Code, this.Message)
+}
+
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex // one command at a time
+	events []string   // read while waiting for replies, see Events
+}
+
+func Dial(addr string) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, COMMAND_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// tor removes the onions added without Detach when the connection closes
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// sends command and returns the lines of the reply without their status
+// code, replies other than 250 are returned as Error
+func (c *Conn) Command(command string) ([]string, error) {
+	if strings.ContainsAny(command, "\r\n") {
+		return nil, errors.New("tor control: command contains a line break")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn.SetDeadline(time.Now().Add(COMMAND_TIMEOUT))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write([]byte(command + "\r\n")); err != nil {
+		return nil, err
+	}
+	for {
+		code, lines, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if code/100 == 6 {
+			c.events = append(c.events, lines...)
+			continue
+		}
+		if code != 250 {
+			return nil, Error{Code: code, Message: strings.Join(lines, " ")}
+		}
+		return lines, nil
+	}
+}
+
+// the events tor sent since the last call, as lines without the status code
+func (c *Conn) Events() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	events := c.events
+	c.events = nil
+	return events
+}
+
+func (c *Conn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *Conn) readReply() (int, []string, error) {
+	lines := []string{}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(line) < 4 {
+			return 0, nil, errors.New("tor control: malformed reply line: " + line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return 0, nil, errors.New("tor control: malformed status code: " + line)
+		}
+		text := line[4:]
+		switch line[3] {
+		case ' ':
+			return code, append(lines, text), nil
+		case '-':
+			lines = append(lines, text)
+		case '+':
+			data, err := c.readData()
+			if err != nil {
+				return 0, nil, err
+			}
+			lines = append(lines, text+data)
+		default:
+			return 0, nil, errors.New("tor control: malformed reply line: " + line)
+		}
+	}
+}
+
+// the data block after a "+" line, up to the line with a single "."
+func (c *Conn) readData() (string, error) {
+	data := []string{}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		if line == "." {
+			return strings.Join(data, "\n"), nil
+		}
+		data = append(data, strings.TrimPrefix(line, "."))
+	}
+}
+
+/* Authentication */
+
+type ProtocolInfo struct {
+	Methods    []string // NULL, HASHEDPASSWORD, COOKIE, SAFECOOKIE
+	CookieFile string
+	Version    string
+}
+
+func (c *Conn) ProtocolInfo() (ProtocolInfo, error) {
+	info := ProtocolInfo{}
+	lines, err := c.Command("PROTOCOLINFO 1")
+	if err != nil {
+		return info, err
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "AUTH ") {
+			values := ParseKeywords(line[len("AUTH "):])
+			info.Methods = strings.Split(values["METHODS"], ",")
+			info.CookieFile = values["COOKIEFILE"]
+		} else if strings.HasPrefix(line, "VERSION ") {
+			info.Version = ParseKeywords(line[len("VERSION "):])["Tor"]
+		}
+	}
+	return info, nil
+}
+
+// authenticates with password if there is one, otherwise with the cookie
+// tor wrote, cookieFile overrides where tor says it is
+func (c *Conn) Authenticate(password, cookieFile string) error {
+	info, err := c.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		if !info.offers("HASHEDPASSWORD") {
+			return errors.New("tor control: tor does not accept passwords")
+		}
+		_, err = c.Command("AUTHENTICATE " + Quote(password))
+		return err
+	}
+	if cookieFile == "" {
+		cookieFile = info.CookieFile
+	}
+	switch {
+	case info.offers("SAFECOOKIE"):
+		cookie, err := ioutil.ReadFile(cookieFile)
+		if err != nil {
+			return err
+		}
+		return c.authenticateSafeCookie(cookie)
+	case info.offers("COOKIE"):
+		cookie, err := ioutil.ReadFile(cookieFile)
+		if err != nil {
+			return err
+		}
+		_, err = c.Command("AUTHENTICATE " + hex.EncodeToString(cookie))
+		return err
+	case info.offers("NULL"):
+		_, err = c.Command("AUTHENTICATE")
+		return err
+	}
+	return errors.New("tor control: no password given and tor offers no cookie")
+}
+
+func (info ProtocolInfo) offers(method string) bool {
+	for _, m := range info.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// the cookie never leaves us, tor has to prove it knows it first
+func (c *Conn) authenticateSafeCookie(cookie []byte) error {
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	lines, err := c.Command("AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+	values := ParseKeywords(strings.TrimPrefix(lines[0], "AUTHCHALLENGE "))
+	serverHash, err := hex.DecodeString(values["SERVERHASH"])
+	if err != nil {
+		return errors.New("tor control: malformed SERVERHASH")
+	}
+	serverNonce, err := hex.DecodeString(values["SERVERNONCE"])
+	if err != nil {
+		return errors.New("tor control: malformed SERVERNONCE")
+	}
+
+	message := append(append(append([]byte{}, cookie...), clientNonce...), serverNonce...)
+	if !hmac.Equal(serverHash, cookieHash(SERVER_TO_CONTROLLER, message)) {
+		return errors.New("tor control: tor does not know the cookie")
+	}
+	_, err = c.Command("AUTHENTICATE " + hex.EncodeToString(cookieHash(CONTROLLER_TO_SERVER, message)))
+	return err
+}
+
+func cookieHash(key string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+/* Onion services */
+
+// adds the onion service of key ("ED25519-V3:..." or "RSA1024:..." as
+// base64), forwarding port to target. Tor keeps it while this connection is
+// open. Returns the onion without ".onion".
+func (c *Conn) AddOnion(key string, port int, target string) (string, error) {
+	lines, err := c.Command(fmt.Sprintf("ADD_ONION %s Flags=DiscardPK Port=%d,%s", key, port, target))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "ServiceID=") {
+			return line[len("ServiceID="):], nil
+		}
+	}
+	return "", errors.New("tor control: ADD_ONION returned no ServiceID")
+}
+
+func (c *Conn) DelOnion(serviceID string) error {
+	_, err := c.Command("DEL_ONION " + serviceID)
+	return err
+}
+
+/* Status */
+
+func (c *Conn) GetInfo(keys ...string) (map[string]string, error) {
+	lines, err := c.Command("GETINFO " + strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{}
+	for _, line := range lines {
+		if i := strings.Index(line, "="); i > 0 {
+			info[line[:i]] = line[i+1:]
+		}
+	}
+	return info, nil
+}
+
+// replaces the events tor sends, none without arguments
+func (c *Conn) SetEvents(events ...string) error {
+	_, err := c.Command(strings.TrimSpace("SETEVENTS " + strings.Join(events, " ")))
+	return err
+}
+
+type Bootstrap struct {
+	Progress int // percent, 100 once tor can build circuits
+	Tag      string
+	Summary  string
+}
+
+func (c *Conn) Bootstrap() (Bootstrap, error) {
+	info, err := c.GetInfo("status/bootstrap-phase")
+	if err != nil {
+		return Bootstrap{}, err
+	}
+	// NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"
+	values := ParseKeywords(info["status/bootstrap-phase"])
+	progress, err := strconv.Atoi(values["PROGRESS"])
+	if err != nil {
+		return Bootstrap{}, errors.New("tor control: malformed bootstrap phase")
+	}
+	return Bootstrap{Progress: progress, Tag: values["TAG"], Summary: values["SUMMARY"]}, nil
+}
+
+// whether tor thinks it can reach the network
+func (c *Conn) NetworkLive() (bool, error) {
+	info, err := c.GetInfo("network-liveness")
+	if err != nil {
+		return false, err
+	}
+	return info["network-liveness"] == "up", nil
+}
+
+/* Encoding */
+
+// the QuotedString of the control protocol
+func Quote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// the KEY=VALUE and KEY="QUOTED VALUE" pairs of a line, words without "="
+// are skipped
+func ParseKeywords(line string) map[string]string {
+	values := map[string]string{}
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		end := strings.IndexAny(line, " =")
+		if end < 0 {
+			break
+		}
+		if line[end] == ' ' {
+			line = line[end:]
+			continue
+		}
+		key := line[:end]
+		line = line[end+1:]
+		if strings.HasPrefix(line, "\"") {
+			value, rest := unquote(line[1:])
+			values[key] = value
+			line = rest
+		} else {
+			end = strings.Index(line, " ")
+			if end < 0 {
+				end = len(line)
+			}
+			values[key] = line[:end]
+			line = line[end:]
+		}
+	}
+	return values
+}
+
+// reads a quoted string up to its closing quote, returns it and the rest
+func unquote(s string) (string, string) {
+	value := []byte{}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value = append(value, s[i])
+			}
+		case '"':
+			return string(value), s[i+1:]
+		default:
+			value = append(value, s[i])
+		}
+	}
+	return string(value), ""
+}
@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package torcontrol
+
+import "testing"
+import "bufio"
+import "crypto/hmac"
+import "encoding/hex"
+import "io/ioutil"
+import "net"
+import "path/filepath"
+import "strings"
+
+// a control port answering each command with the reply of the longest
+// prefix it starts with
+func startFakeTor(t *testing.T, replies map[string]string) *Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		reader := bufio.NewReader(server)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.TrimRight(line, "\r\n")
+			reply, match := "510 Unrecognized command\r\n", ""
+			for prefix, r := range replies {
+				if strings.HasPrefix(command, prefix) && len(prefix) > len(match) {
+					reply, match = r, prefix
+				}
+			}
+			if _, err := server.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}()
+	conn := NewConn(client)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+const protocolInfo = "250-PROTOCOLINFO 1\r\n" +
+	"250-AUTH METHODS=COOKIE,SAFECOOKIE,HASHEDPASSWORD COOKIEFILE=\"%s\"\r\n" +
+	"250-VERSION Tor=\"0.4.8.9\"\r\n" +
+	"250 OK\r\n"
+
+func TestPasswordAuth(t *testing.T) {
+	conn := startFakeTor(t, map[string]string{
+		"PROTOCOLINFO":                      strings.Replace(protocolInfo, "%s", "/nonexistent", 1),
+		"AUTHENTICATE \"pa\\\"ss\\\\word\"": "250 OK\r\n",
+		"AUTHENTICATE":                      "515 Authentication failed: Password did not match\r\n",
+	})
+	if err := conn.Authenticate("pa\"ss\\word", ""); err != nil {
+		t.Fatalf("could not authenticate: error: %s\n", err.Error())
+	}
+	err := conn.Authenticate("wrong", "")
+	if e, ok := err.(Error); !ok || e.Code != 515 {
+		t.Fatalf("wrong password was accepted: %v\n", err)
+	}
+}
+
+func TestSafeCookieAuth(t *testing.T) {
+	cookie := []byte(strings.Repeat("c", 32))
+	cookieFile := filepath.Join(t.TempDir(), "control_auth_cookie")
+	if err := ioutil.WriteFile(cookieFile, cookie, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// tor answers the challenge knowing the cookie, the nonce is checked by
+	// the hash the client sends back
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		reader := bufio.NewReader(server)
+		read := func() string {
+			line, _ := reader.ReadString('\n')
+			return strings.TrimRight(line, "\r\n")
+		}
+		read()
+		server.Write([]byte(strings.Replace(protocolInfo, "%s", cookieFile, 1)))
+		clientNonce, _ := hex.DecodeString(strings.TrimPrefix(read(), "AUTHCHALLENGE SAFECOOKIE "))
+		serverNonce := []byte(strings.Repeat("s", 32))
+		message := append(append(append([]byte{}, cookie...), clientNonce...), serverNonce...)
+		server.Write([]byte("250 AUTHCHALLENGE SERVERHASH=" + hex.EncodeToString(cookieHash(SERVER_TO_CONTROLLER, message)) +
+			" SERVERNONCE=" + hex.EncodeToString(serverNonce) + "\r\n"))
+		hash, _ := hex.DecodeString(strings.TrimPrefix(read(), "AUTHENTICATE "))
+		if !hmac.Equal(hash, cookieHash(CONTROLLER_TO_SERVER, message)) {
+			server.Write([]byte("515 Authentication failed: Safe cookie response did not match expected value.\r\n"))
+			done <- nil
+			return
+		}
+		server.Write([]byte("250 OK\r\n"))
+		done <- nil
+	}()
+	conn := NewConn(client)
+	defer conn.Close()
+	if err := conn.Authenticate("", ""); err != nil {
+		t.Fatalf("could not authenticate with cookie: error: %s\n", err.Error())
+	}
+	<-done
+}
+
+func TestWrongSafeCookie(t *testing.T) {
+	cookieFile := filepath.Join(t.TempDir(), "control_auth_cookie")
+	if err := ioutil.WriteFile(cookieFile, []byte(strings.Repeat("c", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a tor not knowing the cookie must not get our hash of it
+	conn := startFakeTor(t, map[string]string{
+		"PROTOCOLINFO":  strings.Replace(protocolInfo, "%s", cookieFile, 1),
+		"AUTHCHALLENGE": "250 AUTHCHALLENGE SERVERHASH=" + strings.Repeat("00", 32) + " SERVERNONCE=" + strings.Repeat("11", 32) + "\r\n",
+		"AUTHENTICATE":  "250 OK\r\n",
+	})
+	if err := conn.Authenticate("", ""); err == nil {
+		t.Fatalf("authenticated to a tor not knowing the cookie\n")
+	}
+}
+
+func TestAddOnion(t *testing.T) {
+	conn := startFakeTor(t, map[string]string{
+		"ADD_ONION ED25519-V3:a2V5 Flags=DiscardPK Port=3141,localhost:3141": "250-ServiceID=abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz23\r\n250 OK\r\n",
+		"ADD_ONION RSA1024:": "512 Invalid key type\r\n",
+	})
+	serviceID, err := conn.AddOnion("ED25519-V3:a2V5", 3141, "localhost:3141")
+	if err != nil {
+		t.Fatalf("could not add onion: error: %s\n", err.Error())
+	}
+	if serviceID != "abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz23" {
+		t.Fatalf("wrong service id %s\n", serviceID)
+	}
+	if _, err := conn.AddOnion("RSA1024:a2V5", 3141, "localhost:3141"); err == nil {
+		t.Fatalf("error reply was not returned\n")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	// events arrive between the lines of replies
+	conn := startFakeTor(t, map[string]string{
+		"SETEVENTS HS_DESC": "250 OK\r\n",
+		"GETINFO status/bootstrap-phase": "650 HS_DESC UPLOAD abc UNKNOWN $AAAA\r\n" +
+			"250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=85 TAG=ap_conn_done SUMMARY=\"Connected to a relay to build circuits\"\r\n" +
+			"250 OK\r\n",
+		"GETINFO network-liveness": "650 HS_DESC UPLOADED abc UNKNOWN $AAAA\r\n" +
+			"250-network-liveness=up\r\n250 OK\r\n",
+		"GETINFO onions/current": "250+onions/current=\r\nabc\r\n..def\r\n.\r\n250 OK\r\n",
+	})
+	if err := conn.SetEvents("HS_DESC"); err != nil {
+		t.Fatalf("could not set events: error: %s\n", err.Error())
+	}
+	bootstrap, err := conn.Bootstrap()
+	if err != nil {
+		t.Fatalf("could not get bootstrap: error: %s\n", err.Error())
+	}
+	if bootstrap.Progress != 85 || bootstrap.Tag != "ap_conn_done" || bootstrap.Summary != "Connected to a relay to build circuits" {
+		t.Fatalf("wrong bootstrap %+v\n", bootstrap)
+	}
+	live, err := conn.NetworkLive()
+	if err != nil || !live {
+		t.Fatalf("network is not live: %v\n", err)
+	}
+	info, err := conn.GetInfo("onions/current")
+	if err != nil || info["onions/current"] != "abc\n.def" {
+		t.Fatalf("wrong data reply %q: %v\n", info["onions/current"], err)
+	}
+
+	events := conn.Events()
+	if len(events) != 2 || events[1] != "HS_DESC UPLOADED abc UNKNOWN $AAAA" {
+		t.Fatalf("wrong events %q\n", events)
+	}
+	if len(conn.Events()) != 0 {
+		t.Fatalf("events were not drained\n")
+	}
+}
+
+func TestParseKeywords(t *testing.T) {
+	values := ParseKeywords(`NOTICE BOOTSTRAP PROGRESS=5 SUMMARY="say \"hi\" \\ there" TAG=conn`)
+	if values["PROGRESS"] != "5" || values["SUMMARY"] != `say "hi" \ there` || values["TAG"] != "conn" || len(values) != 3 {
+		t.Fatalf("wrong keywords %q\n", values)
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"../client"
+	"../core/db"
+)
+
+/* Scenarios
+ *
+ * Each scenario starts a network of fresh nodes, acts on them and checks
+ * the database of every node at the end. They are what two nodes have to
+ * agree on, whatever changes in the protocol.
+ */
+
+type Scenario struct {
+	Name  string
+	Nodes []string
+	Run   func(*Network) error
+}
+
+// how long a change may take to reach a node
+const PROPAGATION_TIMEOUT = 10 * time.Second
+
+var Scenarios = []Scenario{
+	{Name: "contact request", Nodes: []string{"alice", "bob", "carol"}, Run: contactRequest},
+	{Name: "posts reach their circles only", Nodes: []string{"alice", "bob", "carol"}, Run: circlePosts},
+	{Name: "comments go through the originator", Nodes: []string{"alice", "bob", "carol"}, Run: commentsViaOriginator},
+	{Name: "profile entries reach their circles only", Nodes: []string{"alice", "bob", "carol"}, Run: profileVisibility},
+	{Name: "declined contacts can not authenticate", Nodes: []string{"alice", "bob"}, Run: declinedContact},
+}
+
+// runs scenario on a network of its own
+func Run(scenario Scenario) error {
+	network, err := NewNetwork(scenario.Nodes...)
+	if err != nil {
+		return err
+	}
+	defer network.Close()
+	return scenario.Run(network)
+}
+
+// collects what did not hold at the end of a scenario
+type expectations []string
+
+func (this *expectations) that(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*this = append(*this, fmt.Sprintf(format, args...))
+	}
+}
+
+func (this expectations) err() error {
+	if len(this) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(this, "; "))
+}
+
+func (this *expectations) contact(node *Node, other *Node, status db.RelationStatus) {
+	got, ok := node.ContactStatus(other)
+	this.that(ok && got == status, "%s: contact %s has status %s, expected %s",
+		node.Name, other.Name, db.StatusString(got), db.StatusString(status))
+}
+
+func (this *expectations) noContact(node *Node, other *Node) {
+	_, ok := node.ContactStatus(other)
+	this.that(!ok, "%s: has %s as contact", node.Name, other.Name)
+}
+
+func (this *expectations) post(node *Node, post *db.Post, has bool) {
+	got := node.PostByHash(post.Hash)
+	this.that((got != nil) == has, "%s: has post %q: %t, expected %t", node.Name, post.Message, got != nil, has)
+	if got != nil {
+		this.that(got.Message == post.Message, "%s: post %q arrived as %q", node.Name, post.Message, got.Message)
+		this.that(got.Verified, "%s: signature of post %q was not verified", node.Name, post.Message)
+	}
+}
+
+func (this *expectations) profile(node *Node, other *Node, key string, value string, has bool) {
+	got, ok := node.ProfileOf(other, key)
+	this.that(ok == has, "%s: knows %s of %s: %t, expected %t", node.Name, key, other.Name, ok, has)
+	this.that(!has || got == value, "%s: %s of %s is %q, expected %q", node.Name, key, other.Name, got, value)
+}
+
+// waits until node has post
+func (this *Network) await(node *Node, post *db.Post) error {
+	return this.Eventually(PROPAGATION_TIMEOUT, func() error {
+		if node.PostByHash(post.Hash) == nil {
+			return fmt.Errorf("%s did not receive post %q", node.Name, post.Message)
+		}
+		return nil
+	})
+}
+
+// alice asks bob, bob accepts. carol stays out of it.
+func contactRequest(network *Network) error {
+	alice, bob, carol := network.Node("alice"), network.Node("bob"), network.Node("carol")
+	if err := alice.RequestContact(bob, "hello bob"); err != nil {
+		return err
+	}
+
+	var expect expectations
+	expect.contact(alice, bob, db.PENDING)
+	expect.contact(bob, alice, db.OPEN)
+	if contact := bob.DB.GetContactByOnion(alice.Onion); contact != nil {
+		expect.that(contact.RequestMessage == "hello bob", "bob: request message is %q", contact.RequestMessage)
+		expect.that(contact.RequestVerified, "bob: request of alice was not verified")
+	}
+	if err := expect.err(); err != nil {
+		return err
+	}
+
+	if err := bob.AcceptContact(alice); err != nil {
+		return err
+	}
+	network.Eventually(PROPAGATION_TIMEOUT, func() error {
+		if status, _ := alice.ContactStatus(bob); status != db.SUCCESS {
+			return errors.New("alice did not learn that bob accepted")
+		}
+		return nil
+	})
+
+	expect.contact(alice, bob, db.SUCCESS)
+	expect.contact(bob, alice, db.SUCCESS)
+	expect.that(len(alice.Contacts()) == 1, "alice: %d contacts, expected 1", len(alice.Contacts()))
+	expect.that(len(bob.Contacts()) == 1, "bob: %d contacts, expected 1", len(bob.Contacts()))
+	expect.that(len(carol.Contacts()) == 0, "carol: %d contacts, expected none", len(carol.Contacts()))
+	// each side has the other in a circle of its own
+	for _, pair := range [][2]*Node{{alice, bob}, {bob, alice}} {
+		circles, err := pair[0].circles([]string{pair[1].Name})
+		expect.that(err == nil && len(circles) == 1, "%s: no circle for %s", pair[0].Name, pair[1].Name)
+	}
+	return expect.err()
+}
+
+// alice posts to a circle holding bob only, carol is a contact as well
+func circlePosts(network *Network) error {
+	alice, bob, carol := network.Node("alice"), network.Node("bob"), network.Node("carol")
+	for _, contact := range []*Node{bob, carol} {
+		if err := network.Connect(alice, contact); err != nil {
+			return err
+		}
+	}
+	if err := alice.AddToCircle("friends", bob); err != nil {
+		return err
+	}
+	post, err := alice.Post("hello friends", "friends")
+	if err != nil {
+		return err
+	}
+	if err = network.await(bob, post); err != nil {
+		return err
+	}
+	// carol asks herself, she must not get it either way
+	if err = carol.Sync(alice); err != nil {
+		return err
+	}
+
+	var expect expectations
+	expect.post(alice, post, true)
+	expect.post(bob, post, true)
+	expect.post(carol, post, false)
+	if got := bob.PostByHash(post.Hash); got != nil {
+		expect.that(got.Author.Onion == alice.Onion, "bob: post has author %s, expected alice", got.Author.Onion)
+		expect.that(got.Originator.Onion == alice.Onion, "bob: post has originator %s, expected alice", got.Originator.Onion)
+	}
+	return expect.err()
+}
+
+// bob comments on a post of alice, carol who is no contact of bob gets it
+// from alice
+func commentsViaOriginator(network *Network) error {
+	alice, bob, carol := network.Node("alice"), network.Node("bob"), network.Node("carol")
+	for _, contact := range []*Node{bob, carol} {
+		if err := network.Connect(alice, contact); err != nil {
+			return err
+		}
+	}
+	if err := alice.AddToCircle("friends", bob, carol); err != nil {
+		return err
+	}
+	post, err := alice.Post("what do you think?", "friends")
+	if err != nil {
+		return err
+	}
+	for _, node := range []*Node{bob, carol} {
+		if err = network.await(node, post); err != nil {
+			return err
+		}
+	}
+
+	comment, err := bob.Comment(post, "looks good")
+	if err != nil {
+		return err
+	}
+	for _, node := range []*Node{alice, carol} {
+		if err = network.await(node, comment); err != nil {
+			return err
+		}
+	}
+
+	var expect expectations
+	expect.noContact(bob, carol)
+	expect.noContact(carol, bob)
+	for _, node := range network.Nodes {
+		expect.post(node, comment, true)
+		comments := node.Comments(post.Hash)
+		expect.that(len(comments) == 1, "%s: %d comments on the post, expected 1", node.Name, len(comments))
+		for _, got := range comments {
+			expect.that(got.Author.Onion == bob.Onion, "%s: comment has author %s, expected bob", node.Name, got.Author.Onion)
+			expect.that(got.Originator.Onion == alice.Onion, "%s: comment has originator %s, expected alice", node.Name, got.Originator.Onion)
+		}
+	}
+	return expect.err()
+}
+
+// alice shows her email to bob and her phone to carol only
+func profileVisibility(network *Network) error {
+	alice, bob, carol := network.Node("alice"), network.Node("bob"), network.Node("carol")
+	for _, contact := range []*Node{bob, carol} {
+		if err := network.Connect(alice, contact); err != nil {
+			return err
+		}
+	}
+	if err := alice.AddToCircle("friends", bob); err != nil {
+		return err
+	}
+	if err := alice.AddToCircle("family", carol); err != nil {
+		return err
+	}
+	if err := alice.SetProfile("email", "alice@example.org", "friends"); err != nil {
+		return err
+	}
+	if err := alice.SetProfile("phone", "555-0100", "family"); err != nil {
+		return err
+	}
+	for _, node := range []*Node{bob, carol} {
+		if err := node.Sync(alice); err != nil {
+			return err
+		}
+	}
+
+	var expect expectations
+	expect.profile(alice, alice, "email", "alice@example.org", true)
+	expect.profile(alice, alice, "phone", "555-0100", true)
+	expect.profile(bob, alice, "email", "alice@example.org", true)
+	expect.profile(bob, alice, "phone", "", false)
+	expect.profile(carol, alice, "email", "", false)
+	expect.profile(carol, alice, "phone", "555-0100", true)
+	return expect.err()
+}
+
+// bob declines alice after they were contacts, she can neither pull what
+// bob posts to her circle nor push her posts to him
+func declinedContact(network *Network) error {
+	alice, bob := network.Node("alice"), network.Node("bob")
+	if err := network.Connect(alice, bob); err != nil {
+		return err
+	}
+	if err := alice.AddToCircle("friends", bob); err != nil {
+		return err
+	}
+	if err := bob.AddToCircle("friends", alice); err != nil {
+		return err
+	}
+	contact := bob.DB.GetContactByOnion(alice.Onion)
+	contact.Status = db.DECLINED
+	if err := bob.DB.Save(contact).Error; err != nil {
+		return err
+	}
+
+	hidden, err := bob.Post("not for alice anymore", "friends")
+	if err != nil {
+		return err
+	}
+	pushed, err := alice.Post("hello bob", "friends")
+	if err != nil {
+		return err
+	}
+	// alice falls back to an anonymous pull, which gets public posts only
+	alice.Sync(bob)
+	client.DeliverTriggers(&alice.DB)
+
+	var expect expectations
+	expect.post(alice, hidden, false)
+	expect.post(bob, pushed, false)
+	return expect.err()
+}
@@ -0,0 +1,421 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"../client"
+	"../core/crypto"
+	"../core/db"
+	"../sync/server"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/* Simulator
+ *
+ * Runs complete nodes in one process: each has its own identity, SSNDB in
+ * a temporary directory, syncerd handler and sync scheduler. They reach
+ * each other through client.LoopbackTransport instead of Tor, everything
+ * else is the code of a real node. Actions go through the same functions
+ * the frontend uses, see Node.
+ */
+
+// workers of the scheduler of each node
+const NODE_SYNC_WORKERS = 2
+
+type Network struct {
+	Transport *client.LoopbackTransport
+	Nodes     []*Node
+	dir       string
+}
+
+type Node struct {
+	Name      string
+	Onion     string
+	Id        *crypto.Identity
+	DB        db.SSNDB
+	listener  net.Listener
+	scheduler *client.SyncScheduler
+}
+
+// starts a node for each of names. The loopback transport becomes the
+// transport of the process, the schedulers of the nodes pull what their
+// servers are triggered for.
+func NewNetwork(names ...string) (*Network, error) {
+	dir, err := ioutil.TempDir("", "zwiebelnetz-simulator")
+	if err != nil {
+		return nil, err
+	}
+	this := &Network{Transport: client.NewLoopbackTransport(), dir: dir}
+	client.DefaultTransport = this.Transport
+	server.Schedulers = func(id *crypto.Identity) server.Scheduler {
+		return client.GetSyncScheduler(id)
+	}
+
+	for _, name := range names {
+		node, err := newNode(this.Transport, filepath.Join(dir, name+".db"), name)
+		if err != nil {
+			this.Close()
+			return nil, fmt.Errorf("could not start node %s: %s", name, err)
+		}
+		this.Nodes = append(this.Nodes, node)
+	}
+	return this, nil
+}
+
+// takes all nodes offline, stops their schedulers and removes their
+// databases
+func (this *Network) Close() {
+	for _, node := range this.Nodes {
+		node.listener.Close()
+		node.scheduler.Stop()
+		node.DB.Close()
+	}
+	os.RemoveAll(this.dir)
+}
+
+func (this *Network) Node(name string) *Node {
+	for _, node := range this.Nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// polls check until it succeeds or timeout passed, in between the nodes
+// deliver their due TRIGGERs. Returns the last error of check.
+func (this *Network) Eventually(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		for _, node := range this.Nodes {
+			client.DeliverTriggers(&node.DB)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// makes a and b contacts of each other: a asks, b accepts
+func (this *Network) Connect(a *Node, b *Node) error {
+	if err := a.RequestContact(b, "hello from "+a.Name); err != nil {
+		return err
+	}
+	if err := b.AcceptContact(a); err != nil {
+		return err
+	}
+	return this.Eventually(5*time.Second, func() error {
+		if status, _ := a.ContactStatus(b); status != db.SUCCESS {
+			return fmt.Errorf("%s did not learn that %s accepted", a.Name, b.Name)
+		}
+		return nil
+	})
+}
+
+// a node with a fresh v3 identity, set up as the wizard does
+func newNode(transport client.Transport, dbname string, name string) (*Node, error) {
+	key, err := crypto.GenerateEd25519Key()
+	if err != nil {
+		return nil, err
+	}
+	pemKey, err := crypto.Ed25519Key2Pem(key)
+	if err != nil {
+		return nil, err
+	}
+	this := &Node{Name: name}
+	if this.Id, err = crypto.ParseIdentity(pemKey); err != nil {
+		return nil, err
+	}
+	this.Onion = this.Id.Onion()
+
+	this.DB.Open(dbname)
+	self := db.Onion{Onion: this.Onion, Version: 3}
+	this.DB.FirstOrCreate(&self, self)
+	user := db.User{Username: name, Onion: self, PemKey: string(pemKey)}
+	if err = user.SetPassword(name); err != nil {
+		return nil, err
+	}
+	this.DB.Save(&user)
+	selfContact := db.Contact{}
+	this.DB.Where(db.Contact{OnionId: self.Id}).Attrs(db.Contact{Nickname: name}).FirstOrCreate(&selfContact)
+
+	this.scheduler = client.NewSyncScheduler(this.Id, dbname, NODE_SYNC_WORKERS)
+	client.SetSyncScheduler(this.scheduler)
+
+	if this.listener, err = transport.Listen(this.Onion); err != nil {
+		this.scheduler.Stop()
+		this.DB.Close()
+		return nil, err
+	}
+	go server.Serve(this.listener, this.DB, this.Id)
+	return this, nil
+}
+
+/* Actions */
+
+// asks other to become our contact, as the contacts page does
+func (this *Node) RequestContact(other *Node, message string) error {
+	contact := db.Contact{Alias: other.Name, Status: db.PENDING, RequestMessage: message}
+	contact.Onion = this.DB.GetOnion(other.Onion)
+	if contact.Onion.Id == 0 {
+		contact.Onion = db.Onion{Onion: other.Onion, Version: 3}
+	}
+	if err := this.DB.Create(&contact).Error; err != nil {
+		return err
+	}
+	self := this.DB.GetSelfOnion()
+	return client.ContactRequestHandling(&contact, &self, this.Id)
+}
+
+// accepts the open request of other and sends our response
+func (this *Node) AcceptContact(other *Node) error {
+	contact := this.DB.GetContactByOnion(other.Onion)
+	if contact == nil || contact.Status != db.OPEN {
+		return errors.New(this.Name + " has no open contact request of " + other.Name)
+	}
+	contact.Alias = other.Name // the circle of the contact gets its name
+	contact.Response = db.ACCEPTED
+	this.DB.SetContactToSuccess(contact)
+	if err := client.ContactResponseHandling(contact, this.Id); err != nil {
+		return err
+	}
+	contact.Response = db.NO_DECISION
+	return this.DB.Save(contact).Error
+}
+
+// puts the contacts others into circle name, which is created if needed
+func (this *Node) AddToCircle(name string, others ...*Node) error {
+	circle := db.Circle{Name: name}
+	this.DB.Find(&circle, circle)
+	if circle.Id == 0 {
+		circle.Creator = db.CREATOR_USER
+		if err := this.DB.Create(&circle).Error; err != nil {
+			return err
+		}
+	}
+	for _, other := range others {
+		contact := this.DB.GetContactByOnion(other.Onion)
+		if contact == nil {
+			return errors.New(other.Name + " is no contact of " + this.Name)
+		}
+		if err := this.DB.Model(&circle).Association("Contacts").Append(*contact).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Node) circles(names []string) ([]db.Circle, error) {
+	var circles []db.Circle
+	for _, name := range names {
+		circle := db.Circle{Name: name}
+		this.DB.Find(&circle, circle)
+		if circle.Id == 0 {
+			return nil, errors.New(this.Name + " has no circle " + name)
+		}
+		circles = append(circles, circle)
+	}
+	return circles, nil
+}
+
+// publishes a post to circles and triggers their contacts
+func (this *Node) Post(message string, circleNames ...string) (*db.Post, error) {
+	circles, err := this.circles(circleNames)
+	if err != nil {
+		return nil, err
+	}
+	self := this.DB.GetSelfOnion()
+	post := db.Post{
+		Message:      message,
+		TTL:          3,
+		Author:       self,
+		AuthorId:     self.Id,
+		Originator:   self,
+		OriginatorId: self.Id,
+		PostedAt:     time.Now(),
+		PublishedAt:  time.Now(),
+		Published:    true,
+	}
+	this.DB.SignPost(&post)
+	if err = this.DB.Create(&post).Error; err != nil {
+		return nil, err
+	}
+	for _, circle := range circles {
+		if err = this.DB.Model(&circle).Association("Posts").Append(&post).Error; err != nil {
+			return nil, err
+		}
+	}
+	client.TriggerCircles(&this.DB, circles)
+	return &post, nil
+}
+
+// comments on our copy of parent, the comment goes to the originator of
+// parent which passes it on
+func (this *Node) Comment(parent *db.Post, message string) (*db.Post, error) {
+	ours := this.PostByHash(parent.Hash)
+	if ours == nil {
+		return nil, errors.New(this.Name + " does not have the post to comment on")
+	}
+	self := this.DB.GetSelfOnion()
+	comment := db.Post{
+		Message:      message,
+		TTL:          ours.TTL,
+		Author:       self,
+		AuthorId:     self.Id,
+		OriginatorId: ours.OriginatorId,
+		PostedAt:     time.Now(),
+		PublishedAt:  time.Now(),
+		Published:    true,
+		ParentId:     ours.Id,
+		ParentHash:   ours.Hash,
+	}
+	this.DB.First(&comment.Originator, comment.OriginatorId)
+	this.DB.SignPost(&comment)
+	if err := this.DB.Create(&comment).Error; err != nil {
+		return nil, err
+	}
+	this.DB.RedirectComment(&comment)
+	client.TriggerCircles(&this.DB, this.DB.GetPostCircles(&comment))
+
+	if comment.OriginatorId != comment.AuthorId {
+		client.TriggerHandling(&this.DB, []db.Onion{comment.Originator})
+	} else {
+		comment.RemotePublishedAt = time.Now()
+		this.DB.Save(&comment)
+	}
+	return &comment, nil
+}
+
+// sets key of our profile to value, visible to circles
+func (this *Node) SetProfile(key string, value string, circleNames ...string) error {
+	circles, err := this.circles(circleNames)
+	if err != nil {
+		return err
+	}
+	self := this.DB.GetSelfOnion()
+	profile := db.Profile{}
+	this.DB.Unscoped().Where(db.Profile{OnionId: self.Id, Key: key}).First(&profile)
+	profile.Key = key
+	profile.Value = value
+	profile.Circles = circles
+	profile.Onion = self
+	profile.OnionId = self.Id
+	profile.ChangedAt = time.Now()
+	profile.DeletedAt = time.Time{}
+	if err = this.DB.Unscoped().Save(&profile).Error; err != nil {
+		return err
+	}
+	for _, circle := range circles {
+		if err = this.DB.Model(&circle).Association("Profiles").Append(&profile).Error; err != nil {
+			return err
+		}
+	}
+	client.TriggerCircles(&this.DB, circles)
+	return nil
+}
+
+// pulls from other right away
+func (this *Node) Sync(other *Node) error {
+	contact := this.DB.GetContactByOnion(other.Onion)
+	if contact == nil {
+		return errors.New(other.Name + " is no contact of " + this.Name)
+	}
+	return client.PullHandling(&this.DB, contact, this.Id)
+}
+
+/* State */
+
+// our post with hash, nil if we do not have it
+func (this *Node) PostByHash(hash string) *db.Post {
+	var post db.Post
+	this.DB.Where(db.Post{Hash: hash}).First(&post)
+	if post.Id == 0 {
+		return nil
+	}
+	this.DB.First(&post.Author, post.AuthorId)
+	this.DB.First(&post.Originator, post.OriginatorId)
+	return &post
+}
+
+// the comments we have on the post with hash
+func (this *Node) Comments(hash string) []db.Post {
+	post := this.PostByHash(hash)
+	if post == nil {
+		return nil
+	}
+	var comments []db.Post
+	this.DB.Where("parent_id = ?", post.Id).Find(&comments)
+	for i := range comments {
+		this.DB.First(&comments[i].Author, comments[i].AuthorId)
+		this.DB.First(&comments[i].Originator, comments[i].OriginatorId)
+	}
+	return comments
+}
+
+// the status of our contact other, false if other is none
+func (this *Node) ContactStatus(other *Node) (db.RelationStatus, bool) {
+	contact := this.DB.GetContactByOnion(other.Onion)
+	if contact == nil {
+		return 0, false
+	}
+	return contact.Status, true
+}
+
+// the value of key in the profile of other as we know it
+func (this *Node) ProfileOf(other *Node, key string) (string, bool) {
+	onion := this.DB.GetOnion(other.Onion)
+	if onion.Id == 0 {
+		return "", false
+	}
+	var profile db.Profile
+	this.DB.Where(db.Profile{OnionId: onion.Id, Key: key}).First(&profile)
+	return profile.Value, profile.Id != 0
+}
+
+// the contacts we have, without ourselves
+func (this *Node) Contacts() []db.Contact {
+	self := this.DB.GetSelfOnion()
+	var contacts []db.Contact
+	this.DB.Where("onion_id != ?", self.Id).Find(&contacts)
+	return contacts
+}
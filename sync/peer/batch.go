@@ -0,0 +1,245 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package peer
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"../../core/db"
+	"../../logger"
+	"../protocol"
+)
+
+func WritePost(conn net.Conn, dbconn *db.SSNDB, post *db.Post, features []string) error {
+	if post.Revision > 0 && !protocol.HasFeature(features, protocol.FEATURE_EDITS) {
+		// peers without edits would take an edit for a new post
+		post = dbconn.FirstRevision(post)
+	}
+	err := protocol.WritePacket(conn, protocol.EncodePushPost(post))
+	logger.ConditionalWarning(err, "sending post back failed!")
+	return err
+}
+
+func WriteProfiles(conn net.Conn, profiles *list.List) error {
+	for itr := profiles.Front(); itr != nil; itr = itr.Next() {
+		profile := itr.Value.(*db.Profile)
+		err := protocol.WritePacket(conn, protocol.EncodePushProfile(profile))
+		if logger.ConditionalWarning(err, "sending profile back failed!") {
+			return err
+		}
+	}
+	return nil
+}
+
+// answers a PULL_BATCH of contact with what it may see after the cursor of
+// req, returns whether there is more
+func SendBatch(conn net.Conn, dbconn *db.SSNDB, contact *db.Contact, req protocol.PullRequest, features []string) (bool, error) {
+	var err error
+	cursor := dbconn.LegacySyncCursor(req.Since)
+	if req.Cursor != "" {
+		cursor, err = db.DecodeSyncCursor(req.Cursor)
+		if err != nil {
+			return false, errors.New("could not decode cursor: " + err.Error())
+		}
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = protocol.PULL_BATCH_SIZE
+	} else if limit > protocol.MAX_PULL_BATCH_SIZE {
+		limit = protocol.MAX_PULL_BATCH_SIZE
+	}
+
+	posts, profiles, next, more := dbconn.GetSyncBatch(contact, cursor, int(limit),
+		protocol.HasFeature(features, protocol.FEATURE_TOMBSTONES),
+		protocol.HasFeature(features, protocol.FEATURE_PROFILE))
+
+	if contact == nil {
+		logger.Debug(fmt.Sprint("SEND(", len(posts), " POSTS, ", profiles.Len(), " PROFILES) to (unknown person)"))
+	} else {
+		logger.Debug(fmt.Sprint("SEND(", len(posts), " POSTS, ", profiles.Len(), " PROFILES) to ", contact.Alias))
+	}
+
+	for _, post := range posts {
+		if err = WritePost(conn, dbconn, post, features); err != nil {
+			return false, err
+		}
+	}
+	if err = WriteProfiles(conn, profiles); err != nil {
+		return false, err
+	}
+
+	if protocol.HasFeature(features, protocol.FEATURE_MESSAGES) {
+		var msgs []*db.Message
+		var moreMsgs bool
+		msgs, next, moreMsgs = dbconn.GetMessageBatch(contact, next, int(limit))
+		for _, msg := range msgs {
+			err = protocol.WritePacket(conn, protocol.EncodePushMessage(msg))
+			if logger.ConditionalWarning(err, "sending message failed!") {
+				return false, err
+			}
+		}
+		more = more || moreMsgs
+	}
+
+	if protocol.HasFeature(features, protocol.FEATURE_REACTIONS) {
+		reactions, counts, nextReactions, moreReactions := dbconn.GetReactionBatch(contact, next, int(limit))
+		for _, reaction := range reactions {
+			err = protocol.WritePacket(conn, protocol.EncodePushReaction(reaction))
+			if logger.ConditionalWarning(err, "sending reaction failed!") {
+				return false, err
+			}
+		}
+		for _, postCounts := range counts {
+			err = protocol.WritePacket(conn, protocol.EncodePushReactionCounts(postCounts))
+			if logger.ConditionalWarning(err, "sending reaction counts failed!") {
+				return false, err
+			}
+		}
+		next = nextReactions
+		more = more || moreReactions
+	}
+
+	err = protocol.WritePacket(conn, protocol.EncodePullEnd(protocol.PullEnd{Cursor: next.Encode(), More: more}))
+	logger.ConditionalWarning(err, "sending pull end packet failed!")
+	return more, err
+}
+
+// sends what contact may see directly after we authenticated, instead of a
+// TRIGGER after which contact would connect back to pull it
+func (conn OnionConnection) Push(dbconn *db.SSNDB, contact *db.Contact) error {
+	if err := conn.refusePlaintext(); err != nil {
+		return err
+	}
+	if err := protocol.WritePacket(conn, protocol.EncodePush()); err != nil {
+		return errors.New("could not send push: " + err.Error())
+	}
+	for {
+		header, err := protocol.ReadHeader(conn)
+		if err != nil {
+			return errors.New("error while waiting for pull request: " + err.Error())
+		}
+		if header.PacketType == protocol.SUCCESS {
+			return nil
+		} else if header.PacketType != protocol.PULL_BATCH {
+			return fmt.Errorf("expected pull request, but got %c instead", header.PacketType)
+		}
+		if 4096 < header.PacketLength {
+			return errors.New("pull request is greater than 4096 bytes")
+		}
+		payload := make([]byte, header.PacketLength)
+		if err = protocol.ReadPayload(conn, payload); err != nil {
+			return errors.New("could not read pull request: " + err.Error())
+		}
+		req, err := protocol.DecodePullRequest(payload)
+		if err != nil {
+			return errors.New("could not decode pull request: " + err.Error())
+		}
+		if _, err = SendBatch(conn, dbconn, contact, req, conn.Features); err != nil {
+			return err
+		}
+	}
+}
+
+// the batches contact pushed to us on conn, which we authenticated it on
+func ReceivePush(conn OnionConnection, dbconn *db.SSNDB, contact *db.Contact) error {
+	state := dbconn.GetSyncState(contact.Onion)
+	err := conn.PullBatches(state.Cursor, state.Since, StoreBatch(dbconn, contact, conn))
+	if err != nil {
+		return err
+	}
+	return protocol.WritePacket(conn, protocol.EncodeSuccess())
+}
+
+// stores the batches pulled from contact on conn and the cursor after each
+func StoreBatch(dbconn *db.SSNDB, contact *db.Contact, conn OnionConnection) func(Batch, string) error {
+	return func(batch Batch, cursor string) error {
+		logger.Debug(fmt.Sprint("RECEIVED(", len(batch.Posts), " POSTS, ", len(batch.Profiles), " PROFILES, ",
+			len(batch.Messages), " MESSAGES, ", len(batch.Reactions)+len(batch.ReactionCounts), " REACTIONS) from ", contact.Alias))
+		StorePulled(dbconn, batch.Posts, batch.Profiles, conn.Supports(protocol.FEATURE_PROFILE))
+		if contact.Status == db.SUCCESS {
+			dbconn.AddMessages(contact.Onion, batch.Messages)
+			StoreReactions(dbconn, contact.Onion, batch.Reactions, batch.ReactionCounts)
+		}
+		return dbconn.SaveSyncCursor(contact.Onion, cursor)
+	}
+}
+
+// stores what we pulled from a contact, profileDelta if the contact sent
+// the changed profile entries only
+func StorePulled(dbconn *db.SSNDB, posts []db.Post, profiles []db.Profile, profileDelta bool) {
+	if profileDelta {
+		dbconn.ApplyProfileChanges(profiles)
+	} else {
+		dbconn.AddOrUpdateProfiles(profiles)
+	}
+	dbconn.AddOrUpdatePosts(posts)
+
+	for _, post := range posts {
+		TriggerOnReceivingComment(dbconn, &post)
+	}
+}
+
+// stores the reactions sender sent to our posts and the counts of its own
+// posts, the circles of our posts learn about the new counts
+func StoreReactions(dbconn *db.SSNDB, sender db.Onion, reactions []db.Reaction, counts []db.PostReactions) {
+	for _, post := range dbconn.AddReactions(sender, reactions) {
+		dbconn.QueueCircleTriggers(dbconn.GetPostCircles(&post))
+	}
+	dbconn.SetReactionCounts(sender, counts)
+}
+
+// publishes a comment to one of our posts to the circles of the post, the
+// triggers are delivered with the outbox
+func TriggerOnReceivingComment(dbconn *db.SSNDB, comment *db.Post) {
+	if comment.ParentId == 0 {
+		return
+	}
+
+	var parentPost db.Post
+	dbconn.First(&parentPost, comment.ParentId)
+
+	if parentPost.OriginatorId != dbconn.GetSelfOnion().Id {
+		return
+	}
+
+	comment.PublishedAt = time.Now()
+	comment.Published = true
+	dbconn.Unscoped().Save(comment) // unscoped, so the tombstone of a comment is passed on too
+
+	dbconn.QueueCircleTriggers(dbconn.GetPostCircles(comment))
+}
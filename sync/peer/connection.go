@@ -0,0 +1,542 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package peer
+
+import (
+	"../../core/crypto"
+	"../../core/crypto/auth"
+	"../../core/db"
+	"../../logger"
+	"../protocol"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+/* Peer
+ *
+ * What both sides of a connection between two nodes share: the packets
+ * exchanged on it, sessions and the batches of a sync. The client dials
+ * peers, the server answers them, both talk to them through this package.
+ */
+
+type OnionConnection struct {
+	net.Conn
+	Onion       string
+	Established bool
+	Version     uint16   // negotiated protocol version, 0 for peers without HELLO
+	Features    []string // features both sides announced in their HELLO
+	Self        string   // the onion we authenticated as, empty if we did not
+	Encrypted   bool     // the packets go through the secure channel
+	Binding     []byte   // protocol.HelloBinding, the authentication is bound to it
+	ContactWork int      // proof of work the peer requires for contact requests, 0 if it did not say
+}
+
+// the peer closed the connection on our HELLO without a single byte, as a
+// syncerd from before the handshake does
+var ErrHelloRejected = errors.New("peer closed the connection on HELLO")
+
+// a connection to onion which agreed on features already, like the one of a
+// peer which connected to us
+func NewOnionConnection(conn net.Conn, onion string, features []string) OnionConnection {
+	return OnionConnection{Conn: conn, Onion: onion, Established: true, Features: features}
+}
+
+// agrees on protocol version and features with the peer, ErrHelloRejected
+// if it closed the connection on HELLO
+func (conn *OnionConnection) Hello() error {
+	ours := protocol.EncodeHello(protocol.OurHello())
+	err := protocol.WritePacket(conn, ours)
+	if err != nil {
+		return errors.New("could not send hello: " + err.Error())
+	}
+	header, err := protocol.ReadHeader(conn)
+	if err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+		return ErrHelloRejected
+	}
+	if err != nil {
+		return errors.New("error while reading hello header: " + err.Error())
+	}
+	if header.PacketType != protocol.HELLO {
+		return fmt.Errorf("expected hello packet, but got %c instead", header.PacketType)
+	}
+	if 4096 < header.PacketLength {
+		return errors.New("hello packet is greater than 4096 bytes")
+	}
+	buffer := make([]byte, header.PacketLength)
+	if err = protocol.ReadPayload(conn, buffer); err != nil {
+		return errors.New("could not read hello: " + err.Error())
+	}
+	hello, err := protocol.DecodeHello(buffer)
+	if err != nil {
+		return errors.New("could not decode hello: " + err.Error())
+	}
+	conn.Version = protocol.NegotiateVersion(protocol.PROTOCOL_VERSION, hello.Version)
+	conn.Features = protocol.NegotiateFeatures(protocol.SupportedFeatures, hello.Features)
+	conn.Binding = protocol.HelloBinding(ours[protocol.HEADER_SIZE:], buffer)
+	conn.ContactWork = hello.ContactWork
+	return nil
+}
+
+// reports whether both sides announced feature in their HELLO
+func (conn OnionConnection) Supports(feature string) bool {
+	return protocol.HasFeature(conn.Features, feature)
+}
+
+// authenticates us to the peer, the peer's key is pinned in dbconn.
+// v3 onions are authenticated with ed25519 keys, v2 onions with RSA keys.
+// Peers which support it prove their key to us as well and are talked to
+// through the secure channel after.
+func (conn *OnionConnection) Auth(id *crypto.Identity, dbconn *db.SSNDB) error {
+	var err error
+	if conn.Supports(protocol.FEATURE_MUTUAL) {
+		err = conn.authMutual(id, dbconn)
+	} else if crypto.OnionVersion(conn.Onion) == 3 && id.Ed25519 != nil {
+		if !conn.Supports(protocol.FEATURE_ED25519) {
+			return errors.New("peer does not support ed25519 authentication")
+		}
+		err = conn.authV3(id, dbconn)
+		conn.Self = crypto.GetOnionAddressV3(id.Ed25519.Public().(ed25519.PublicKey))
+	} else if id.RSA == nil {
+		return errors.New("no RSA key to authenticate to v2 onion " + conn.Onion)
+	} else {
+		err = conn.authV2(id.RSA, dbconn)
+		conn.Self = crypto.GetOnionAddress(&id.RSA.PublicKey)
+	}
+	if err != nil {
+		conn.Self = ""
+		return err
+	}
+	if conn.Supports(protocol.FEATURE_SECURE) {
+		return conn.secureChannel(id)
+	}
+	return nil
+}
+
+// sets up the secure channel for a connection on which we do not
+// authenticate, if the peer supports it
+func (conn *OnionConnection) Secure() error {
+	if !conn.Supports(protocol.FEATURE_SECURE) || conn.Encrypted {
+		return nil
+	}
+	return conn.secureChannel(nil)
+}
+
+// agrees on the keys of the secure channel with the peer, as the onion we
+// authenticated as if any, and encrypts everything after
+func (conn *OnionConnection) secureChannel(id *crypto.Identity) error {
+	initiation, ephemeral, err := auth.InitiateKeyExchange(id, conn.Self, conn.Onion)
+	if err != nil {
+		return err
+	}
+	if err = protocol.WritePacket(conn, protocol.EncodeKeyExchange(initiation)); err != nil {
+		return errors.New("could not send key exchange: " + err.Error())
+	}
+
+	header, err := protocol.ReadHeader(conn)
+	if err != nil {
+		return errors.New("error while reading key exchange header: " + err.Error())
+	}
+	if header.PacketType != protocol.KEY_EXCHANGE {
+		return fmt.Errorf("expected key exchange, but got %c instead", header.PacketType)
+	}
+	if 4096 < header.PacketLength {
+		return errors.New("key exchange packet is greater than 4096 bytes")
+	}
+	buffer := make([]byte, header.PacketLength)
+	if err = protocol.ReadPayload(conn, buffer); err != nil {
+		return errors.New("could not read key exchange: " + err.Error())
+	}
+	response, err := protocol.DecodeKeyExchange(buffer)
+	if err != nil {
+		return errors.New("could not decode key exchange: " + err.Error())
+	}
+
+	keys, err := auth.CompleteKeyExchange(ephemeral, conn.Self, conn.Onion, initiation, response)
+	if err != nil {
+		logger.Security(fmt.Sprintf("key exchange with %s failed: %s", conn.Onion, err))
+		return err
+	}
+	secure, err := protocol.NewSecureConn(conn.Conn, keys, true)
+	if err != nil {
+		return err
+	}
+	conn.Conn = secure
+	conn.Encrypted = true
+	return conn.AwaitSuccess()
+}
+
+// content must not be sent in plaintext to peers which support the secure
+// channel
+func (conn OnionConnection) refusePlaintext() error {
+	if conn.Supports(protocol.FEATURE_SECURE) && !conn.Encrypted {
+		return errors.New("refusing to talk to " + conn.Onion + " without the secure channel")
+	}
+	return nil
+}
+
+func (conn OnionConnection) authV2(key *rsa.PrivateKey, dbconn *db.SSNDB) error {
+	// 1. send auth request
+	//logger.Debug("...sending auth request")
+	pkg := protocol.EncodeAuth(key.PublicKey)
+	conn.Write(pkg)
+
+	// 2 read and check challenge
+	//logger.Debug("...waiting for challenge")
+	header, err := protocol.ReadHeader(conn)
+	if err != nil {
+		return errors.New("error while reading challenge header: " + err.Error())
+	}
+	if header.PacketType != protocol.CHALLENGE {
+		return errors.New("wrong package type waiting for challenge")
+	}
+	buffer := make([]byte, 16384)
+	_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
+	challenge, err := protocol.DecodeChallenge(buffer[:header.PacketLength])
+	if err != nil {
+		return errors.New("could not decode challenge" + err.Error())
+	}
+
+	// 3 build and send response
+	//logger.Debug("...generating response")
+	response, err := auth.GenerateResponse(challenge,
+		key,
+		conn.Onion)
+	if err != nil {
+		return errors.New("could not build resonionsponse: " + err.Error())
+	}
+	peerKey, err := crypto.UnmarshalPKCS1PublicKey(challenge.PubKey[:])
+	if err != nil {
+		return errors.New("could not decode public key of peer: " + err.Error())
+	}
+	if err = dbconn.PinPublicKey(conn.Onion, crypto.MarshalPKCS1PublicKey(&peerKey)); err != nil {
+		return err
+	}
+	//logger.Debug("...sending response")
+	pkg = protocol.EncodeResponse(&response)
+	conn.Write(pkg)
+
+	return conn.AwaitSuccess()
+}
+
+func (conn OnionConnection) authV3(id *crypto.Identity, dbconn *db.SSNDB) error {
+	// 1. send auth request, with the proof of our old onion if we moved
+	authV3 := protocol.AuthV3{PubKey: id.Ed25519.Public().(ed25519.PublicKey)}
+	authV3.LegacyKey, authV3.LegacySig = id.LegacyProof()
+	conn.Write(protocol.EncodeAuthV3(authV3))
+
+	// 2 read and check challenge
+	header, err := protocol.ReadHeader(conn)
+	if err != nil {
+		return errors.New("error while reading challenge header: " + err.Error())
+	}
+	if header.PacketType != protocol.CHALLENGE_V3 {
+		return errors.New("wrong package type waiting for challenge")
+	}
+	if header.PacketLength > 4096 {
+		return errors.New("challenge too long")
+	}
+	buffer := make([]byte, header.PacketLength)
+	_ = protocol.ReadPayload(conn, buffer)
+	challenge, err := protocol.DecodeChallengeV3(buffer)
+	if err != nil {
+		return errors.New("could not decode challenge" + err.Error())
+	}
+
+	// 3 build and send response
+	response, err := auth.GenerateResponseV3(challenge, id.Ed25519, conn.Onion)
+	if err != nil {
+		return errors.New("could not build response: " + err.Error())
+	}
+	if err = dbconn.PinPublicKey(conn.Onion, challenge.PubKey[:]); err != nil {
+		return err
+	}
+	conn.Write(protocol.EncodeResponseV3(&response))
+
+	return conn.AwaitSuccess()
+}
+
+func (conn *OnionConnection) authMutual(id *crypto.Identity, dbconn *db.SSNDB) error {
+	// 1. send auth request as the onion matching the one of the peer
+	var authMutual protocol.AuthMutual
+	if crypto.OnionVersion(conn.Onion) == 3 && id.Ed25519 != nil {
+		conn.Self = crypto.GetOnionAddressV3(id.Ed25519.Public().(ed25519.PublicKey))
+		authMutual.LegacyKey, authMutual.LegacySig = id.LegacyProof()
+	} else if id.RSA != nil {
+		conn.Self = crypto.GetOnionAddress(&id.RSA.PublicKey)
+	} else {
+		return errors.New("no RSA key to authenticate to v2 onion " + conn.Onion)
+	}
+	init, err := auth.InitiateMutualAuth(conn.Self, conn.Onion)
+	if err != nil {
+		return err
+	}
+	authMutual.MutualInit = init
+	conn.Write(protocol.EncodeAuthMutual(authMutual))
+
+	// 2. read the challenge, the peer proves its key with it
+	header, err := protocol.ReadHeader(conn)
+	if err != nil {
+		return errors.New("error while reading challenge header: " + err.Error())
+	}
+	if header.PacketType != protocol.CHALLENGE_MUTUAL {
+		return errors.New("wrong package type waiting for challenge")
+	}
+	if header.PacketLength > 4096 {
+		return errors.New("challenge too long")
+	}
+	buffer := make([]byte, header.PacketLength)
+	if err = protocol.ReadPayload(conn, buffer); err != nil {
+		return errors.New("could not read challenge: " + err.Error())
+	}
+	challenge, err := protocol.DecodeChallengeMutual(buffer)
+	if err != nil {
+		return errors.New("could not decode challenge" + err.Error())
+	}
+
+	// 3 build and send our proof
+	proof, err := auth.ProveMutualAuth(id, conn.Binding, init, challenge)
+	if err != nil {
+		logger.Security(fmt.Sprintf("%s could not prove its key: %s", conn.Onion, err))
+		return err
+	}
+	if err = dbconn.PinPublicKey(conn.Onion, challenge.PubKey); err != nil {
+		return err
+	}
+	conn.Write(protocol.EncodeResponseMutual(proof))
+
+	return conn.AwaitSuccess()
+}
+
+// 4. await success notification
+func (conn OnionConnection) AwaitSuccess() error {
+	header, err := protocol.ReadHeader(conn)
+	if err != nil {
+		return errors.New("could not receive success notification: " + err.Error())
+	}
+	if header.PacketType != protocol.SUCCESS {
+		return fmt.Errorf("expected success packet, but got %s instead",
+			header.PacketType)
+	}
+	return nil
+}
+
+// what a contact sent on a PULL
+type Batch struct {
+	Posts          []db.Post
+	Profiles       []db.Profile
+	Messages       []db.Message
+	Reactions      []db.Reaction
+	ReactionCounts []db.PostReactions
+}
+
+func (conn OnionConnection) Pull(timestamp int64) ([]db.Post, []db.Profile, error) {
+	if err := conn.refusePlaintext(); err != nil {
+		return nil, nil, err
+	}
+	//logger.Debug(fmt.Sprint("sending PULL with timestamp ", timestamp))
+	conn.Write(protocol.EncodePull(timestamp))
+
+	batch, _, err := conn.receive(protocol.SUCCESS)
+	return batch.Posts, batch.Profiles, err
+}
+
+// pulls batch after batch starting at cursor, or at since if we have no
+// cursor yet. commit is called after every batch with the cursor to resume
+// from once the batch is stored.
+func (conn OnionConnection) PullBatches(cursor string, since int64,
+	commit func(Batch, string) error) error {
+	if err := conn.refusePlaintext(); err != nil {
+		return err
+	}
+	for {
+		req := protocol.PullRequest{Cursor: cursor, Limit: protocol.PULL_BATCH_SIZE}
+		if cursor == "" {
+			req.Since = since
+		}
+		conn.Write(protocol.EncodePullRequest(req))
+
+		batch, payload, err := conn.receive(protocol.PULL_END)
+		if err != nil {
+			return err
+		}
+		end, err := protocol.DecodePullEnd(payload)
+		if err != nil {
+			return errors.New("decode of pull end failed: " + err.Error())
+		}
+		if err = commit(batch, end.Cursor); err != nil {
+			return err
+		}
+		if !end.More {
+			return nil
+		}
+		cursor = end.Cursor
+	}
+}
+
+// reads PUSH_POSTs, PUSH_PROFILEs, PUSH_MESSAGEs and reactions up to a
+// packet of type end, whose payload is returned as well
+func (conn OnionConnection) receive(end protocol.PacketType) (Batch, []byte, error) {
+	batch := Batch{Posts: []db.Post{}, Profiles: []db.Profile{}, Messages: []db.Message{},
+		Reactions: []db.Reaction{}, ReactionCounts: []db.PostReactions{}}
+
+	// default length of post: 64 Kilobyte, relocation is implemented
+	length := uint32(65536)
+	buffer := make([]byte, length)
+	for {
+		header, err := protocol.ReadHeader(conn)
+		if err != nil {
+			return batch, nil, errors.New("error while receiving posts: " + err.Error())
+		}
+
+		if 16777216 < header.PacketLength { // if payload greater than 16 Megabyte
+			return batch, nil, errors.New("Received payload is greater than 16 Megabyte")
+		} else if length < header.PacketLength { // relocate buffer if required
+			buffer = nil // garbage collection help
+			length = header.PacketLength
+			buffer = make([]byte, length)
+		}
+
+		if header.PacketType == end {
+			// finished, no more replies
+			err = protocol.ReadPayload(conn, buffer[:header.PacketLength])
+			return batch, buffer[:header.PacketLength], err
+		} else if header.PacketType == protocol.PUSH_POST {
+
+			_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
+			post, err := protocol.DecodePushPost(
+				buffer[:header.PacketLength],
+				conn.Onion)
+			if err != nil {
+				return batch, nil, errors.New("decode of post failed: " + err.Error())
+			}
+			batch.Posts = append(batch.Posts, post)
+
+		} else if header.PacketType == protocol.PUSH_PROFILE {
+
+			_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
+			profile, err := protocol.DecodePushProfile(
+				buffer[:header.PacketLength],
+				conn.Onion)
+			if err != nil {
+				return batch, nil, errors.New("decode of post failed: " + err.Error())
+			}
+			batch.Profiles = append(batch.Profiles, profile)
+
+		} else if header.PacketType == protocol.PUSH_MESSAGE {
+
+			_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
+			msg, err := protocol.DecodePushMessage(buffer[:header.PacketLength])
+			if err != nil {
+				return batch, nil, errors.New("decode of message failed: " + err.Error())
+			}
+			batch.Messages = append(batch.Messages, msg)
+
+		} else if header.PacketType == protocol.PUSH_REACTION {
+
+			_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
+			reaction, err := protocol.DecodePushReaction(buffer[:header.PacketLength])
+			if err != nil {
+				return batch, nil, errors.New("decode of reaction failed: " + err.Error())
+			}
+			batch.Reactions = append(batch.Reactions, reaction)
+
+		} else if header.PacketType == protocol.PUSH_REACTION_COUNTS {
+
+			_ = protocol.ReadPayload(conn, buffer[:header.PacketLength])
+			counts, err := protocol.DecodePushReactionCounts(buffer[:header.PacketLength])
+			if err != nil {
+				return batch, nil, errors.New("decode of reaction counts failed: " + err.Error())
+			}
+			batch.ReactionCounts = append(batch.ReactionCounts, counts)
+
+		} else {
+			return batch, nil, fmt.Errorf("expected push post, but got %s\n", header.PacketType)
+		}
+	}
+}
+
+func (conn OnionConnection) Trigger() error {
+	if err := conn.refusePlaintext(); err != nil {
+		return err
+	}
+	//logger.Debug("sending TRIGGER")
+	conn.Write(protocol.EncodeTrigger())
+	header, err := protocol.ReadHeader(conn)
+	if err != nil {
+		return errors.New("error while waiting for SUCCESS: " + err.Error())
+	} else if header.PacketType != protocol.SUCCESS {
+		return errors.New("expected SUCCESS, but got " + string(header.PacketType))
+	}
+	return nil
+}
+
+func (conn OnionConnection) ContactResponse(cr protocol.ContactResponse) error {
+	if err := conn.refusePlaintext(); err != nil {
+		return err
+	}
+	conn.Write(protocol.EncodeContactResponse(cr))
+	return conn.AwaitSuccess()
+}
+
+// the proof of work to put into a contact request to the peer, what it
+// announced in HELLO or the default of peers which did not
+func (conn OnionConnection) ContactRequestWork() (int, error) {
+	if conn.ContactWork > protocol.MAX_CONTACT_REQUEST_WORK {
+		return 0, fmt.Errorf("peer requires %d bits of proof of work for contact requests, more than %d",
+			conn.ContactWork, protocol.MAX_CONTACT_REQUEST_WORK)
+	}
+	if conn.ContactWork == 0 {
+		return protocol.CONTACT_REQUEST_WORK, nil
+	}
+	return conn.ContactWork, nil
+}
+
+func (conn OnionConnection) ContactRequest(cr protocol.ContactRequest) error {
+	if err := conn.refusePlaintext(); err != nil {
+		return err
+	}
+	//logger.Debug("sending contact request")
+	conn.Write(protocol.EncodeContactRequest(cr))
+	header, err := protocol.ReadHeader(conn)
+	if err != nil {
+		return errors.New("error while waiting for SUCCESS message " + err.Error())
+	} else if header.PacketType != protocol.SUCCESS {
+		return errors.New("expected success message but received " + string(header.PacketType))
+	}
+	return nil
+}
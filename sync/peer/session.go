@@ -0,0 +1,407 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"../../logger"
+	"../protocol"
+)
+
+// a session without open requests for this long is closed by the client,
+// the server waits twice as long so that it does not close a session the
+// client is about to use
+const SESSION_IDLE_TIMEOUT = 5 * time.Minute
+
+// requests a peer may have open in one session at the same time
+const MAX_SESSION_STREAMS = 16
+
+// data of a stream received but not read yet, a bit more than the largest
+// packet we accept
+const MAX_STREAM_BUFFER = 16777216 + protocol.MAX_FRAME_DATA
+
+var errSessionClosed = errors.New("session closed")
+
+/* Session
+ *
+ * An authenticated connection which carries several requests, each in a
+ * Stream of its own, see the session packets in the protocol. The client
+ * opens streams, the server hands the streams the client opened to accept.
+ */
+type Session struct {
+	conn        OnionConnection
+	writeLock   sync.Mutex // one frame at a time
+	mutex       sync.Mutex
+	streams     map[uint32]*Stream
+	lastId      uint32    // the id of the last stream opened
+	idleSince   time.Time // when the last stream was closed
+	idleTimeout time.Duration
+	lastWrite   time.Time
+	closed      bool
+	done        chan struct{}
+	accept      func(*Stream) // handles a stream the peer opened, nil for the client
+}
+
+func newSession(conn OnionConnection, accept func(*Stream)) *Session {
+	this := &Session{
+		conn:        conn,
+		streams:     map[uint32]*Stream{},
+		idleSince:   time.Now(),
+		idleTimeout: SESSION_IDLE_TIMEOUT,
+		lastWrite:   time.Now(),
+		done:        make(chan struct{}),
+		accept:      accept,
+	}
+	if accept != nil {
+		this.idleTimeout *= 2
+	}
+	go this.keepalive()
+	return this
+}
+
+// keeps the session alive for the peer, and closes it once it was not used
+// for its idle timeout
+func (this *Session) keepalive() {
+	ticker := time.NewTicker(protocol.KEEPALIVE_INTERVAL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.done:
+			return
+		case now := <-ticker.C:
+			this.mutex.Lock()
+			idle := len(this.streams) == 0 && now.Sub(this.idleSince) > this.idleTimeout
+			this.mutex.Unlock()
+			if idle {
+				logger.Debug(fmt.Sprint("closing idle session with ", this.conn.Onion))
+				this.Close()
+				return
+			}
+			this.writeLock.Lock()
+			var err error
+			if now.Sub(this.lastWrite) >= protocol.KEEPALIVE_INTERVAL {
+				err = protocol.WritePacket(this.conn, protocol.EncodeKeepalive())
+				this.lastWrite = now
+			}
+			this.writeLock.Unlock()
+			if err != nil {
+				this.Close()
+				return
+			}
+		}
+	}
+}
+
+// reads frames and passes them to their streams until the session is closed
+func (this *Session) serve() {
+	defer this.Close()
+	for {
+		header, err := protocol.ReadHeader(this.conn)
+		if err != nil {
+			if !this.IsClosed() {
+				logger.Info(fmt.Sprint("session with ", this.conn.Onion, " ended: ", err))
+			}
+			return
+		}
+		if header.PacketType == protocol.KEEPALIVE && header.PacketLength == 0 {
+			continue
+		}
+		if header.PacketType != protocol.SESSION_FRAME || header.PacketLength > uint32(4+protocol.MAX_FRAME_DATA) {
+			logger.Security(fmt.Sprintf("%s sent %c in a session", this.conn.Onion, header.PacketType))
+			return
+		}
+		payload := make([]byte, header.PacketLength)
+		if err = protocol.ReadPayload(this.conn, payload); err != nil {
+			return
+		}
+		requestId, data, err := protocol.DecodeFrame(payload)
+		if err != nil {
+			return
+		}
+
+		stream := this.stream(requestId, len(data) > 0)
+		if stream != nil && !stream.deliver(data) {
+			logger.Security(fmt.Sprintf("%s sent more than a stream may buffer", this.conn.Onion))
+			return
+		}
+	}
+}
+
+// the stream with requestId, a new one if the peer may open it
+func (this *Session) stream(requestId uint32, open bool) *Stream {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if stream, ok := this.streams[requestId]; ok {
+		return stream
+	}
+	if this.accept == nil || !open || requestId <= this.lastId {
+		// a late frame of a stream we closed already
+		return nil
+	}
+	this.lastId = requestId
+	stream := newStream(this, requestId)
+	if len(this.streams) >= MAX_SESSION_STREAMS {
+		logger.Warning(fmt.Sprint(this.conn.Onion, " opened too many streams, refusing one"))
+		stream.remoteClosed = true
+		go stream.Close()
+		return nil
+	}
+	this.streams[requestId] = stream
+	go this.accept(stream)
+	return stream
+}
+
+// opens a stream for a request of ours
+func (this *Session) Open() (OnionConnection, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return OnionConnection{Onion: this.conn.Onion}, errSessionClosed
+	}
+	this.lastId++
+	stream := newStream(this, this.lastId)
+	this.streams[stream.id] = stream
+	conn := NewOnionConnection(stream, this.conn.Onion, this.conn.Features)
+	conn.Self = this.conn.Self
+	conn.Encrypted = this.conn.Encrypted
+	return conn, nil
+}
+
+func (this *Session) writeFrame(requestId uint32, data []byte) error {
+	if this.IsClosed() {
+		return errSessionClosed
+	}
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	this.lastWrite = time.Now()
+	err := protocol.WritePacket(this.conn, protocol.EncodeFrame(requestId, data))
+	if err != nil {
+		go this.Close()
+	}
+	return err
+}
+
+// forgets a stream both sides closed
+func (this *Session) release(stream *Stream) {
+	this.mutex.Lock()
+	delete(this.streams, stream.id)
+	if len(this.streams) == 0 {
+		this.idleSince = time.Now()
+	}
+	this.mutex.Unlock()
+}
+
+func (this *Session) IsClosed() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.closed
+}
+
+// closes the connection, open streams read EOF
+func (this *Session) Close() error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	streams := this.streams
+	this.streams = map[uint32]*Stream{}
+	close(this.done)
+	this.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.wake()
+	}
+	return this.conn.Close()
+}
+
+/* Stream
+ *
+ * One request in a session. It is a net.Conn, so requests are read and
+ * written the same way as on a connection of their own. Deadlines only
+ * apply to reads, writes are bounded by those of the session.
+ */
+type Stream struct {
+	session      *Session
+	id           uint32
+	mutex        sync.Mutex
+	cond         *sync.Cond
+	buffer       bytes.Buffer
+	deadline     time.Time
+	remoteClosed bool // the peer closed its side
+	localClosed  bool
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	stream := &Stream{session: session, id: id}
+	stream.cond = sync.NewCond(&stream.mutex)
+	return stream
+}
+
+// stores data of the peer, false if the peer sent too much
+func (this *Stream) deliver(data []byte) bool {
+	this.mutex.Lock()
+	if len(data) == 0 {
+		this.remoteClosed = true
+	} else if this.buffer.Len()+len(data) > MAX_STREAM_BUFFER {
+		this.mutex.Unlock()
+		return false
+	} else {
+		this.buffer.Write(data)
+	}
+	release := this.remoteClosed && this.localClosed
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+
+	if release {
+		this.session.release(this)
+	}
+	return true
+}
+
+func (this *Stream) wake() {
+	this.mutex.Lock()
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+}
+
+func (this *Stream) Read(b []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var timer *time.Timer
+	for this.buffer.Len() == 0 {
+		if this.remoteClosed || this.session.IsClosed() {
+			return 0, io.EOF
+		}
+		if !this.deadline.IsZero() {
+			wait := time.Until(this.deadline)
+			if wait <= 0 {
+				return 0, errors.New("read from stream timed out")
+			}
+			if timer == nil {
+				timer = time.AfterFunc(wait, this.wake)
+				defer timer.Stop()
+			}
+		}
+		this.cond.Wait()
+	}
+	return this.buffer.Read(b)
+}
+
+func (this *Stream) Write(b []byte) (int, error) {
+	this.mutex.Lock()
+	closed := this.localClosed
+	this.mutex.Unlock()
+	if closed {
+		return 0, errors.New("write to closed stream")
+	}
+	written := 0
+	for written < len(b) {
+		end := written + protocol.MAX_FRAME_DATA
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := this.session.writeFrame(this.id, b[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// ends our side of the request
+func (this *Stream) Close() error {
+	this.mutex.Lock()
+	if this.localClosed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.localClosed = true
+	release := this.remoteClosed
+	this.mutex.Unlock()
+
+	err := this.session.writeFrame(this.id, nil)
+	if release || err != nil {
+		this.session.release(this)
+	}
+	return err
+}
+
+func (this *Stream) LocalAddr() net.Addr {
+	return this.session.conn.LocalAddr()
+}
+
+func (this *Stream) RemoteAddr() net.Addr {
+	return this.session.conn.RemoteAddr()
+}
+
+func (this *Stream) SetDeadline(t time.Time) error {
+	return this.SetReadDeadline(t)
+}
+
+func (this *Stream) SetReadDeadline(t time.Time) error {
+	this.mutex.Lock()
+	this.deadline = t
+	this.mutex.Unlock()
+	return nil
+}
+
+func (this *Stream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// serves the session a client opened on conn after it authenticated, each
+// request is handled by handle. Returns once the session is closed.
+func ServeSession(conn OnionConnection, handle func(net.Conn)) {
+	session := newSession(conn, func(stream *Stream) {
+		defer stream.Close()
+		handle(stream)
+	})
+	session.serve()
+}
+
+// opens a session for our requests on conn, on which the peer accepted
+// SESSION
+func OpenSession(conn OnionConnection) *Session {
+	session := newSession(conn, nil)
+	go session.serve()
+	return session
+}
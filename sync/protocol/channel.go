@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"../../core/crypto/auth"
+)
+
+/* Secure Channel
+ *
+ * With FEATURE_SECURE, the client sends KEY_EXCHANGE right after it
+ * authenticated, or, if it does not authenticate, before it sends anything
+ * else. The server answers with its KEY_EXCHANGE, see auth.KeyExchange, and
+ * both sides encrypt everything after it. The server sends SUCCESS as its
+ * first encrypted packet, which proves that both derived the same keys.
+ *
+ * Every write is sent as a record, sealed with AES-256-GCM and the key of
+ * its direction. The nonce is the number of the record, so records cannot
+ * be dropped, replayed or reordered without the next one failing.
+ *
+ * 4 bytes              -- length of the sealed record
+ * <length> bytes       -- sealed record
+ */
+
+// largest plaintext of one record
+const MAX_RECORD_SIZE = 16384
+
+func EncodeKeyExchange(kx auth.KeyExchange) []byte {
+	return EncodePacket(KEY_EXCHANGE, JsonOrDie(kx))
+}
+
+func DecodeKeyExchange(payload []byte) (auth.KeyExchange, error) {
+	var kx auth.KeyExchange
+	err := json.Unmarshal(payload, &kx)
+	return kx, err
+}
+
+// a connection whose packets are encrypted with the keys of a key exchange
+type SecureConn struct {
+	net.Conn
+	send       cipher.AEAD
+	receive    cipher.AEAD
+	writeLock  sync.Mutex
+	sendSeq    uint64
+	readLock   sync.Mutex
+	receiveSeq uint64
+	plaintext  []byte // received but not read yet
+}
+
+// the channel of the initiator of the key exchange if initiator is set,
+// the one of the responder otherwise
+func NewSecureConn(conn net.Conn, keys auth.ChannelKeys, initiator bool) (*SecureConn, error) {
+	sendKey, receiveKey := keys.Initiator, keys.Responder
+	if !initiator {
+		sendKey, receiveKey = receiveKey, sendKey
+	}
+	send, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := newAEAD(receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureConn{Conn: conn, send: send, receive: receive}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func recordNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (this *SecureConn) Write(b []byte) (int, error) {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	written := 0
+	for written < len(b) {
+		end := written + MAX_RECORD_SIZE
+		if end > len(b) {
+			end = len(b)
+		}
+		record := make([]byte, 4, 4+end-written+this.send.Overhead())
+		record = this.send.Seal(record, recordNonce(this.send, this.sendSeq), b[written:end], nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+		this.sendSeq++
+		if _, err := this.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (this *SecureConn) Read(b []byte) (int, error) {
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+	if len(this.plaintext) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(this.Conn, length[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > uint32(MAX_RECORD_SIZE+this.receive.Overhead()) {
+			return 0, errors.New("record too long")
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(this.Conn, record); err != nil {
+			return 0, err
+		}
+		plaintext, err := this.receive.Open(record[:0], recordNonce(this.receive, this.receiveSeq), record, nil)
+		if err != nil {
+			return 0, errors.New("record failed authentication")
+		}
+		this.receiveSeq++
+		this.plaintext = plaintext
+	}
+	n := copy(b, this.plaintext)
+	this.plaintext = this.plaintext[n:]
+	return n, nil
+}
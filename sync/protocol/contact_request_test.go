@@ -0,0 +1,163 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package protocol
+
+import "testing"
+import "crypto/ed25519"
+import "time"
+import "../../core/crypto"
+
+func newTestIdentity(t *testing.T) (*crypto.Identity, string) {
+	key, err := crypto.GenerateEd25519Key()
+	if err != nil {
+		t.Fatalf("could not generate key: error: %s\n", err.Error())
+	}
+	return &crypto.Identity{Ed25519: key}, crypto.GetOnionAddressV3(key.Public().(ed25519.PublicKey))
+}
+
+// a request from A to B, signed by A
+func signedRequest(t *testing.T) (ContactRequest, *crypto.Identity, string) {
+	A, _ := newTestIdentity(t)
+	_, B_Onion := newTestIdentity(t)
+	cr := ContactRequest{Message: "hi, it is A"}
+	if err := cr.Sign(A, B_Onion); err != nil {
+		t.Fatalf("could not sign contact request: error: %s\n", err.Error())
+	}
+	return cr, A, B_Onion
+}
+
+func TestContactRequestSignature(t *testing.T) {
+	cr, _, B_Onion := signedRequest(t)
+	if err := cr.Verify([]string{"other.onion", B_Onion}, time.Now()); err != nil {
+		t.Fatalf("could not verify contact request: error: %s\n", err.Error())
+	}
+	if !cr.IsSigned() {
+		t.Fatalf("signed contact request is not signed\n")
+	}
+}
+
+func TestContactRequestWrongKey(t *testing.T) {
+	// C claims to be A
+	cr, _, B_Onion := signedRequest(t)
+	C, _ := newTestIdentity(t)
+	sig, pubKey, err := C.Sign(cr.SignedData())
+	if err != nil {
+		t.Fatalf("could not sign: error: %s\n", err.Error())
+	}
+	cr.Signature, cr.PubKey = sig, pubKey
+	if err := cr.Verify([]string{B_Onion}, time.Now()); err == nil {
+		t.Fatalf("contact request signed by another key was verified\n")
+	}
+}
+
+func TestContactRequestWrongRecipient(t *testing.T) {
+	cr, _, _ := signedRequest(t)
+	_, C_Onion := newTestIdentity(t)
+	if err := cr.Verify([]string{C_Onion}, time.Now()); err == nil {
+		t.Fatalf("contact request to another onion was verified\n")
+	}
+	// changing the recipient breaks the signature
+	cr.Recipient = C_Onion
+	if err := cr.Verify([]string{C_Onion}, time.Now()); err == nil {
+		t.Fatalf("contact request readdressed to another onion was verified\n")
+	}
+}
+
+func TestContactRequestExpired(t *testing.T) {
+	cr, _, B_Onion := signedRequest(t)
+	now := time.Now()
+	if err := cr.Verify([]string{B_Onion}, now.Add(CONTACT_REQUEST_MAX_AGE+time.Minute)); err == nil {
+		t.Fatalf("expired contact request was verified\n")
+	}
+	if err := cr.Verify([]string{B_Onion}, now.Add(-CONTACT_REQUEST_MAX_AGE-time.Minute)); err == nil {
+		t.Fatalf("contact request from the future was verified\n")
+	}
+}
+
+func TestContactRequestModified(t *testing.T) {
+	cr, _, B_Onion := signedRequest(t)
+	cr.Message = "hi, it is not A"
+	if err := cr.Verify([]string{B_Onion}, time.Now()); err == nil {
+		t.Fatalf("modified contact request was verified\n")
+	}
+}
+
+// an unsigned request with a fixed time, so its work does not change
+// between runs
+func unsignedRequest() ContactRequest {
+	return ContactRequest{Message: "hi", Onion: "sender.onion", Recipient: "recipient.onion", Timestamp: 1700000000}
+}
+
+func TestContactRequestWork(t *testing.T) {
+	for _, work := range []int{0, 1, 8, 12} {
+		cr := unsignedRequest()
+		cr.SolveWork(work)
+		if cr.Work() < work {
+			t.Fatalf("solved request has %d of %d bits of work\n", cr.Work(), work)
+		}
+		// the nonces before the solution are just below the threshold
+		solution := cr.Nonce
+		for cr.Nonce = 0; cr.Nonce < solution; cr.Nonce++ {
+			if cr.Work() >= work {
+				t.Fatalf("nonce %d has %d bits of work, but %d was solved for %d\n", cr.Nonce, cr.Work(), solution, work)
+			}
+		}
+	}
+}
+
+func TestContactRequestWorkTampered(t *testing.T) {
+	const work = 16
+	tamper := map[string]func(*ContactRequest){
+		"message":   func(cr *ContactRequest) { cr.Message = "ho" },
+		"onion":     func(cr *ContactRequest) { cr.Onion = "other.onion" },
+		"recipient": func(cr *ContactRequest) { cr.Recipient = "other.onion" },
+		"timestamp": func(cr *ContactRequest) { cr.Timestamp++ },
+	}
+	for field, change := range tamper {
+		cr := unsignedRequest()
+		cr.SolveWork(work)
+		change(&cr)
+		if cr.Work() >= work {
+			t.Fatalf("work still holds after changing the %s\n", field)
+		}
+	}
+}
+
+func TestContactRequestOnionTampered(t *testing.T) {
+	cr, _, B_Onion := signedRequest(t)
+	_, C_Onion := newTestIdentity(t)
+	cr.Onion = C_Onion
+	if err := cr.Verify([]string{B_Onion}, time.Now()); err == nil {
+		t.Fatalf("contact request with a changed onion was verified\n")
+	}
+}
@@ -34,12 +34,17 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package protocol
 
 import (
+	"../../core/crypto"
 	"../../core/crypto/auth"
 	"../../core/db"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/bits"
 	"net"
 	"time"
 )
@@ -54,18 +59,66 @@ import (
 type PacketType uint8
 
 const (
-	AUTH            PacketType = 'A'
-	PULL                       = 'P'
-	TRIGGER                    = 'T'
-	CHALLENGE                  = 'C'
-	RESPONSE                   = 'R'
-	PUSH_POST                  = 'Q'
-	SUCCESS                    = 'S'
-	CONTACT_REQUEST            = 'B'
-	PUSH_PROFILE               = 'U'
-	INVALID                    = 0
+	AUTH                 PacketType = 'A'
+	PULL                            = 'P'
+	TRIGGER                         = 'T'
+	CHALLENGE                       = 'C'
+	RESPONSE                        = 'R'
+	PUSH_POST                       = 'Q'
+	SUCCESS                         = 'S'
+	CONTACT_REQUEST                 = 'B'
+	PUSH_PROFILE                    = 'U'
+	HELLO                           = 'H'
+	AUTH_V3                         = 'V'
+	CHALLENGE_V3                    = 'W'
+	RESPONSE_V3                     = 'X'
+	PULL_BATCH                      = 'N'
+	PULL_END                        = 'E'
+	CONTACT_RESPONSE                = 'Y'
+	PUSH_MESSAGE                    = 'M'
+	PUSH_REACTION                   = 'L'
+	PUSH_REACTION_COUNTS            = 'G'
+	PUSH                            = 'O'
+	SESSION                         = 'J'
+	SESSION_FRAME                   = 'F'
+	KEEPALIVE                       = 'K'
+	KEY_EXCHANGE                    = 'D'
+	AUTH_MUTUAL                     = 'a'
+	CHALLENGE_MUTUAL                = 'c'
+	RESPONSE_MUTUAL                 = 'r'
+	INVALID                         = 0
 )
 
+/* Protocol Version
+ *
+ * A peer may open a connection with a HELLO packet carrying its protocol
+ * version and the features it supports. Peers which start with AUTH, PULL
+ * or CONTACT_REQUEST instead never sent a HELLO and are treated as version 0,
+ * they only get the original packet set.
+ */
+
+const PROTOCOL_VERSION uint16 = 1
+
+const (
+	FEATURE_ED25519    = "ed25519"    // AUTH_V3 for v3 onions
+	FEATURE_TOMBSTONES = "tombstones" // PUSH_POST carries deletions of posts
+	FEATURE_EDITS      = "edits"      // PUSH_POST carries revisions of edited posts
+	FEATURE_CURSOR     = "cursor"     // PULL_BATCH and PULL_END
+	FEATURE_PROFILE    = "profile"    // PULL_BATCH sends changed profile entries and their tombstones only
+	FEATURE_RESPONSE   = "response"   // CONTACT_RESPONSE
+	FEATURE_MESSAGES   = "messages"   // PULL_BATCH sends direct messages as PUSH_MESSAGE
+	FEATURE_REACTIONS  = "reactions"  // PULL_BATCH sends PUSH_REACTION and PUSH_REACTION_COUNTS
+	FEATURE_PUSH       = "push"       // PUSH instead of TRIGGER, needs FEATURE_CURSOR
+	FEATURE_SESSION    = "session"    // SESSION keeps an authenticated connection for several requests
+	FEATURE_SECURE     = "secure"     // KEY_EXCHANGE, everything after it is encrypted
+	FEATURE_MUTUAL     = "mutual"     // AUTH_MUTUAL instead of AUTH and AUTH_V3
+)
+
+// features we announce in our HELLO, only features both sides announce are used
+var SupportedFeatures = []string{FEATURE_ED25519, FEATURE_TOMBSTONES, FEATURE_EDITS, FEATURE_CURSOR, FEATURE_PROFILE,
+	FEATURE_RESPONSE, FEATURE_MESSAGES, FEATURE_REACTIONS, FEATURE_PUSH, FEATURE_SESSION, FEATURE_SECURE,
+	FEATURE_MUTUAL}
+
 const (
 	HEADER_SIZE          int = 5
 	MAX_PACKET_BYTE_SIZE     = 1024 // one Kilobyte
@@ -197,6 +250,93 @@ func DecodeResponse(payload []byte) (auth.Response, error) {
 	return response, err
 }
 
+/* Auth V3 Payload
+ *
+ * A node which moved from a v2 to a v3 onion sends the RSA key of its old
+ * onion (pkcs1) and its signature over crypto.MigrationStatement along, so
+ * contacts which only know the old onion can move it.
+ */
+
+type AuthV3 struct {
+	PubKey    []byte
+	LegacyKey []byte `json:",omitempty"`
+	LegacySig []byte `json:",omitempty"`
+}
+
+func EncodeAuthV3(authV3 AuthV3) []byte {
+	return EncodePacket(AUTH_V3, JsonOrDie(authV3))
+}
+
+func DecodeAuthV3(payload []byte) (AuthV3, error) {
+	var authV3 AuthV3
+	err := json.Unmarshal(payload, &authV3)
+	return authV3, err
+}
+
+func EncodeChallengeV3(challenge *auth.ChallengeV3) []byte {
+	return EncodePacket(CHALLENGE_V3, JsonOrDie(*challenge))
+}
+
+func DecodeChallengeV3(payload []byte) (auth.ChallengeV3, error) {
+	var challenge auth.ChallengeV3
+	err := json.Unmarshal(payload, &challenge)
+	return challenge, err
+}
+
+func EncodeResponseV3(response *auth.ResponseV3) []byte {
+	return EncodePacket(RESPONSE_V3, JsonOrDie(*response))
+}
+
+func DecodeResponseV3(payload []byte) (auth.ResponseV3, error) {
+	var response auth.ResponseV3
+	err := json.Unmarshal(payload, &response)
+	return response, err
+}
+
+/* Mutual Auth Payload
+ *
+ * With FEATURE_MUTUAL the client sends AUTH_MUTUAL, the server answers with
+ * CHALLENGE_MUTUAL and the client proves itself with RESPONSE_MUTUAL, see
+ * auth.MutualInit. Both sides sign HelloBinding of the connection. The
+ * legacy fields are those of AuthV3.
+ */
+
+type AuthMutual struct {
+	auth.MutualInit
+	LegacyKey []byte `json:",omitempty"`
+	LegacySig []byte `json:",omitempty"`
+}
+
+func EncodeAuthMutual(authMutual AuthMutual) []byte {
+	return EncodePacket(AUTH_MUTUAL, JsonOrDie(authMutual))
+}
+
+func DecodeAuthMutual(payload []byte) (AuthMutual, error) {
+	var authMutual AuthMutual
+	err := json.Unmarshal(payload, &authMutual)
+	return authMutual, err
+}
+
+func EncodeChallengeMutual(challenge auth.MutualChallenge) []byte {
+	return EncodePacket(CHALLENGE_MUTUAL, JsonOrDie(challenge))
+}
+
+func DecodeChallengeMutual(payload []byte) (auth.MutualChallenge, error) {
+	var challenge auth.MutualChallenge
+	err := json.Unmarshal(payload, &challenge)
+	return challenge, err
+}
+
+func EncodeResponseMutual(proof auth.MutualProof) []byte {
+	return EncodePacket(RESPONSE_MUTUAL, JsonOrDie(proof))
+}
+
+func DecodeResponseMutual(payload []byte) (auth.MutualProof, error) {
+	var proof auth.MutualProof
+	err := json.Unmarshal(payload, &proof)
+	return proof, err
+}
+
 /* Pull Payload */
 
 func EncodePull(timestamp int64) []byte {
@@ -209,6 +349,170 @@ func DecodePull(payload []byte) (int64, error) {
 	return timestamp, err
 }
 
+/* Pull Batch Payload
+ *
+ * PULL_BATCH asks for the items after a cursor the server handed out in an
+ * earlier PULL_END, the cursor is opaque to the client. Without a cursor the
+ * server starts after Since, the timestamp of the old PULL. The server
+ * answers with at most Limit PUSH_POSTs, the PUSH_PROFILEs of a changed
+ * profile and a PULL_END with the cursor after this batch. If More is set,
+ * the client may send the next PULL_BATCH on the same connection.
+ */
+
+const (
+	PULL_BATCH_SIZE     uint16 = 50
+	MAX_PULL_BATCH_SIZE uint16 = 200
+)
+
+type PullRequest struct {
+	Cursor string `json:",omitempty"`
+	Since  int64  `json:",omitempty"`
+	Limit  uint16
+}
+
+type PullEnd struct {
+	Cursor string
+	More   bool
+}
+
+func EncodePullRequest(req PullRequest) []byte {
+	return EncodePacket(PULL_BATCH, JsonOrDie(req))
+}
+
+func DecodePullRequest(payload []byte) (PullRequest, error) {
+	var req PullRequest
+	err := json.Unmarshal(payload, &req)
+	return req, err
+}
+
+func EncodePullEnd(end PullEnd) []byte {
+	return EncodePacket(PULL_END, JsonOrDie(end))
+}
+
+func DecodePullEnd(payload []byte) (PullEnd, error) {
+	var end PullEnd
+	err := json.Unmarshal(payload, &end)
+	return end, err
+}
+
+/* Push
+ *
+ * Instead of a TRIGGER, after which the peer connects back to PULL, an
+ * authenticated client may send PUSH. The roles are swapped on the same
+ * connection then: the peer sends PULL_BATCH with its cursor, the client
+ * answers like a server would, until the peer ends with SUCCESS.
+ */
+
+func EncodePush() []byte {
+	return EncodePacket(PUSH, []byte{})
+}
+
+/* Session
+ *
+ * An authenticated client may send SESSION, answered with SUCCESS, to keep
+ * the connection. From then on only SESSION_FRAMEs and KEEPALIVEs are sent.
+ * A frame carries the id of a request and a piece of its stream, the packets
+ * of the request as they would be sent on a connection of its own. The
+ * client numbers its requests, several may be open at the same time. A
+ * frame without data closes the stream of its sender. KEEPALIVEs are sent
+ * while there is nothing else to send, so that the read timeout only hits
+ * dead connections.
+ *
+ * 4 bytes              -- request id
+ * <payload len-4> bytes -- data
+ */
+
+const (
+	MAX_FRAME_DATA     int           = 65536
+	KEEPALIVE_INTERVAL time.Duration = TIMEOUT * time.Second / 3
+)
+
+func EncodeSession() []byte {
+	return EncodePacket(SESSION, []byte{})
+}
+
+func EncodeFrame(requestId uint32, data []byte) []byte {
+	payload := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(payload, requestId)
+	copy(payload[4:], data)
+	return EncodePacket(SESSION_FRAME, payload)
+}
+
+func DecodeFrame(payload []byte) (uint32, []byte, error) {
+	if len(payload) < 4 {
+		return 0, nil, errors.New("frame without request id")
+	}
+	if len(payload)-4 > MAX_FRAME_DATA {
+		return 0, nil, errors.New("frame too long")
+	}
+	return binary.BigEndian.Uint32(payload), payload[4:], nil
+}
+
+func EncodeKeepalive() []byte {
+	return EncodePacket(KEEPALIVE, []byte{})
+}
+
+/* Hello Payload */
+
+type Hello struct {
+	Version     uint16
+	Features    []string
+	ContactWork int `json:",omitempty"` // proof of work the server requires for contact requests
+}
+
+func OurHello() Hello {
+	return Hello{Version: PROTOCOL_VERSION, Features: SupportedFeatures}
+}
+
+func EncodeHello(hello Hello) []byte {
+	return EncodePacket(HELLO, JsonOrDie(hello))
+}
+
+func DecodeHello(payload []byte) (Hello, error) {
+	var hello Hello
+	err := json.Unmarshal(payload, &hello)
+	return hello, err
+}
+
+// what the authentication of a connection is bound to: the HELLO payloads
+// of the client and of the server, as they were sent
+func HelloBinding(client []byte, server []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("zwiebelnetz hello\n"))
+	binary.Write(hash, binary.BigEndian, uint32(len(client)))
+	hash.Write(client)
+	hash.Write(server)
+	return hash.Sum(nil)
+}
+
+// the version both sides speak is the lower one of the two
+func NegotiateVersion(ours uint16, theirs uint16) uint16 {
+	if theirs < ours {
+		return theirs
+	}
+	return ours
+}
+
+// returns the features which are in both lists
+func NegotiateFeatures(ours []string, theirs []string) []string {
+	features := []string{}
+	for _, feature := range ours {
+		if HasFeature(theirs, feature) {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+func HasFeature(features []string, feature string) bool {
+	for _, elm := range features {
+		if elm == feature {
+			return true
+		}
+	}
+	return false
+}
+
 /* Trigger Payload */
 
 func EncodeTrigger() []byte {
@@ -230,6 +534,20 @@ type PushPost struct {
 	Author      string
 	Hash        string
 	ParentHash  string
+	Signature   string // author's signature over db.Post.SignedData, base64
+	AuthorKey   string // author's public key the signature is checked with, base64
+
+	// tombstones: the post was deleted at PublishedAt, the message is not sent
+	Deleted         bool   `json:",omitempty"`
+	DeleteSignature string `json:",omitempty"` // author's signature over db.Post.DeletionData, base64
+
+	// edits: the hash is the one of revision 0, the signature covers the revision
+	Revision uint32 `json:",omitempty"`
+	EditedAt int64  `json:",omitempty"`
+
+	// reshares: the onions which reshared the post before the sender, the
+	// one nearest to the author first
+	Via []string `json:",omitempty"`
 }
 
 func EncodePushPost(post *db.Post) []byte {
@@ -240,7 +558,21 @@ func EncodePushPost(post *db.Post) []byte {
 		post.TTL,
 		post.Author.Onion,
 		post.Hash,
-		post.ParentHash}
+		post.ParentHash,
+		post.Signature,
+		post.AuthorKey,
+		false,
+		post.DeleteSignature,
+		post.Revision,
+		0,
+		post.Resharers()}
+	if post.Revision > 0 {
+		pullReply.EditedAt = post.EditedAt.Unix()
+	}
+	if post.IsDeleted() {
+		pullReply.Message = ""
+		pullReply.Deleted = true
+	}
 	json := JsonOrDie(pullReply)
 	return EncodePacket(PUSH_POST, json)
 }
@@ -256,17 +588,126 @@ func DecodePushPost(payload []byte, origin string) (db.Post, error) {
 	pub.PostedAt = time.Unix(pp.PostedAt, 0)
 	pub.RemotePublishedAt = time.Unix(pp.PublishedAt, 0)
 	pub.TTL = pp.TTL
-	pub.Originator = db.Onion{0, origin}
-	pub.Author = db.Onion{0, pp.Author}
+	pub.Originator = db.Onion{Onion: origin}
+	pub.Author = db.Onion{Onion: pp.Author}
 	pub.Hash = pp.Hash
 	pub.ParentHash = pp.ParentHash
+	pub.Signature = pp.Signature
+	pub.AuthorKey = pp.AuthorKey
+	pub.Revision = pp.Revision
+	if pp.ParentHash == "" && pp.Author != origin {
+		// reshared by the sender
+		pub.SetResharers(append(pp.Via, origin))
+	}
+	if pp.EditedAt != 0 {
+		pub.EditedAt = time.Unix(pp.EditedAt, 0)
+	}
+	if pp.Deleted {
+		pub.DeletedAt = time.Unix(pp.PublishedAt, 0)
+		pub.DeleteSignature = pp.DeleteSignature
+	}
 	return pub, err
 }
 
-/* Contact Request Payload */
+/* Contact Request Payload
+ *
+ * The sender proves that it owns Onion by signing the request with its key.
+ * The signature covers the recipient and the time, so it can neither be
+ * sent to someone else nor be replayed after CONTACT_REQUEST_MAX_AGE.
+ * Requests of peers from before signatures have no Signature.
+ */
 type ContactRequest struct {
-	Message string
-	Onion   string
+	Message   string
+	Onion     string
+	Recipient string `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+	PubKey    []byte `json:",omitempty"` // ed25519 or pkcs1
+	Signature []byte `json:",omitempty"`
+	Nonce     uint64 `json:",omitempty"` // proof of work, see SolveWork
+}
+
+const CONTACT_REQUEST_MAX_AGE = 24 * time.Hour
+
+// leading zero bits of the proof of work we put into our contact requests
+// and require by default
+const CONTACT_REQUEST_WORK = 20
+
+// the most proof of work we put into a contact request, a peer which
+// requires more is not asked
+const MAX_CONTACT_REQUEST_WORK = 28
+
+func (cr *ContactRequest) SignedData() []byte {
+	return []byte(fmt.Sprintf("zwiebelnetz contact request\n%s\n%s\n%d\n%s",
+		cr.Onion, cr.Recipient, cr.Timestamp, cr.Message))
+}
+
+// signs a contact request from id to recipient
+func (cr *ContactRequest) Sign(id *crypto.Identity, recipient string) error {
+	cr.Onion = id.Onion()
+	cr.Recipient = recipient
+	cr.Timestamp = time.Now().Unix()
+	sig, pubKey, err := id.Sign(cr.SignedData())
+	cr.Signature = sig
+	cr.PubKey = pubKey
+	return err
+}
+
+/* Contact Request Proof of Work
+ *
+ * Hashcash: the SHA-256 hash of the signed data and the nonce has to start
+ * with a number of zero bits. It binds the work to the sender, recipient
+ * and time, so each request to each recipient has to be paid for.
+ */
+
+func (cr *ContactRequest) workHash() [32]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("%s\n%d", cr.SignedData(), cr.Nonce)))
+}
+
+// the leading zero bits of the hash of the request
+func (cr *ContactRequest) Work() int {
+	hash := cr.workHash()
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// searches a nonce for which the request has the given work
+func (cr *ContactRequest) SolveWork(work int) {
+	for cr.Nonce = 0; cr.Work() < work; cr.Nonce++ {
+	}
+}
+
+func (cr *ContactRequest) IsSigned() bool {
+	return len(cr.Signature) > 0
+}
+
+// checks that the request is signed by the owner of its onion, addressed to
+// one of recipients and recent
+func (cr *ContactRequest) Verify(recipients []string, now time.Time) error {
+	return verifyStatement("contact request", cr.Onion, cr.Recipient, cr.Timestamp, cr.PubKey,
+		cr.SignedData(), cr.Signature, recipients, now)
+}
+
+// checks a statement of onion to recipient signed at timestamp
+func verifyStatement(kind string, onion string, recipient string, timestamp int64, pubKey []byte,
+	data []byte, sig []byte, recipients []string, now time.Time) error {
+	addressed := false
+	for _, r := range recipients {
+		addressed = addressed || (r != "" && r == recipient)
+	}
+	if !addressed {
+		return errors.New(kind + " is addressed to " + recipient)
+	}
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > CONTACT_REQUEST_MAX_AGE || age < -CONTACT_REQUEST_MAX_AGE {
+		return errors.New(kind + " is too old or from the future")
+	}
+	return crypto.VerifyOnionSignature(onion, pubKey, data, sig)
 }
 
 func EncodeContactRequest(cr ContactRequest) []byte {
@@ -279,11 +720,143 @@ func DecodeContactRequest(payload []byte) (ContactRequest, error) {
 	return cr, err
 }
 
+/* Contact Response Payload
+ *
+ * The answer to a contact request, signed like the request by the onion
+ * which answers. Only sent to peers with FEATURE_RESPONSE, the others learn
+ * about an accepted request on their next AUTH.
+ */
+type ContactResponse struct {
+	Decision  db.ContactDecision
+	Message   string
+	Onion     string
+	Recipient string
+	Timestamp int64
+	PubKey    []byte
+	Signature []byte
+}
+
+func (cr *ContactResponse) SignedData() []byte {
+	return []byte(fmt.Sprintf("zwiebelnetz contact response\n%s\n%s\n%d\n%d\n%s",
+		cr.Onion, cr.Recipient, cr.Timestamp, cr.Decision, cr.Message))
+}
+
+// signs a contact response from id to recipient
+func (cr *ContactResponse) Sign(id *crypto.Identity, recipient string) error {
+	cr.Onion = id.Onion()
+	cr.Recipient = recipient
+	cr.Timestamp = time.Now().Unix()
+	sig, pubKey, err := id.Sign(cr.SignedData())
+	cr.Signature = sig
+	cr.PubKey = pubKey
+	return err
+}
+
+func (cr *ContactResponse) Verify(recipients []string, now time.Time) error {
+	return verifyStatement("contact response", cr.Onion, cr.Recipient, cr.Timestamp, cr.PubKey,
+		cr.SignedData(), cr.Signature, recipients, now)
+}
+
+func EncodeContactResponse(cr ContactResponse) []byte {
+	return EncodePacket(CONTACT_RESPONSE, JsonOrDie(cr))
+}
+
+func DecodeContactResponse(payload []byte) (ContactResponse, error) {
+	var cr ContactResponse
+	err := json.Unmarshal(payload, &cr)
+	return cr, err
+}
+
+/* Direct Message Payload
+ *
+ * Only sent to the other party of the conversation after it authenticated,
+ * the sender is the onion it pulled from.
+ */
+type PushMessage struct {
+	Hash   string
+	Body   string
+	SentAt int64 // unix nanoseconds
+}
+
+func EncodePushMessage(msg *db.Message) []byte {
+	pm := PushMessage{
+		Hash:   msg.Hash,
+		Body:   msg.Body,
+		SentAt: msg.SentAt.UnixNano(),
+	}
+	return EncodePacket(PUSH_MESSAGE, JsonOrDie(pm))
+}
+
+func DecodePushMessage(payload []byte) (db.Message, error) {
+	var pm PushMessage
+	err := json.Unmarshal(payload, &pm)
+	msg := db.Message{
+		Hash:   pm.Hash,
+		Body:   pm.Body,
+		SentAt: time.Unix(0, pm.SentAt),
+	}
+	if err == nil && msg.Hash == "" {
+		err = errors.New("message without hash")
+	}
+	return msg, err
+}
+
+/* Reaction Payloads
+ *
+ * PUSH_REACTION carries a reaction to a post of the peer which pulls, it
+ * counts them. PUSH_REACTION_COUNTS carries the counts of a post of the peer
+ * which is pulled from.
+ */
+type PushReaction struct {
+	PostHash  string
+	Kind      string
+	ChangedAt int64 // unix nanoseconds
+	Deleted   bool  `json:",omitempty"` // the reaction was taken back
+}
+
+func EncodePushReaction(reaction *db.Reaction) []byte {
+	pr := PushReaction{
+		PostHash:  reaction.PostHash,
+		Kind:      reaction.Kind,
+		ChangedAt: reaction.ChangedAt.UnixNano(),
+		Deleted:   reaction.IsDeleted(),
+	}
+	return EncodePacket(PUSH_REACTION, JsonOrDie(pr))
+}
+
+func DecodePushReaction(payload []byte) (db.Reaction, error) {
+	var pr PushReaction
+	err := json.Unmarshal(payload, &pr)
+	reaction := db.Reaction{
+		PostHash:  pr.PostHash,
+		Kind:      pr.Kind,
+		ChangedAt: time.Unix(0, pr.ChangedAt),
+	}
+	if pr.Deleted {
+		reaction.DeletedAt = reaction.ChangedAt
+	}
+	if err == nil && !db.ValidReactionKind(reaction.Kind) {
+		err = errors.New("invalid reaction")
+	}
+	return reaction, err
+}
+
+func EncodePushReactionCounts(counts db.PostReactions) []byte {
+	return EncodePacket(PUSH_REACTION_COUNTS, JsonOrDie(counts))
+}
+
+func DecodePushReactionCounts(payload []byte) (db.PostReactions, error) {
+	var counts db.PostReactions
+	err := json.Unmarshal(payload, &counts)
+	return counts, err
+}
+
 /* Profile Payload */
 type PushProfile struct {
 	Key       string
 	Value     string
 	ChangedAt int64
+	Deleted   bool `json:",omitempty"` // tombstone of the entry with Key
 }
 
 func EncodePushProfile(prof *db.Profile) []byte {
@@ -291,6 +864,10 @@ func EncodePushProfile(prof *db.Profile) []byte {
 		Key:       prof.Key,
 		Value:     prof.Value,
 		ChangedAt: prof.ChangedAt.Unix(),
+		Deleted:   prof.IsDeleted(),
+	}
+	if pp.Deleted {
+		pp.Value = ""
 	}
 
 	json := JsonOrDie(pp)
@@ -307,6 +884,9 @@ func DecodePushProfile(payload []byte, onion string) (db.Profile, error) {
 		ChangedAt: time.Unix(pp.ChangedAt, 0),
 		Onion:     db.Onion{Id: 0, Onion: onion},
 	}
+	if pp.Deleted {
+		prof.DeletedAt = prof.ChangedAt
+	}
 
 	return prof, err
 }
@@ -0,0 +1,908 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"../../core/crypto"
+	"../../core/crypto/auth"
+	"../../core/db"
+	"../../core/ratelimit"
+	"../../logger"
+	"../peer"
+	"../protocol"
+)
+
+func containsState(states []protocol.PacketType, state protocol.PacketType) bool {
+	for _, elm := range states {
+		if elm == state {
+			return true
+		}
+	}
+	return false
+}
+
+// the pull requests a peer may send, PULL_BATCH only once it was negotiated
+func pullStates(features []string) []protocol.PacketType {
+	states := []protocol.PacketType{protocol.PULL}
+	if protocol.HasFeature(features, protocol.FEATURE_CURSOR) {
+		states = append(states, protocol.PULL_BATCH)
+	}
+	return states
+}
+
+// how a peer may authenticate after HELLO, only AUTH_MUTUAL once it was
+// negotiated
+func authStates(features []string) []protocol.PacketType {
+	if protocol.HasFeature(features, protocol.FEATURE_MUTUAL) {
+		return []protocol.PacketType{protocol.AUTH_MUTUAL}
+	}
+	states := []protocol.PacketType{protocol.AUTH}
+	if protocol.HasFeature(features, protocol.FEATURE_ED25519) {
+		states = append(states, protocol.AUTH_V3)
+	}
+	return states
+}
+
+// what a peer which did not authenticate may send after HELLO, besides
+// authenticating
+func anonymousStates(features []string) []protocol.PacketType {
+	states := append([]protocol.PacketType{protocol.CONTACT_REQUEST}, pullStates(features)...)
+	if protocol.HasFeature(features, protocol.FEATURE_RESPONSE) {
+		states = append(states, protocol.CONTACT_RESPONSE)
+	}
+	return states
+}
+
+// what an authenticated peer may send, SESSION only on a connection of its
+// own
+func authenticatedStates(features []string, connection bool) []protocol.PacketType {
+	states := append([]protocol.PacketType{protocol.TRIGGER}, pullStates(features)...)
+	if protocol.HasFeature(features, protocol.FEATURE_PUSH) && protocol.HasFeature(features, protocol.FEATURE_CURSOR) {
+		states = append(states, protocol.PUSH)
+	}
+	if connection && protocol.HasFeature(features, protocol.FEATURE_SESSION) {
+		states = append(states, protocol.SESSION)
+	}
+	return states
+}
+
+// what it takes to have a contact request stored, set before Serve. Only
+// requests which create or re-open a contact are charged.
+var ContactRequestLimits = struct {
+	Work     int                    // leading zero bits of the proof of work
+	Source   *ratelimit.RateLimiter // requests per onion, see UNSIGNED_SOURCE
+	Unsigned *ratelimit.RateLimiter // unsigned requests of everyone
+	Global   *ratelimit.RateLimiter // requests of everyone
+	MaxOpen  int                    // unanswered requests we keep
+}{
+	Work:     protocol.CONTACT_REQUEST_WORK,
+	Source:   ratelimit.NewRateLimiter(3, time.Hour),
+	Unsigned: ratelimit.NewRateLimiter(10, time.Hour),
+	Global:   ratelimit.NewRateLimiter(60, time.Hour),
+	MaxOpen:  100,
+}
+
+// prefixes the onion an unsigned request claims in the Source limit, so it
+// can not use up the budget of the owner of that onion
+const UNSIGNED_SOURCE = "unsigned "
+
+// charges a contact request from onion to ContactRequestLimits, false if
+// one of them is used up
+func allowContactRequest(onion string, verified bool, now time.Time) bool {
+	source := onion
+	if !verified {
+		source = UNSIGNED_SOURCE + onion
+	}
+	if !ContactRequestLimits.Source.Allow(source, now) {
+		logger.Security(fmt.Sprint("too many contact requests from ", source, ", dropped one"))
+		return false
+	}
+	if !verified && !ContactRequestLimits.Unsigned.Allow("", now) {
+		logger.Security("too many unsigned contact requests, dropped one")
+		return false
+	}
+	if !ContactRequestLimits.Global.Allow("", now) {
+		logger.Security("too many contact requests, dropped one")
+		return false
+	}
+	return true
+}
+
+// the nonces of AUTH_MUTUAL we answered recently
+var authReplays = auth.NewReplayCache()
+
+// a peer which authenticated before it opened a session, its requests are
+// handled on streams of the session
+type sessionPeer struct {
+	contact  *db.Contact
+	features []string
+	secure   bool // the session goes through the secure channel
+}
+
+// pulls from contacts in the background, one sync per contact at a time
+type Scheduler interface {
+	Trigger(contact *db.Contact) // a contact sent TRIGGER
+	Seen(contact *db.Contact)    // a contact pushed what we would have pulled
+}
+
+// the scheduler of the identity we serve, set before Serve. Without one,
+// TRIGGERs are answered but nothing is pulled.
+var Schedulers func(id *crypto.Identity) Scheduler
+
+// accepts the connections of peers on ln until it is closed
+func Serve(ln net.Listener, dbconn db.SSNDB, id *crypto.Identity) error {
+	for {
+		netconn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			logger.Warning(fmt.Sprint("could not accept connection: ", err))
+			continue
+		}
+		go HandleConnection(netconn, dbconn, id)
+	}
+}
+
+// handles the packets of a peer until it closes the connection
+func HandleConnection(netconn net.Conn, dbconn db.SSNDB, id *crypto.Identity) {
+	connectionHandling(netconn, dbconn, id, nil)
+}
+
+// handles the packets of a connection, or of a stream of session if it is
+// not nil
+func connectionHandling(netconn net.Conn, dbconn db.SSNDB, id *crypto.Identity, session *sessionPeer) {
+	//logger.Security(fmt.Sprint("net.Conn open :", netconn.RemoteAddr(), " on ", netconn.LocalAddr()))
+	defer netconn.Close()
+
+	var challengeR [32]byte
+	var authKey rsa.PublicKey
+	var challengeV3 auth.ChallengeV3
+	var authV3 protocol.AuthV3
+	var authMutual protocol.AuthMutual
+	var challengeMutual auth.MutualChallenge
+	var binding []byte         // protocol.HelloBinding of the connection
+	var migrating bool = false // the peer authenticates with the proof of its old onion
+	var contact *db.Contact = nil
+	var peerOnion string // the onion the peer authenticated as
+	var selfOnion string // the onion we answered the authentication as
+	var secure bool = false
+	head := make([]byte, protocol.HEADER_SIZE)
+	buffer := make([]byte, 4096) // max length
+
+	// peers which do not start with HELLO speak version 0 without features
+	var peerVersion uint16 = 0
+	var features []string = []string{}
+
+	nextPossibleStates := []protocol.PacketType{
+		protocol.HELLO,
+		protocol.AUTH,
+		protocol.PULL,
+		protocol.CONTACT_REQUEST}
+
+	if session != nil {
+		// we may have declined the contact since it opened the session
+		contact = dbconn.GetFriendlyContactByOnion(session.contact.Onion.Onion)
+		if contact == nil {
+			return
+		}
+		features = session.features
+		secure = session.secure
+		nextPossibleStates = authenticatedStates(features, false)
+	}
+
+	for {
+
+		err := protocol.ReadPayload(netconn, head)
+		if logger.ConditionalWarning(err, "could not read header from socket") {
+			return
+		}
+
+		header := protocol.DecodeHeader(head)
+		//logger.Info(fmt.Sprintf("Header(%c, %d)", header.PacketType, header.PacketLength))
+
+		// protection for memory exhaustion attacks
+		// increase maximum if connection authorized
+		if 4096 < header.PacketLength {
+			logger.Warning("corrupted network package (got more than 4096 bytes)")
+			return
+		}
+
+		payload := buffer[0:header.PacketLength]
+		if 0 < header.PacketLength { // if there is something to read
+			err = protocol.ReadPayload(netconn, payload)
+			if logger.ConditionalWarning(err, "could not read payload from socket") {
+				return
+			}
+		}
+
+		switch header.PacketType {
+		case protocol.HELLO:
+
+			if !containsState(nextPossibleStates, protocol.HELLO) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			hello, err := protocol.DecodeHello(payload)
+			if logger.ConditionalWarning(err, "could not decode hello") {
+				return
+			}
+
+			// always answer, so the peer learns which version we speak and
+			// the work its contact requests need
+			ours := protocol.OurHello()
+			ours.ContactWork = ContactRequestLimits.Work
+			err = protocol.WritePacket(netconn, protocol.EncodeHello(ours))
+			if logger.ConditionalWarning(err, "sending hello packet failed!") {
+				return
+			}
+
+			peerVersion = protocol.NegotiateVersion(protocol.PROTOCOL_VERSION, hello.Version)
+			features = protocol.NegotiateFeatures(protocol.SupportedFeatures, hello.Features)
+			logger.Debug(fmt.Sprint("HELLO version ", peerVersion, " features ", features))
+			binding = protocol.HelloBinding(payload, protocol.JsonOrDie(ours))
+
+			if protocol.HasFeature(features, protocol.FEATURE_SECURE) {
+				// no content before the secure channel
+				nextPossibleStates = append(authStates(features), protocol.KEY_EXCHANGE)
+			} else {
+				nextPossibleStates = append(authStates(features), anonymousStates(features)...)
+			}
+
+		case protocol.AUTH:
+
+			if !containsState(nextPossibleStates, protocol.AUTH) {
+				logger.Warning("impossible protocol state condition")
+				return
+			}
+
+			if id.RSA == nil {
+				logger.Warning("got a v2 AUTH, but we have no RSA key")
+				return
+			}
+
+			pubKey, err := protocol.DecodeAuth(payload)
+			if logger.ConditionalWarning(err, "could not decode public key blob") {
+				return
+			}
+
+			onionstr := crypto.GetOnionAddress(&pubKey)
+
+			contact = dbconn.GetFriendlyContactByOnion(onionstr)
+			if contact == nil {
+				return
+			}
+
+			authKey = pubKey
+
+			var challenge auth.Challenge
+			challenge, challengeR, err = auth.GenerateChallenge(&pubKey, &id.RSA.PublicKey)
+			if logger.ConditionalWarning(err, "could not generate a challenge") {
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeChallenge(&challenge))
+			if logger.ConditionalWarning(err, "sending challenge packet failed!") {
+				return
+			}
+
+			nextPossibleStates = []protocol.PacketType{protocol.RESPONSE}
+
+		case protocol.AUTH_V3:
+
+			if !containsState(nextPossibleStates, protocol.AUTH_V3) {
+				logger.Warning("impossible protocol state condition")
+				return
+			}
+
+			if id.Ed25519 == nil {
+				logger.Warning("got a v3 AUTH, but we have no ed25519 key")
+				return
+			}
+
+			authV3, err = protocol.DecodeAuthV3(payload)
+			if logger.ConditionalWarning(err, "could not decode public key blob") {
+				return
+			}
+			if len(authV3.PubKey) != ed25519.PublicKeySize {
+				logger.Warning("invalid ed25519 public key")
+				return
+			}
+
+			onionstr := crypto.GetOnionAddressV3(authV3.PubKey)
+
+			contact = dbconn.GetFriendlyContactByOnion(onionstr)
+			if contact == nil && len(authV3.LegacyKey) > 0 {
+				// a contact we only know by its v2 onion, it is moved once
+				// it proved that it owns the new key
+				legacyKey, err := crypto.UnmarshalPKCS1PublicKey(authV3.LegacyKey)
+				if logger.ConditionalWarning(err, "could not decode legacy key") {
+					return
+				}
+				contact = dbconn.GetFriendlyContactByOnion(crypto.GetOnionAddress(&legacyKey))
+				migrating = true
+			}
+			if contact == nil {
+				return
+			}
+
+			challengeV3, err = auth.GenerateChallengeV3(id.Ed25519.Public().(ed25519.PublicKey))
+			if logger.ConditionalWarning(err, "could not generate a challenge") {
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeChallengeV3(&challengeV3))
+			if logger.ConditionalWarning(err, "sending challenge packet failed!") {
+				return
+			}
+
+			nextPossibleStates = []protocol.PacketType{protocol.RESPONSE_V3}
+
+		case protocol.AUTH_MUTUAL:
+
+			if !containsState(nextPossibleStates, protocol.AUTH_MUTUAL) {
+				logger.Warning("impossible protocol state condition")
+				return
+			}
+
+			authMutual, err = protocol.DecodeAuthMutual(payload)
+			if logger.ConditionalWarning(err, "could not decode mutual auth") {
+				return
+			}
+
+			contact = dbconn.GetFriendlyContactByOnion(authMutual.Initiator)
+			if contact == nil && len(authMutual.LegacyKey) > 0 && crypto.OnionVersion(authMutual.Initiator) == 3 {
+				// as with AUTH_V3, moved once the peer proved its new key
+				legacyKey, err := crypto.UnmarshalPKCS1PublicKey(authMutual.LegacyKey)
+				if logger.ConditionalWarning(err, "could not decode legacy key") {
+					return
+				}
+				contact = dbconn.GetFriendlyContactByOnion(crypto.GetOnionAddress(&legacyKey))
+				migrating = true
+			}
+			if contact == nil {
+				return
+			}
+
+			challengeMutual, err = auth.RespondMutualAuth(id, binding, authMutual.MutualInit, authReplays)
+			if err != nil {
+				logger.Security(fmt.Sprintf("refused mutual auth of %s: %s", authMutual.Initiator, err))
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeChallengeMutual(challengeMutual))
+			if logger.ConditionalWarning(err, "sending challenge packet failed!") {
+				return
+			}
+
+			nextPossibleStates = []protocol.PacketType{protocol.RESPONSE_MUTUAL}
+
+		case protocol.PULL:
+
+			if !containsState(nextPossibleStates, protocol.PULL) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			timestamp, err := protocol.DecodePull(payload)
+			if logger.ConditionalWarning(err, "could not decode timestamp") {
+				return
+			}
+			/*
+				if contact == nil {
+					logger.Debug(fmt.Sprint("GET PULL REQUEST (unknown person) timestamp ", timestamp))
+				} else {
+					logger.Debug(fmt.Sprint("GET PULL REQUEST (", contact.Alias, ") timestamp ", timestamp))
+				} */
+
+			posts := dbconn.GetPosts(contact, timestamp)
+			profiles := dbconn.GetProfiles(contact, timestamp)
+			if protocol.HasFeature(features, protocol.FEATURE_TOMBSTONES) {
+				// peers without tombstones would store them as empty posts
+				posts.PushBackList(dbconn.GetTombstones(contact, timestamp))
+			}
+
+			if contact == nil {
+				logger.Debug(fmt.Sprint("SEND(", posts.Len(), " POSTS, ", profiles.Len(), " PROFILES) to (unknown person)"))
+			} else {
+				logger.Debug(fmt.Sprint("SEND(", posts.Len(), " POSTS, ", profiles.Len(), " PROFILES) to ", contact.Alias))
+			}
+
+			// reply posts
+			for itr := posts.Front(); itr != nil; itr = itr.Next() {
+				if peer.WritePost(netconn, &dbconn, itr.Value.(*db.Post), features) != nil {
+					return
+				}
+			}
+			// reply profile items
+			if peer.WriteProfiles(netconn, profiles) != nil {
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if err != nil {
+				logger.Warning(fmt.Sprint(err, " sending success packet failed!"))
+			}
+
+			//logger.Debug("DONE!")
+
+			return // no next possible states
+
+		case protocol.PULL_BATCH:
+
+			if !containsState(nextPossibleStates, protocol.PULL_BATCH) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			req, err := protocol.DecodePullRequest(payload)
+			if logger.ConditionalWarning(err, "could not decode pull request") {
+				return
+			}
+
+			more, err := peer.SendBatch(netconn, &dbconn, contact, req, features)
+			if logger.ConditionalWarning(err, "could not send batch") {
+				return
+			}
+
+			if !more {
+				return
+			}
+			nextPossibleStates = []protocol.PacketType{protocol.PULL_BATCH}
+
+		case protocol.PUSH:
+
+			if !containsState(nextPossibleStates, protocol.PUSH) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			// what we would have pulled after a TRIGGER, on this connection
+			if Schedulers != nil {
+				Schedulers(id).Seen(contact)
+			}
+			conn := peer.NewOnionConnection(netconn, contact.Onion.Onion, features)
+			conn.Encrypted = secure
+			err = peer.ReceivePush(conn, &dbconn, contact)
+			logger.ConditionalWarning(err, "could not receive push")
+
+			return
+
+		case protocol.SESSION:
+
+			if !containsState(nextPossibleStates, protocol.SESSION) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if logger.ConditionalWarning(err, "sending success packet failed!") {
+				return
+			}
+
+			// the connection carries the requests of contact from now on
+			session := &sessionPeer{contact: contact, features: features, secure: secure}
+			peer.ServeSession(peer.NewOnionConnection(netconn, contact.Onion.Onion, features),
+				func(stream net.Conn) {
+					connectionHandling(stream, dbconn, id, session)
+				})
+
+			return
+
+		case protocol.TRIGGER:
+
+			if !containsState(nextPossibleStates, protocol.TRIGGER) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			err := protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if err != nil {
+				logger.Warning(fmt.Sprint(err, " sending success packet failed!"))
+			}
+
+			// pulls in the background, one sync per contact at a time
+			if contact != nil && Schedulers != nil {
+				Schedulers(id).Trigger(contact)
+			}
+
+			//logger.Debug("DONE!")
+
+			return
+
+		case protocol.CHALLENGE, protocol.CHALLENGE_V3:
+
+			//logger.Debug("CHALLENGE")
+			logger.Security("impossible protocol state condition")
+			return
+
+		case protocol.RESPONSE:
+
+			//logger.Debug("RESPONSE")
+			if !containsState(nextPossibleStates, protocol.RESPONSE) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			response, err := protocol.DecodeResponse(payload)
+			if logger.ConditionalWarning(err, "could not decode response") {
+				return
+			}
+
+			if response.R != challengeR {
+				logger.Security(fmt.Sprintf("invalid response from %s", contact.Onion.Onion))
+				return
+			}
+
+			// the peer proved it owns authKey, it has to be the pinned one
+			if dbconn.PinPublicKey(contact.Onion.Onion, crypto.MarshalPKCS1PublicKey(&authKey)) != nil {
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if err != nil {
+				logger.Warning(fmt.Sprint(err, " sending success packet failed!"))
+			}
+			//logger.Security(fmt.Sprintf("contact successful AUTH [%s]", contact.Onion.Onion))
+
+			peerOnion = crypto.GetOnionAddress(&authKey)
+			selfOnion = crypto.GetOnionAddress(&id.RSA.PublicKey)
+			nextPossibleStates = authenticatedStates(features, true)
+			if protocol.HasFeature(features, protocol.FEATURE_SECURE) {
+				nextPossibleStates = []protocol.PacketType{protocol.KEY_EXCHANGE}
+			}
+
+		case protocol.RESPONSE_V3:
+
+			if !containsState(nextPossibleStates, protocol.RESPONSE_V3) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			response, err := protocol.DecodeResponseV3(payload)
+			if logger.ConditionalWarning(err, "could not decode response") {
+				return
+			}
+
+			if !auth.VerifyResponseV3(challengeV3, response, authV3.PubKey) {
+				logger.Security(fmt.Sprintf("invalid response from %s", contact.Onion.Onion))
+				return
+			}
+
+			onionstr := crypto.GetOnionAddressV3(authV3.PubKey)
+			if migrating {
+				contact.Onion, err = dbconn.MigrateLegacyOnion(onionstr, authV3.LegacyKey, authV3.LegacySig)
+				if logger.ConditionalWarning(err, "could not move contact to its v3 onion") {
+					return
+				}
+			}
+
+			// the peer proved it owns the key of its v3 onion, pin it
+			if dbconn.PinPublicKey(contact.Onion.Onion, authV3.PubKey) != nil {
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if err != nil {
+				logger.Warning(fmt.Sprint(err, " sending success packet failed!"))
+			}
+
+			peerOnion = onionstr
+			selfOnion = crypto.GetOnionAddressV3(id.Ed25519.Public().(ed25519.PublicKey))
+			nextPossibleStates = authenticatedStates(features, true)
+			if protocol.HasFeature(features, protocol.FEATURE_SECURE) {
+				nextPossibleStates = []protocol.PacketType{protocol.KEY_EXCHANGE}
+			}
+
+		case protocol.RESPONSE_MUTUAL:
+
+			if !containsState(nextPossibleStates, protocol.RESPONSE_MUTUAL) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			proof, err := protocol.DecodeResponseMutual(payload)
+			if logger.ConditionalWarning(err, "could not decode response") {
+				return
+			}
+
+			err = auth.VerifyMutualAuth(binding, authMutual.MutualInit, challengeMutual, proof)
+			if err != nil {
+				logger.Security(fmt.Sprintf("invalid response from %s: %s", authMutual.Initiator, err))
+				return
+			}
+
+			if migrating {
+				contact.Onion, err = dbconn.MigrateLegacyOnion(authMutual.Initiator, authMutual.LegacyKey, authMutual.LegacySig)
+				if logger.ConditionalWarning(err, "could not move contact to its v3 onion") {
+					return
+				}
+			}
+
+			if dbconn.PinPublicKey(contact.Onion.Onion, proof.PubKey) != nil {
+				return
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if err != nil {
+				logger.Warning(fmt.Sprint(err, " sending success packet failed!"))
+			}
+
+			peerOnion = authMutual.Initiator
+			selfOnion = authMutual.Responder
+			nextPossibleStates = authenticatedStates(features, true)
+			if protocol.HasFeature(features, protocol.FEATURE_SECURE) {
+				nextPossibleStates = []protocol.PacketType{protocol.KEY_EXCHANGE}
+			}
+
+		case protocol.KEY_EXCHANGE:
+
+			if !containsState(nextPossibleStates, protocol.KEY_EXCHANGE) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			initiation, err := protocol.DecodeKeyExchange(payload)
+			if logger.ConditionalWarning(err, "could not decode key exchange") {
+				return
+			}
+			if peerOnion != "" && initiation.Responder != selfOnion {
+				logger.Security(fmt.Sprintf("%s authenticated to %s, but exchanges keys with %s",
+					peerOnion, selfOnion, initiation.Responder))
+				return
+			}
+
+			response, keys, err := auth.RespondKeyExchange(id, peerOnion, initiation.Responder, initiation)
+			if err != nil {
+				logger.Security(fmt.Sprintf("key exchange with %s failed: %s", peerOnion, err))
+				return
+			}
+			err = protocol.WritePacket(netconn, protocol.EncodeKeyExchange(response))
+			if logger.ConditionalWarning(err, "sending key exchange packet failed!") {
+				return
+			}
+
+			// everything from here on is encrypted
+			netconn, err = protocol.NewSecureConn(netconn, keys, false)
+			if logger.ConditionalWarning(err, "could not set up the secure channel") {
+				return
+			}
+			secure = true
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if logger.ConditionalWarning(err, "sending success packet failed!") {
+				return
+			}
+
+			if contact != nil {
+				nextPossibleStates = authenticatedStates(features, true)
+			} else {
+				nextPossibleStates = anonymousStates(features)
+			}
+
+		case protocol.PUSH_POST:
+
+			logger.Debug("PUSH_POST")
+			logger.Security("impossible protocol state condition")
+			return
+
+		case protocol.SUCCESS:
+
+			logger.Debug("SUCCESS")
+			logger.Security("impossible protocol state condition")
+			return
+
+		case protocol.CONTACT_REQUEST:
+
+			if !containsState(nextPossibleStates, protocol.CONTACT_REQUEST) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			contactReq, err := protocol.DecodeContactRequest(payload)
+			if logger.ConditionalWarning(err, "could not decode contact request") {
+				return
+			}
+
+			if work := contactReq.Work(); work < ContactRequestLimits.Work {
+				logger.Security(fmt.Sprint("contact request claiming to be from ", contactReq.Onion,
+					" without enough proof of work (", work, " of ", ContactRequestLimits.Work, " bits), dropped"))
+				return
+			}
+
+			// only requests signed by the owner of the onion may change a
+			// contact, unsigned ones (from peers before signatures) can
+			// only create new ones
+			verified := false
+			if contactReq.IsSigned() {
+				self := dbconn.GetSelfOnion()
+				err = contactReq.Verify([]string{self.Onion, self.LegacyOnion}, time.Now())
+				if err != nil {
+					logger.Security(fmt.Sprint("contact request claiming to be from ", contactReq.Onion, " is invalid: ", err))
+					return
+				}
+				verified = true
+			}
+
+			contact = dbconn.GetContactByOnion(contactReq.Onion)
+
+			// charged only now, requests without work or with a forged
+			// signature use up nobody's budget. Neither do the ones resent
+			// for contacts which exist already.
+			reopen := contact != nil && verified && (contact.Status == db.DECLINED || contact.Status == db.EXPIRED)
+			if (contact == nil || reopen) && !allowContactRequest(contactReq.Onion, verified, time.Now()) {
+				return
+			}
+
+			if contact != nil { // contact exists already
+
+				if !verified {
+					logger.Security(fmt.Sprint("unauthenticated contact request for existing contact ", contactReq.Onion, ", ignored"))
+				} else if dbconn.PinPublicKey(contactReq.Onion, contactReq.PubKey) != nil {
+					logger.Security(fmt.Sprint("contact request from ", contactReq.Onion, " with a key which differs from the pinned one, ignored"))
+				} else if contact.Status == db.PENDING {
+					dbconn.SetContactToSuccess(contact)
+				} else if contact.Status == db.DECLINED || contact.Status == db.EXPIRED {
+					// asks again after a declined or unanswered request
+					if open := dbconn.CountOpenContacts(); ContactRequestLimits.MaxOpen > 0 && open >= ContactRequestLimits.MaxOpen {
+						logger.Security(fmt.Sprint(open, " unanswered contact requests, dropped the one from ", contactReq.Onion))
+						return
+					}
+					contact.Status = db.OPEN
+					contact.RequestMessage = contactReq.Message
+					contact.RequestVerified = true
+					contact.Response = db.NO_DECISION
+					contact.ResponseMessage = ""
+					dbconn.Save(contact)
+				} else {
+					logger.Debug("contact exists already, doing nothing")
+				}
+
+			} else {
+
+				if open := dbconn.CountOpenContacts(); ContactRequestLimits.MaxOpen > 0 && open >= ContactRequestLimits.MaxOpen {
+					logger.Security(fmt.Sprint(open, " unanswered contact requests, dropped the one from ", contactReq.Onion))
+					return
+				}
+
+				if contact == nil {
+					contact = new(db.Contact)
+				}
+
+				contact.Status = db.OPEN
+				contact.RequestMessage = contactReq.Message
+				contact.RequestVerified = verified
+				contact.Onion = dbconn.GetOnion(contactReq.Onion)
+				contact.Alias = contactReq.Onion
+
+				if contact.Onion.Id == 0 {
+					logger.Debug("creating new contact and onion")
+					contact.Onion = db.Onion{Onion: contactReq.Onion, Version: uint8(crypto.OnionVersion(contactReq.Onion))}
+					dbconn.Create(contact)
+				} else {
+					logger.Debug("onion exists already, creating new contact")
+					dbconn.Create(contact)
+				}
+				if verified {
+					dbconn.PinPublicKey(contactReq.Onion, contactReq.PubKey)
+				}
+			}
+
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if err != nil {
+				logger.Warning(fmt.Sprint(err, " sending success packet failed!"))
+			}
+
+			var p db.Pending
+			dbconn.Find(&p, 1)
+			p.Contacts = true
+			dbconn.Save(&p)
+
+			return
+
+		case protocol.CONTACT_RESPONSE:
+
+			if !containsState(nextPossibleStates, protocol.CONTACT_RESPONSE) {
+				logger.Security("impossible protocol state condition")
+				return
+			}
+
+			response, err := protocol.DecodeContactResponse(payload)
+			if logger.ConditionalWarning(err, "could not decode contact response") {
+				return
+			}
+
+			self := dbconn.GetSelfOnion()
+			err = response.Verify([]string{self.Onion, self.LegacyOnion}, time.Now())
+			if err != nil {
+				logger.Security(fmt.Sprint("contact response claiming to be from ", response.Onion, " is invalid: ", err))
+				return
+			}
+
+			contact = dbconn.GetContactByOnion(response.Onion)
+			if contact == nil || (contact.Status != db.PENDING && contact.Status != db.EXPIRED) {
+				logger.Security(fmt.Sprint("contact response from ", response.Onion, " which we did not ask"))
+				return
+			}
+			if dbconn.PinPublicKey(response.Onion, response.PubKey) != nil {
+				logger.Security(fmt.Sprint("contact response from ", response.Onion, " with a key which differs from the pinned one, ignored"))
+				return
+			}
+
+			switch response.Decision {
+			case db.ACCEPTED:
+				dbconn.SetContactToSuccess(contact)
+			case db.DECLINED_REQUEST, db.BLOCKED_REQUEST:
+				logger.Info(fmt.Sprint(contact.Alias, " declined our contact request"))
+				contact.Status = db.DECLINED
+			default:
+				logger.Warning(fmt.Sprint("unknown decision ", response.Decision, " in contact response"))
+				return
+			}
+			contact.ResponseMessage = response.Message
+			dbconn.Save(contact)
+
+			err = protocol.WritePacket(netconn, protocol.EncodeSuccess())
+			if err != nil {
+				logger.Warning(fmt.Sprint(err, " sending success packet failed!"))
+			}
+
+			var p db.Pending
+			dbconn.Find(&p, 1)
+			p.Contacts = true
+			dbconn.Save(&p)
+
+			return
+
+		case protocol.INVALID:
+
+			logger.Debug("INVALID")
+			logger.Security("corrupted network package")
+			return
+
+		default:
+
+			logger.Security("undefined network package")
+			return
+
+		}
+	}
+}
@@ -34,10 +34,13 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -45,6 +48,7 @@ import (
 	"../core/crypto"
 	"../core/db"
 	"../logger"
+	"../sync/peer"
 	"../sync/protocol"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -55,7 +59,7 @@ func main() {
 	logmode := flag.Bool("log", false, "enable log mode")
 	command := flag.String("cmd", "", "the command to execute")
 	onion := flag.String("onion", "", "the onion address to connect to")
-	keyfile := flag.String("key", "", "the path to the rsa private key")
+	keyfile := flag.String("key", "", "the path to the private key (or key directory for gen-v3-key, migrate-v3)")
 	nickname := flag.String("nickname", "", "the nickname for the contact")
 	password := flag.String("password", "", "your password")
 	circname := flag.String("circname", "", "the name of one or more circles, separated by comma")
@@ -67,12 +71,15 @@ func main() {
 	key := flag.String("prof_key", "", "Profile Key")
 	value := flag.String("prof_value", "", "Profile Value")
 
+	tor := client.NewTorTransport()
+	client.TorFlags(tor)
 	flag.Parse()
+	client.DefaultTransport = tor
 
 	logger.AssertError(len(*command) > 0, "please provide a command argument")
 
 	var dbconn db.SSNDB
-	var conn client.OnionConnection
+	var conn peer.OnionConnection
 	var err error
 
 	dbconn.Init()
@@ -134,7 +141,7 @@ func main() {
 				dbconn.Create(&contact)
 			} else {
 				fmt.Printf("creating new contact and onion\n")
-				contact.Onion = db.Onion{0, *onion}
+				contact.Onion = db.Onion{Onion: *onion, Version: uint8(crypto.OnionVersion(*onion))}
 				dbconn.Create(&contact)
 			}
 
@@ -147,7 +154,12 @@ func main() {
 				Onion:   dbconn.GetSelfOnion().Onion,
 				Message: *post,
 			}
-			err := conn.ContactRequest(cr)
+			err := cr.Sign(dbconn.GetIdentity(), *onion)
+			logger.ConditionalError(err, "could not sign contact request")
+			work, err := conn.ContactRequestWork()
+			logger.ConditionalError(err, "could not send contact request")
+			cr.SolveWork(work)
+			err = conn.ContactRequest(cr)
 			if err != nil {
 				logger.Info(fmt.Sprint("Failed to send contact request: ", err))
 			}
@@ -158,20 +170,21 @@ func main() {
 			logger.AssertError(len(*password) > 0, "please provide your nick name")
 			logger.AssertError(len(*keyfile) > 0, "please the path to the key for initialization")
 
-			// Read key
-			var pemKeyBuf [2048]byte
-			file, err := os.Open(*keyfile)
-			logger.ConditionalError(err, "could not open key file")
-			n, err := file.Read(pemKeyBuf[:])
+			// Read key, either the RSA key of a v2 onion or our ed25519 key
+			pemKey, err := ioutil.ReadFile(*keyfile)
 			logger.ConditionalError(err, "could not read from key file")
-			file.Close()
+			identity, err := crypto.ParseIdentity(pemKey)
+			logger.ConditionalError(err, "could not parse key file")
+			logger.AssertError(identity.Onion() == *onion, "the key does not belong to the onion address")
 
 			// Frontend User
 			myOnion := db.Onion{Onion: *onion}
 			dbconn.FirstOrCreate(&myOnion, myOnion)
+			myOnion.Version = uint8(crypto.OnionVersion(*onion))
+			dbconn.Save(&myOnion)
 			user := db.User{Username: *nickname, Onion: myOnion}
 			user.SetPassword(*password)
-			user.PemKey = string(pemKeyBuf[0:n])
+			user.PemKey = string(pemKey)
 			dbconn.Save(&user)
 			myContact := db.Contact{}
 			dbconn.Where(db.Contact{OnionId: myOnion.Id}).Attrs(db.Contact{Nickname: *nickname}).FirstOrCreate(&myContact)
@@ -194,6 +207,7 @@ func main() {
 				fmt.Printf("  Origin:     %s\n", post.Originator.Onion)
 				fmt.Printf("  Timestamp:  %s\n", post.PostedAt)
 				fmt.Printf("  Hash:       %s\n", post.Hash)
+				fmt.Printf("  Verified:   %t\n", post.Verified)
 				fmt.Printf("  ParentId:   %d\n", post.ParentId)
 				fmt.Printf("  Circles: ")
 				for _, c := range circs {
@@ -217,6 +231,7 @@ func main() {
 				fmt.Printf("  Origin:     %s\n", post.Originator.Onion)
 				fmt.Printf("  Timestamp:  %s\n", post.PostedAt)
 				fmt.Printf("  Hash:       %s\n", post.Hash)
+				fmt.Printf("  Verified:   %t\n", post.Verified)
 				fmt.Printf("  ParentId:   %d\n", post.ParentId)
 				fmt.Printf("  Circles: ")
 				for _, c := range circs {
@@ -233,7 +248,9 @@ func main() {
 			post := db.Post{
 				Message:      *post,
 				TTL:          99,
+				Author:       selfonion,
 				AuthorId:     selfonion.Id,
+				Originator:   selfonion,
 				OriginatorId: selfonion.Id,
 				PostedAt:     time.Now(),
 				PublishedAt:  time.Now(),
@@ -248,6 +265,7 @@ func main() {
 				}
 			}
 			fmt.Printf("adding post to circles: ")
+			dbconn.SignPost(&post)
 			dbconn.AddOrUpdatePost(&post)
 
 			for _, c := range circs {
@@ -276,9 +294,10 @@ func main() {
 				PostedAt:     time.Now(),
 				PublishedAt:  time.Now(),
 				ParentId:     *id,
+				ParentHash:   parentPost.Hash,
 				Published:    true,
 			}
-			post.CalcHash()
+			dbconn.SignPost(&post)
 			dbconn.Save(&post)
 			dbconn.RedirectComment(&post)
 
@@ -337,16 +356,36 @@ func main() {
 
 		case "key2onion":
 			logger.AssertError(len(*keyfile) > 0, "please provide a valid onion address")
-			key := crypto.ReadKey(*keyfile)
-			onion := crypto.GetOnionAddress(&key.PublicKey)
-			fmt.Println(onion)
+			identity, err := crypto.ReadIdentity(*keyfile)
+			logger.ConditionalError(err, "could not read key")
+			fmt.Println(identity.Onion())
+
+		case "gen-v3-key":
+			// writes a new ed25519 key as ssn_key.pem and in Tor's format to
+			// the directory given with -key, Tor gets the hs_ed25519_* files
+			logger.AssertError(len(*keyfile) > 0, "please provide a directory for the key")
+			edKey, err := crypto.GenerateEd25519Key()
+			logger.ConditionalError(err, "could not generate key")
+			writeV3Keys(*keyfile, edKey)
+			fmt.Println(crypto.GetOnionAddressV3(edKey.Public().(ed25519.PublicKey)))
+
+		case "migrate-v3":
+			// moves an existing v2 node to a new v3 onion, the keys for Tor
+			// are written to the directory given with -key
+			logger.AssertError(len(*keyfile) > 0, "please provide a directory for the key")
+			edKey, err := crypto.GenerateEd25519Key()
+			logger.ConditionalError(err, "could not generate key")
+			writeV3Keys(*keyfile, edKey)
+			err = dbconn.MigrateIdentity(edKey)
+			logger.ConditionalError(err, "could not migrate identity")
+			fmt.Printf("moved to %s, install the keys in %s as hidden service directory\n",
+				dbconn.GetSelfOnion().Onion, *keyfile)
 
 		case "auth":
 			logger.AssertError(len(*onion) > 0, "please provide a valid onion address")
 			logger.AssertError(conn.Established, "no connection established, use command \"conn\"")
 
-			privKey := dbconn.GetKey()
-			if err := conn.Auth(privKey); err != nil {
+			if err := conn.Auth(dbconn.GetIdentity(), &dbconn); err != nil {
 				fmt.Printf("error with auth command: %s\n", err.Error())
 				return
 			}
@@ -472,3 +511,14 @@ func main() {
 		}
 	}
 }
+
+func writeV3Keys(dir string, key ed25519.PrivateKey) {
+	err := os.MkdirAll(dir, 0700)
+	logger.ConditionalError(err, "could not create key directory")
+	err = crypto.WriteTorV3Keys(dir, key)
+	logger.ConditionalError(err, "could not write tor keys")
+	pemKey, err := crypto.Ed25519Key2Pem(key)
+	logger.ConditionalError(err, "could not encode key")
+	err = ioutil.WriteFile(filepath.Join(dir, "ssn_key.pem"), pemKey, 0600)
+	logger.ConditionalError(err, "could not write key")
+}
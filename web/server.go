@@ -34,8 +34,10 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"../client"
 	"../logger"
 	"./uictrl"
+	"flag"
 	"github.com/ant0ine/go-json-rest/rest"
 	"log"
 	"net/http"
@@ -43,6 +45,11 @@ import (
 )
 
 func main() {
+	// the api triggers contacts, through tor
+	tor := client.NewTorTransport()
+	client.TorFlags(tor)
+	flag.Parse()
+	client.DefaultTransport = tor
 
 	api := uictrl.Api{}
 	api.InitDB()
@@ -60,6 +67,17 @@ func main() {
 		rest.RouteObjectMethod("PUT", "/contacts/:id", &api, "PutContact"),
 		rest.RouteObjectMethod("POST", "/contacts", &api, "CreateContact"),
 		rest.RouteObjectMethod("DELETE", "/contacts/:id", &api, "DeleteContact"),
+		rest.RouteObjectMethod("GET", "/contacts/:id/delivery", &api, "GetContactDelivery"),
+		rest.RouteObjectMethod("POST", "/contacts/:id/accept", &api, "AcceptContact"),
+		rest.RouteObjectMethod("POST", "/contacts/:id/decline", &api, "DeclineContact"),
+		rest.RouteObjectMethod("GET", "/deliveries", &api, "GetAllDeliveries"),
+		rest.RouteObjectMethod("GET", "/tor", &api, "GetTor"),
+
+		//Direct messages
+		rest.RouteObjectMethod("GET", "/conversations", &api, "GetAllConversations"),
+		rest.RouteObjectMethod("GET", "/conversations/:id/messages", &api, "GetConversationMessages"),
+		rest.RouteObjectMethod("PUT", "/conversations/:id/read", &api, "MarkConversationRead"),
+		rest.RouteObjectMethod("POST", "/messages", &api, "SendMessage"),
 
 		//Circles
 		rest.RouteObjectMethod("GET", "/circles", &api, "GetAllCircles"),
@@ -70,8 +88,14 @@ func main() {
 		//Posts
 		rest.RouteObjectMethod("GET", "/posts", &api, "GetAllPosts"),
 		rest.RouteObjectMethod("GET", "/posts/:id", &api, "GetPost"),
+		rest.RouteObjectMethod("GET", "/posts/:id/revisions", &api, "GetPostRevisions"),
 		rest.RouteObjectMethod("POST", "/posts", &api, "CreatePost"),
+		rest.RouteObjectMethod("PUT", "/posts/:id", &api, "UpdatePost"),
+		rest.RouteObjectMethod("POST", "/posts/:id/reshare", &api, "ResharePost"),
 		rest.RouteObjectMethod("DELETE", "/posts/:id", &api, "DeletePost"),
+		rest.RouteObjectMethod("GET", "/posts/:id/reactions", &api, "GetPostReactions"),
+		rest.RouteObjectMethod("POST", "/posts/:id/reactions", &api, "AddReaction"),
+		rest.RouteObjectMethod("DELETE", "/posts/:id/reactions/:kind", &api, "RemoveReaction"),
 
 		//Comments
 		rest.RouteObjectMethod("GET", "/comments", &api, "GetAllComments"),
@@ -97,6 +121,12 @@ func main() {
 		rest.RouteObjectMethod("GET", "/authors/:id", &api, "GetAuthor"),
 		rest.RouteObjectMethod("GET", "/originators/:id", &api, "GetOriginator"),
 		rest.RouteObjectMethod("GET", "/onions/:id", &api, "GetOnion"),
+		rest.RouteObjectMethod("POST", "/onions/:id/repin", &api, "RepinOnion"),
+		rest.RouteObjectMethod("POST", "/onions/:id/migrate", &api, "MigrateOnion"),
+
+		//Security Events
+		rest.RouteObjectMethod("GET", "/security_events", &api, "GetAllSecurityEvents"),
+		rest.RouteObjectMethod("PUT", "/security_events/:id", &api, "AcknowledgeSecurityEvent"),
 
 		//rest.RouteObjectMethod("POST",   "/authors",        &api, "CreateOnion"),
 		//rest.RouteObjectMethod("POST",   "/originator",     &api, "CreateOnion"),
@@ -130,6 +160,10 @@ func main() {
 		api.PendingContactsHandler(w, r)
 	})
 
+	http.HandleFunc("/pending_security", func(w http.ResponseWriter, r *http.Request) {
+		api.PendingSecurityHandler(w, r)
+	})
+
 	http.Handle("/api/", http.StripPrefix("/api", &handler))
 	http.Handle("/", http.FileServer(http.Dir(".")))
 
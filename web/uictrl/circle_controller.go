@@ -228,8 +228,11 @@ func (api *Api) DeleteCircle(w rest.ResponseWriter, r *rest.Request) {
 		}
 	}
 
+	// its contacts lose access to the profile entries shared with it
+	api.TouchCircleProfiles(&circle)
 	api.Model(&circle).Association("Contacts").Clear()
 	api.Model(&circle).Association("Posts").Clear()
+	api.Model(&circle).Association("Profiles").Clear()
 	api.Delete(&circle)
 
 	w.WriteHeader(http.StatusOK)
@@ -85,6 +85,7 @@ type CommentResponse struct {
 	AuthorId          int64     `json:"author"`
 	ParentId          int64     `json:"post"`
 	ProfilePictureId  int64     `json:"profilePictureId"`
+	Verified          bool      `json:"verified"`
 }
 
 func (api *Api) GetAllComments(w rest.ResponseWriter, r *rest.Request) {
@@ -132,6 +133,7 @@ func (api *Api) GetAllComments(w rest.ResponseWriter, r *rest.Request) {
 			AuthorId:          post.AuthorId,
 			ParentId:          post.ParentId,
 			ProfilePictureId:  api.GetProfilePictureId(post.AuthorId),
+			Verified:          post.Verified,
 		}
 
 		commentResponses = append(commentResponses, commentResponse)
@@ -210,7 +212,8 @@ func (api *Api) CreateComment(w rest.ResponseWriter, r *rest.Request) {
 		}
 	}
 
-	newComment.CalcHash()
+	newComment.ParentHash = parentPost.Hash
+	api.SignPost(&newComment)
 
 	if api.Create(&newComment).Error != nil {
 		log.Println(gormSaveError("comment"), err)
@@ -253,6 +256,7 @@ func (api *Api) CreateComment(w rest.ResponseWriter, r *rest.Request) {
 		AuthorId:          newComment.AuthorId,
 		ParentId:          newComment.ParentId,
 		ProfilePictureId:  api.GetProfilePictureId(newComment.AuthorId),
+		Verified:          newComment.Verified,
 	}
 	w.WriteJson(GetCommentWrapper{resp})
 }
@@ -293,6 +297,7 @@ func (api *Api) GetComment(w rest.ResponseWriter, r *rest.Request) {
 		AuthorId:          comment.AuthorId,
 		ParentId:          comment.ParentId,
 		ProfilePictureId:  api.GetProfilePictureId(comment.AuthorId),
+		Verified:          comment.Verified,
 	}
 
 	w.WriteJson(
@@ -325,11 +330,21 @@ func (api *Api) DeleteComment(w rest.ResponseWriter, r *rest.Request) {
 		}
 	}
 
-	if err := api.Delete(&post).Error; err != nil {
+	if err := api.SSNDB.DeletePost(&post); err != nil {
 		log.Println(gormDeleteError("post"), err)
 		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
 		return
 	}
 
+	// trigger all contacts to whom it may concern, like in CreateComment
+	circles := api.GetPostCircles(&post)
+	client.TriggerCircles(&api.SSNDB, circles)
+
+	if post.OriginatorId != api.GetSelfOnion().Id {
+		var originator db.Onion
+		api.First(&originator, post.OriginatorId)
+		go client.TriggerHandling(&api.SSNDB, []db.Onion{originator})
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
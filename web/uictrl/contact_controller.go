@@ -62,6 +62,12 @@ type PostContactWrapper struct {
 	Contact db.EmberContactRequest `json:"contact"`
 }
 
+// the optional body of accept and decline
+type ContactResponseRequest struct {
+	Message string `json:"message"`
+	Block   bool   `json:"block"` // decline and block the contact
+}
+
 func (api *Api) CreateContact(w rest.ResponseWriter, r *rest.Request) {
 	_, err := api.validateAuthHeader(r.Request)
 
@@ -163,6 +169,8 @@ func (api *Api) PutContact(w rest.ResponseWriter, r *rest.Request) {
 	oldstatus := contact.Status
 	contact.Status = ec.Contact.Status
 
+	var oldCircles []db.Circle
+	api.Model(&contact).Related(&oldCircles, "Circles")
 	api.Model(&contact).Association("Circles").Clear()
 	// fill in circles
 	for idx, circIdStr := range ec.Contact.EmberCircles {
@@ -188,8 +196,14 @@ func (api *Api) PutContact(w rest.ResponseWriter, r *rest.Request) {
 	contact.Circles = circles
 	api.Save(&contact)
 
+	// the contact loses access to the profile entries of circles it left
+	for _, circle := range circle_difference(oldCircles, circles) {
+		api.TouchCircleProfiles(&circle)
+	}
+
 	if oldstatus == db.OPEN && ec.Contact.Status == db.SUCCESS {
-		client.SetContactToSuccess(&contact, &api.SSNDB)
+		contact.Response = db.ACCEPTED
+		api.SSNDB.SetContactToSuccess(&contact)
 	}
 
 }
@@ -284,6 +298,7 @@ func (api *Api) DeleteContact(w rest.ResponseWriter, r *rest.Request) {
 
 	api.Model(&contact).Association("Circles").Clear()
 	api.Delete(&contact)
+	api.Exec("DELETE FROM profile_shares WHERE contact_id = ?", contact.Id)
 
 	// remove old contact circle
 	ccirc := db.Circle{
@@ -330,3 +345,73 @@ func (api *Api) GetContact(w rest.ResponseWriter, r *rest.Request) {
 		},
 	)
 }
+
+// accepts the contact request of an OPEN contact
+func (api *Api) AcceptContact(w rest.ResponseWriter, r *rest.Request) {
+	api.respondToContact(w, r, true)
+}
+
+// declines the contact request of an OPEN contact, blocks it with
+// {"block": true}
+func (api *Api) DeclineContact(w rest.ResponseWriter, r *rest.Request) {
+	api.respondToContact(w, r, false)
+}
+
+func (api *Api) respondToContact(w rest.ResponseWriter, r *rest.Request, accept bool) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	_id := r.PathParam("id")
+	id, err := strconv.ParseInt(_id, 10, 64)
+	if err != nil {
+		rest.Error(w, INVALIDCONTACT, http.StatusBadRequest)
+		return
+	}
+
+	var req ContactResponseRequest
+	if r.ContentLength > 0 {
+		if err = r.DecodeJsonPayload(&req); err != nil {
+			log.Println(jsonDecodeError("contact response request"), err)
+			rest.Error(w, INVALIDJSON, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var contact db.Contact
+	if err = api.First(&contact, id).Error; err != nil {
+		rest.NotFound(w, r)
+		return
+	}
+	if contact.Status != db.OPEN {
+		rest.Error(w, "Contact has no open request", http.StatusConflict)
+		return
+	}
+	api.Model(&contact).Related(&contact.Onion, "Onion")
+
+	contact.ResponseMessage = req.Message
+	if accept {
+		contact.Response = db.ACCEPTED
+		api.SSNDB.SetContactToSuccess(&contact)
+	} else {
+		contact.Response = db.DECLINED_REQUEST
+		contact.Status = db.DECLINED
+		if req.Block {
+			contact.Response = db.BLOCKED_REQUEST
+			contact.Status = db.BLOCKED
+		}
+		if err = api.Save(&contact).Error; err != nil {
+			log.Println(gormSaveError("contact"), err)
+			rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// the response is sent with the next sync of the contact, retried by
+	// the periodic ones until it is delivered
+	client.GetSyncScheduler(api.GetIdentity()).Trigger(&contact)
+
+	w.WriteJson(&GetContactWrapper{Contact: db.EmberContactResponse{Contact: contact}})
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package uictrl
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"../../core/db"
+	"github.com/ant0ine/go-json-rest/rest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// the TRIGGER we owe a contact, see SSNDB.QueueTrigger
+type DeliveryResponse struct {
+	Id          int64     `json:"id"`
+	ContactId   int64     `json:"contact"`
+	OnionId     int64     `json:"onion"`
+	State       string    `json:"state"`
+	Attempts    uint32    `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+	QueuedAt    time.Time `json:"queued_at"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+type GetAllDeliveriesWrapper struct {
+	Deliveries []DeliveryResponse `json:"deliveries"`
+}
+
+type GetDeliveryWrapper struct {
+	Delivery DeliveryResponse `json:"delivery"`
+}
+
+func newDeliveryResponse(delivery db.Delivery) DeliveryResponse {
+	return DeliveryResponse{
+		Id:          delivery.Id,
+		ContactId:   delivery.ContactId,
+		OnionId:     delivery.OnionId,
+		State:       db.DeliveryStateString(delivery.State),
+		Attempts:    delivery.Attempts,
+		NextAttempt: time.Unix(delivery.NextAttempt, 0),
+		LastError:   delivery.LastError,
+		QueuedAt:    delivery.QueuedAt,
+		DeliveredAt: delivery.DeliveredAt,
+	}
+}
+
+func (api *Api) GetAllDeliveries(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	deliveries := api.GetDeliveries()
+	resp := GetAllDeliveriesWrapper{Deliveries: make([]DeliveryResponse, len(deliveries))}
+	for i, delivery := range deliveries {
+		resp.Deliveries[i] = newDeliveryResponse(delivery)
+	}
+	w.WriteJson(&resp)
+}
+
+// the delivery state of the last TRIGGER to a contact
+func (api *Api) GetContactDelivery(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	_id := r.PathParam("id")
+	id, err := strconv.ParseInt(_id, 10, 64)
+	if err != nil {
+		rest.Error(w, INVALIDCONTACT, http.StatusBadRequest)
+		return
+	}
+
+	for _, delivery := range api.GetDeliveries() {
+		if delivery.ContactId == id {
+			w.WriteJson(&GetDeliveryWrapper{Delivery: newDeliveryResponse(delivery)})
+			return
+		}
+	}
+	rest.NotFound(w, r)
+}
@@ -41,6 +41,7 @@ const (
 	INVALIDCONTACT = "Contact Invalid"
 	DUPLICATECIRC  = "Duplicate Circle"
 	INVALIDONION   = "Invalid Onion"
+	INVALIDID      = "Id Invalid"
 )
 
 func gormLoadError(resource string) string {
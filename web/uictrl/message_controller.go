@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package uictrl
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"../../client"
+	"../../core/db"
+	"github.com/ant0ine/go-json-rest/rest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type GetAllConversationsWrapper struct {
+	Conversations []db.Conversation `json:"conversations"`
+}
+
+type GetConversationWrapper struct {
+	Conversation db.Conversation `json:"conversation"`
+}
+
+type GetAllMessagesWrapper struct {
+	Messages []db.Message `json:"messages"`
+}
+
+type MessageRequest struct {
+	ContactId int64  `json:"contact"`
+	Body      string `json:"body"`
+}
+
+type PostMessageWrapper struct {
+	Message MessageRequest `json:"message"`
+}
+
+type GetMessageWrapper struct {
+	Message db.Message `json:"message"`
+}
+
+func (api *Api) GetAllConversations(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteJson(
+		&GetAllConversationsWrapper{
+			Conversations: api.GetConversations(),
+		},
+	)
+}
+
+// the conversation with the id of the request, writes the error if there is none
+func (api *Api) requestedConversation(w rest.ResponseWriter, r *rest.Request) (db.Conversation, bool) {
+	var conversation db.Conversation
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Conversation Invalid", http.StatusBadRequest)
+		return conversation, false
+	}
+	if api.First(&conversation, id).Error != nil {
+		rest.NotFound(w, r)
+		return conversation, false
+	}
+	return conversation, true
+}
+
+// the messages of a conversation, oldest first
+func (api *Api) GetConversationMessages(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	conversation, ok := api.requestedConversation(w, r)
+	if !ok {
+		return
+	}
+
+	messages := []db.Message{}
+	api.Where(&db.Message{ConversationId: conversation.Id}).Order("sent_at").Find(&messages)
+	w.WriteJson(
+		&GetAllMessagesWrapper{
+			Messages: messages,
+		},
+	)
+}
+
+func (api *Api) MarkConversationRead(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	conversation, ok := api.requestedConversation(w, r)
+	if !ok {
+		return
+	}
+
+	if err = api.SSNDB.MarkConversationRead(&conversation); err != nil {
+		log.Println(gormSaveError("conversation"), err)
+		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		return
+	}
+	conversation.ContactId = api.GetContactIdByOnionId(conversation.OnionId)
+	w.WriteJson(
+		&GetConversationWrapper{
+			Conversation: conversation,
+		},
+	)
+}
+
+// sends a direct message to a contact we are friends with
+func (api *Api) SendMessage(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	var req PostMessageWrapper
+	if err = r.DecodeJsonPayload(&req); err != nil {
+		log.Println(jsonDecodeError("send message request"), err)
+		rest.Error(w, INVALIDJSON, http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Message.Body) == "" {
+		rest.Error(w, "Message Empty", http.StatusBadRequest)
+		return
+	}
+
+	var contact db.Contact
+	if api.First(&contact, req.Message.ContactId).Error != nil || contact.Status != db.SUCCESS {
+		rest.Error(w, INVALIDCONTACT, http.StatusBadRequest)
+		return
+	}
+
+	msg, err := api.SSNDB.SendMessage(&contact, req.Message.Body)
+	if err != nil {
+		log.Println(gormSaveError("message"), err)
+		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		return
+	}
+
+	var onion db.Onion
+	api.First(&onion, contact.OnionId)
+	go client.TriggerHandling(&api.SSNDB, []db.Onion{onion})
+
+	w.WriteJson(
+		&GetMessageWrapper{
+			Message: msg,
+		},
+	)
+}
@@ -38,6 +38,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"../../core/crypto"
 	"../../core/db"
 	"github.com/ant0ine/go-json-rest/rest"
 )
@@ -317,6 +318,7 @@ func (api *Api) CreateOnion(w rest.ResponseWriter, r *rest.Request) {
 		w.WriteJson(onionWrapper)
 		return
 	} else {
+		onionWrapper.Onion.Version = uint8(crypto.OnionVersion(onionWrapper.Onion.Onion))
 		if err := api.Save(&onionWrapper.Onion).Error; err != nil {
 			rest.Error(w, "Could not create onion in db", http.StatusBadRequest)
 			return
@@ -326,6 +328,50 @@ func (api *Api) CreateOnion(w rest.ResponseWriter, r *rest.Request) {
 	}
 }
 
+// moves a contact to the new onion address it told the user, e.g. when it
+// moved from a v2 to a v3 onion. The body is {"onion": {"onion": "<new>"}}
+func (api *Api) MigrateOnion(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	_id := r.PathParam("id")
+	id, err := strconv.ParseInt(_id, 10, 64)
+	if err != nil {
+		rest.Error(w, INVALIDONION, http.StatusBadRequest)
+		return
+	}
+
+	onionWrapper := PostOnionWrapper{}
+	if err = r.DecodeJsonPayload(&onionWrapper); err != nil {
+		log.Println(jsonDecodeError("migrate onion request"), err)
+		rest.Error(w, INVALIDJSON, http.StatusBadRequest)
+		return
+	}
+
+	onion := db.Onion{}
+	if api.First(&onion, id).Error != nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	if !db.IsValidOnion(onionWrapper.Onion.Onion) {
+		rest.Error(w, INVALIDONION, http.StatusBadRequest)
+		return
+	}
+
+	onion, err = api.SSNDB.MigrateOnion(onion.Id, onionWrapper.Onion.Onion)
+	if err != nil {
+		log.Println(gormSaveError("onion"), err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteJson(&PostOnionWrapper{Onion: onion})
+}
+
 func (api *Api) GetOriginator(w rest.ResponseWriter, r *rest.Request) {
 	_, err := api.validateAuthHeader(r.Request)
 
@@ -54,6 +54,10 @@ type GetPostWrapper struct {
 	Post PostResponse `json:"posts"`
 }
 
+type GetPostRevisionsWrapper struct {
+	PostRevisions []db.PostRevision `json:"post_revisions"`
+}
+
 type PostWrapper struct {
 	Post CreatePostRequest `json:"post"`
 }
@@ -84,10 +88,32 @@ type PostResponse struct {
 	OriginatorId     int64     `json:"originator"`
 	AuthorId         int64     `json:"author"`
 	ProfilePictureId int64     `json:"profilePictureId"`
+	Verified         bool      `json:"verified"`
+	Revision         uint32    `json:"revision"`
+	EditedAt         time.Time `json:"editedAt"`
+	ReshareChain     []int64   `json:"reshareChain,omitempty"` // onions which reshared the post on its way to us
+	Reshared         bool      `json:"reshared"`               // we reshared it
 	CircleIds        []int64   `json:"circles,omitempty"`
 	CommentIds       []int64   `json:"comments,omitempty"`
 }
 
+type ReshareRequest struct {
+	CircleIds []string `json:"circles"`
+}
+
+type ReshareWrapper struct {
+	Reshare ReshareRequest `json:"reshare"`
+}
+
+// the onion ids of the reshare chain, the one nearest to the author first
+func (api *Api) reshareChain(post *db.Post) []int64 {
+	var ids []int64
+	for _, onion := range api.GetResharers(post) {
+		ids = append(ids, onion.Id)
+	}
+	return ids
+}
+
 func (api *Api) GetAllPosts(w rest.ResponseWriter, r *rest.Request) {
 	_, err := api.validateAuthHeader(r.Request)
 
@@ -131,6 +157,11 @@ func (api *Api) GetAllPosts(w rest.ResponseWriter, r *rest.Request) {
 			OriginatorId:     post.OriginatorId,
 			AuthorId:         post.AuthorId,
 			ProfilePictureId: api.GetProfilePictureId(post.AuthorId),
+			Verified:         post.Verified,
+			Revision:         post.Revision,
+			EditedAt:         post.EditedAt,
+			ReshareChain:     api.reshareChain(&post),
+			Reshared:         api.IsReshared(&post),
 		}
 
 		// Get Circles
@@ -268,7 +299,7 @@ func (api *Api) CreatePost(w rest.ResponseWriter, r *rest.Request) {
 	newPost.Author = author
 	newPost.Published = true
 
-	newPost.CalcHash()
+	api.SignPost(&newPost)
 
 	if api.Create(&newPost).Error != nil {
 		log.Println(gormSaveError("post"), err)
@@ -328,6 +359,11 @@ func (api *Api) GetPost(w rest.ResponseWriter, r *rest.Request) {
 		OriginatorId:     post.OriginatorId,
 		AuthorId:         post.AuthorId,
 		ProfilePictureId: api.GetProfilePictureId(post.AuthorId),
+		Verified:         post.Verified,
+		Revision:         post.Revision,
+		EditedAt:         post.EditedAt,
+		ReshareChain:     api.reshareChain(&post),
+		Reshared:         api.IsReshared(&post),
 	}
 
 	// Get Circles
@@ -373,6 +409,188 @@ func (api *Api) GetPost(w rest.ResponseWriter, r *rest.Request) {
 	)
 }
 
+// edits the message of one of our posts, the body is {"post": {"message": "..."}}
+func (api *Api) UpdatePost(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	_id := r.PathParam("id")
+	id, err := strconv.ParseInt(_id, 10, 64)
+	if err != nil {
+		rest.Error(w, INVALIDID, http.StatusBadRequest)
+		return
+	}
+
+	postRequest := PostWrapper{}
+	if err = r.DecodeJsonPayload(&postRequest); err != nil {
+		log.Println(jsonDecodeError("update post request"), err)
+		rest.Error(w, INVALIDJSON, http.StatusBadRequest)
+		return
+	}
+
+	post := db.Post{}
+	if err = api.First(&post, id).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			rest.NotFound(w, r)
+			return
+		} else {
+			log.Println(gormLoadError("post"), err)
+			rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if post.AuthorId != api.GetSelfOnion().Id {
+		rest.Error(w, "Only the author can edit a post", http.StatusForbidden)
+		return
+	}
+
+	if err = api.EditPost(&post, postRequest.Post.Message); err == db.ErrPostDeleted {
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(gormSaveError("post"), err)
+		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		return
+	}
+
+	// contacts who could see the post get the new revision
+	circles := api.GetPostCircles(&post)
+	client.TriggerCircles(&api.SSNDB, circles)
+
+	w.WriteJson(
+		&GetPostWrapper{
+			Post: PostResponse{
+				Id:               post.Id,
+				Message:          post.Message,
+				CreatedAt:        post.CreatedAt,
+				UpdatedAt:        post.UpdatedAt,
+				DeletedAt:        post.DeletedAt,
+				PostedAt:         post.PostedAt,
+				TTL:              post.TTL,
+				OriginatorId:     post.OriginatorId,
+				AuthorId:         post.AuthorId,
+				ProfilePictureId: api.GetProfilePictureId(post.AuthorId),
+				Verified:         post.Verified,
+				Revision:         post.Revision,
+				EditedAt:         post.EditedAt,
+			},
+		},
+	)
+}
+
+// shares a post we received with our circles, as long as its TTL allows
+func (api *Api) ResharePost(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Post Invalid", http.StatusBadRequest)
+		return
+	}
+
+	reshareRequest := ReshareWrapper{}
+	if err = r.DecodeJsonPayload(&reshareRequest); err != nil {
+		log.Println(jsonDecodeError("reshare post request"), err)
+		rest.Error(w, INVALIDJSON, http.StatusBadRequest)
+		return
+	}
+
+	err, circleIds := ToIds(reshareRequest.Reshare.CircleIds)
+	if err != nil || len(circleIds) == 0 {
+		log.Println("Cannot convert circle ids to int")
+		rest.Error(w, INVALIDJSON, http.StatusBadRequest)
+		return
+	}
+
+	post := db.Post{}
+	if err = api.First(&post, id).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			rest.NotFound(w, r)
+		} else {
+			log.Println(gormLoadError("post"), err)
+			rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var circles []db.Circle
+	for _, id := range circleIds {
+		circle := db.Circle{}
+		if err = api.Find(&circle, db.Circle{Id: id}).Error; err != nil {
+			rest.NotFound(w, r)
+			return
+		}
+		circles = append(circles, circle)
+	}
+
+	if err = api.SSNDB.ResharePost(&post, circles); err != nil {
+		rest.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	client.TriggerCircles(&api.SSNDB, circles)
+
+	w.WriteJson(
+		&GetPostWrapper{
+			Post: PostResponse{
+				Id:               post.Id,
+				Message:          post.Message,
+				CreatedAt:        post.CreatedAt,
+				UpdatedAt:        post.UpdatedAt,
+				DeletedAt:        post.DeletedAt,
+				PostedAt:         post.PostedAt,
+				TTL:              post.TTL,
+				OriginatorId:     post.OriginatorId,
+				AuthorId:         post.AuthorId,
+				ProfilePictureId: api.GetProfilePictureId(post.AuthorId),
+				Verified:         post.Verified,
+				Revision:         post.Revision,
+				EditedAt:         post.EditedAt,
+				ReshareChain:     api.reshareChain(&post),
+				Reshared:         true,
+			},
+		},
+	)
+}
+
+// the previous revisions of an edited post, oldest first
+func (api *Api) GetPostRevisions(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	_id := r.PathParam("id")
+	id, err := strconv.ParseInt(_id, 10, 64)
+
+	post := db.Post{}
+	if err = api.First(&post, id).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			rest.NotFound(w, r)
+			return
+		} else {
+			log.Println(gormLoadError("post"), err)
+			rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteJson(
+		&GetPostRevisionsWrapper{
+			PostRevisions: api.SSNDB.GetPostRevisions(post.Id),
+		},
+	)
+}
+
 func (api *Api) DeletePost(w rest.ResponseWriter, r *rest.Request) {
 	_, err := api.validateAuthHeader(r.Request)
 	if err != nil {
@@ -396,11 +614,15 @@ func (api *Api) DeletePost(w rest.ResponseWriter, r *rest.Request) {
 		}
 	}
 
-	if err := api.Delete(&post).Error; err != nil {
+	if err := api.SSNDB.DeletePost(&post); err != nil {
 		log.Println(gormDeleteError("post"), err)
 		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
 		return
 	}
 
+	// contacts who could see the post get its tombstone
+	circles := api.GetPostCircles(&post)
+	client.TriggerCircles(&api.SSNDB, circles)
+
 	w.WriteHeader(http.StatusOK)
 }
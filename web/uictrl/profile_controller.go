@@ -195,13 +195,13 @@ func (api *Api) DeleteProfile(w rest.ResponseWriter, r *rest.Request) {
 	var circles []db.Circle
 	api.Model(&profile).Related(&circles, "Circles")
 
-	if err := api.Unscoped().Delete(&profile).Error; err != nil {
+	if err := api.SSNDB.DeleteProfile(&profile); err != nil {
 		rest.Error(w, "Deleting profile failed", http.StatusInternalServerError)
 		return
 	}
 
 	if profile.OnionId == self.Id {
-		api.ProfileDeleted(circles)
+		client.TriggerCircles(&api.SSNDB, circles)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -248,8 +248,8 @@ func (api *Api) CreateProfile(w rest.ResponseWriter, r *rest.Request) {
 
 	newProfile := db.Profile{}
 
-	// if a profile with this key already exits update it
-	api.Where(db.Profile{OnionId: api.GetSelfOnion().Id, Key: profile.Key}).First(&newProfile)
+	// if a profile with this key already exits update it, a deleted one too
+	api.Unscoped().Where(db.Profile{OnionId: api.GetSelfOnion().Id, Key: profile.Key}).First(&newProfile)
 
 	newProfile.Key = profile.Key
 	newProfile.Value = profile.Value
@@ -257,8 +257,9 @@ func (api *Api) CreateProfile(w rest.ResponseWriter, r *rest.Request) {
 	newProfile.Onion = api.GetSelfOnion()
 	newProfile.OnionId = newProfile.Onion.Id
 	newProfile.ChangedAt = time.Now()
+	newProfile.DeletedAt = time.Time{}
 
-	if api.Save(&newProfile).Error != nil {
+	if api.Unscoped().Save(&newProfile).Error != nil {
 		log.Println(gormSaveError("profile"), err)
 		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
 		return
@@ -337,11 +338,16 @@ func (api *Api) PutProfile(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 	// overwrite updated fields
-	profile.Key = pw.Profile.Key
+	if profile.Key != pw.Profile.Key {
+		api.RenameProfile(&profile, pw.Profile.Key)
+	}
 	profile.Value = pw.Profile.Value
 	profile.ChangedAt = time.Now()
 	circles := make([]db.Circle, len(pw.Profile.CircleIds))
 
+	// contacts of circles we remove get a tombstone, the profile changed
+	var oldCircles []db.Circle
+	api.Model(&profile).Related(&oldCircles, "Circles")
 	api.Model(&profile).Association("Circles").Clear()
 	// fill in circles
 	for idx, circIdStr := range pw.Profile.CircleIds {
@@ -360,7 +366,7 @@ func (api *Api) PutProfile(w rest.ResponseWriter, r *rest.Request) {
 	}
 	profile.Circles = circles
 	api.Save(&profile)
-	client.TriggerCircles(&api.SSNDB, profile.Circles)
+	client.TriggerCircles(&api.SSNDB, append(profile.Circles, circle_difference(oldCircles, circles)...))
 }
 
 func (api *Api) ProfilePictureHandler(w http.ResponseWriter, r *http.Request) {
@@ -397,7 +403,7 @@ func (api *Api) ProfilePictureHandler(w http.ResponseWriter, r *http.Request) {
 
 			self := api.GetSelfOnion()
 			var profile db.Profile
-			api.Where(&db.Profile{Key: "picture", OnionId: self.Id}).First(&profile)
+			api.Unscoped().Where(&db.Profile{Key: "picture", OnionId: self.Id}).First(&profile)
 			picture, err := ioutil.ReadAll(part)
 			if err != nil {
 				log.Println("Failed to read profile image: ", err)
@@ -410,7 +416,8 @@ func (api *Api) ProfilePictureHandler(w http.ResponseWriter, r *http.Request) {
 			profile.Onion = self
 			profile.OnionId = self.Id
 			profile.ChangedAt = time.Now()
-			api.Save(&profile)
+			profile.DeletedAt = time.Time{}
+			api.Unscoped().Save(&profile)
 
 			var pubcirc db.Circle
 			api.Where(&db.Circle{Name: "Public"}).First(&pubcirc)
@@ -451,30 +458,8 @@ func (api *Api) DeleteProfilePicture(w rest.ResponseWriter, r *rest.Request) {
 	var circles []db.Circle
 	api.Model(&profilePicture).Related(&circles, "Circles")
 
-	api.Unscoped().Delete(&profilePicture)
-	api.ProfileDeleted(circles)
+	api.SSNDB.DeleteProfile(&profilePicture)
+	client.TriggerCircles(&api.SSNDB, circles)
 
 	w.WriteHeader(http.StatusOK)
 }
-
-func (api *Api) ProfileDeleted(circles []db.Circle) {
-	self := api.GetSelfOnion()
-	var dummy db.Profile
-	api.Where(&db.Profile{OnionId: self.Id, Key: ""}).First(&dummy)
-
-	var pubcirc db.Circle
-	api.Where(&db.Circle{Name: "Public"}).First(&pubcirc)
-
-	dummy.Value = "Deleted"
-	dummy.Key = ""
-	dummy.OnionId = self.Id
-	dummy.Onion = self
-	dummy.ChangedAt = time.Now()
-
-	api.Save(&dummy)
-	if err := api.Model(&pubcirc).Association("Profiles").Append(&dummy).Error; err != nil {
-		log.Println(gormSaveError("dummy profile"), err)
-	}
-
-	client.TriggerCircles(&api.SSNDB, circles)
-}
@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+package uictrl
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"../../client"
+	"../../core/db"
+	"github.com/ant0ine/go-json-rest/rest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type ReactionsResponse struct {
+	PostId int64          `json:"post"`
+	Counts map[string]int `json:"counts"`
+	Mine   []string       `json:"mine"` // the kinds we reacted with
+}
+
+type GetReactionsWrapper struct {
+	Reactions ReactionsResponse `json:"reactions"`
+}
+
+type ReactionRequest struct {
+	Kind string `json:"kind"`
+}
+
+type PostReactionWrapper struct {
+	Reaction ReactionRequest `json:"reaction"`
+}
+
+// the post or comment with the id of the request, writes the error if there
+// is none
+func (api *Api) requestedReactionPost(w rest.ResponseWriter, r *rest.Request) (db.Post, bool) {
+	var post db.Post
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Post Invalid", http.StatusBadRequest)
+		return post, false
+	}
+	if api.First(&post, id).Error != nil {
+		rest.NotFound(w, r)
+		return post, false
+	}
+	return post, true
+}
+
+func (api *Api) reactionsResponse(post *db.Post) *GetReactionsWrapper {
+	return &GetReactionsWrapper{
+		Reactions: ReactionsResponse{
+			PostId: post.Id,
+			Counts: api.GetReactionCounts(post),
+			Mine:   api.GetOwnReactions(post),
+		},
+	}
+}
+
+// the reactions to a post or comment, counted by its originator
+func (api *Api) GetPostReactions(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	post, ok := api.requestedReactionPost(w, r)
+	if !ok {
+		return
+	}
+	w.WriteJson(api.reactionsResponse(&post))
+}
+
+func (api *Api) AddReaction(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	post, ok := api.requestedReactionPost(w, r)
+	if !ok {
+		return
+	}
+
+	var req PostReactionWrapper
+	if err = r.DecodeJsonPayload(&req); err != nil {
+		log.Println(jsonDecodeError("reaction"), err)
+		rest.Error(w, INVALIDJSON, http.StatusBadRequest)
+		return
+	}
+	if req.Reaction.Kind == "" {
+		req.Reaction.Kind = db.REACTION_LIKE
+	}
+	api.react(w, &post, req.Reaction.Kind, false)
+}
+
+func (api *Api) RemoveReaction(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	post, ok := api.requestedReactionPost(w, r)
+	if !ok {
+		return
+	}
+	api.react(w, &post, r.PathParam("kind"), true)
+}
+
+// stores our reaction and tells whom it concerns: the circles of the post
+// if we originated it, the originator otherwise
+func (api *Api) react(w rest.ResponseWriter, post *db.Post, kind string, remove bool) {
+	if !db.ValidReactionKind(kind) {
+		rest.Error(w, "Reaction Invalid", http.StatusBadRequest)
+		return
+	}
+	if err := api.React(post, kind, remove); err != nil {
+		log.Println(gormSaveError("reaction"), err)
+		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		return
+	}
+
+	if post.OriginatorId == api.GetSelfOnion().Id {
+		client.TriggerCircles(&api.SSNDB, api.GetPostCircles(post))
+	} else {
+		var originator db.Onion
+		api.First(&originator, post.OriginatorId)
+		go client.TriggerHandling(&api.SSNDB, []db.Onion{originator})
+	}
+
+	w.WriteJson(api.reactionsResponse(post))
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2014
+  Dario Brandes
+  Thies Johannsen
+  Paul Kröger
+  Sergej Mann
+  Roman Naumann
+  Sebastian Thobe
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+/* -*- Mode: Go; indent-tabs-mode: t; c-basic-offset: 4; tab-width: 4 -*- */
+
+package uictrl
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"../../core/db"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type GetAllSecurityEventsWrapper struct {
+	SecurityEvents []db.SecurityEvent `json:"security_events"`
+}
+
+type GetSecurityEventWrapper struct {
+	SecurityEvent db.SecurityEvent `json:"security_event"`
+}
+
+func (api *Api) GetAllSecurityEvents(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	requestedIds, err := GetRequestedIds(r)
+	if err != nil {
+		log.Println("Parsing requested ids failed", err)
+		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		return
+	}
+
+	events := []db.SecurityEvent{}
+
+	if len(requestedIds) > 0 {
+		err = api.Where(requestedIds).Order("id desc").Find(&events).Error
+	} else {
+		err = api.Order("id desc").Find(&events).Error
+	}
+	if err != nil {
+		if err != gorm.RecordNotFound {
+			log.Println(gormLoadError("security events"), err)
+			rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteJson(
+		&GetAllSecurityEventsWrapper{
+			SecurityEvents: events,
+		},
+	)
+}
+
+// marks a security event as seen by the user
+func (api *Api) AcknowledgeSecurityEvent(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	_id := r.PathParam("id")
+	id, err := strconv.ParseInt(_id, 10, 64)
+
+	event := db.SecurityEvent{}
+	if err = api.First(&event, id).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			rest.NotFound(w, r)
+			return
+		} else {
+			log.Println(gormLoadError("security event"), err)
+			rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	event.Acknowledged = true
+	if err = api.Save(&event).Error; err != nil {
+		log.Println(gormSaveError("security event"), err)
+		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(
+		&GetSecurityEventWrapper{
+			SecurityEvent: event,
+		},
+	)
+}
+
+// accepts the changed public key of a contact, see SSNDB.RepinPublicKey
+func (api *Api) RepinOnion(w rest.ResponseWriter, r *rest.Request) {
+	_, err := api.validateAuthHeader(r.Request)
+	if err != nil {
+		rest.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	_id := r.PathParam("id")
+	id, err := strconv.ParseInt(_id, 10, 64)
+	if err != nil {
+		rest.Error(w, INVALIDONION, http.StatusBadRequest)
+		return
+	}
+
+	onion := db.Onion{}
+	if api.First(&onion, id).Error != nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	if err = api.RepinPublicKey(onion.Id); err != nil {
+		log.Println(gormSaveError("onion"), err)
+		rest.Error(w, INTERNALERROR, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
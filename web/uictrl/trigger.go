@@ -75,7 +75,7 @@ func (api *Api) SyncHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, INVALIDAUTH, http.StatusUnauthorized)
 		return
 	}
-	client.SyncAllContacts(api.GetKey())
+	client.SyncAllContacts(api.GetIdentity())
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -100,3 +100,14 @@ func (api *Api) PendingContactsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("pending", fmt.Sprint(api.ContactsPending()))
 	w.Header().Write(w)
 }
+
+func (api *Api) PendingSecurityHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := api.validateAuthHeader(r)
+	if err != nil {
+		http.Error(w, INVALIDAUTH, http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Add("pending", fmt.Sprint(api.SecurityPending()))
+	w.Header().Write(w)
+}
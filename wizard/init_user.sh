@@ -63,34 +63,35 @@ logger -s "INFO: adding ssn user"
 
 adduser --gecos "" --disabled-password ssn_${NAME}
 
-logger -s "INFO: writing torrc"
+logger -s "INFO: generating v3 onion key"
 
-cat <<EOF > /etc/tor/torrc
-HiddenServiceDir /var/lib/tor/ssn_${NAME}/
-HiddenServicePort 3141 127.0.0.1:3141
+# we generate the ed25519 key ourselves, Tor only stores it in a form the
+# key cannot be read back from
+su -l ssn_${NAME} <<EOF
+/home/pi/zwiebelnetz/test/client_main -cmd gen-v3-key -key \$HOME/keys
 EOF
 
-mkdir -p /var/lib/tor
-chown debian-tor:debian-tor /var/lib/tor
-
-service tor restart
-
-# wait for private key and onion-address to be generated
-while [ ! -f "/var/lib/tor/ssn_${NAME}/private_key" -o ! -f "/var/lib/tor/ssn_${NAME}/hostname" ]; do
-  logger -s "INFO: Tor still generating private key..."
-  sleep 1s
-done
-
+# syncerd adds the onion through the control port of tor with the key of
+# its database, tor itself never stores it
+if ! grep -q "^ControlPort" /etc/tor/torrc; then
+  logger -s "INFO: enabling the control port of tor"
+  cat <<EOF >> /etc/tor/torrc
+ControlPort 9051
+CookieAuthentication 1
+CookieAuthFileGroupReadable 1
+EOF
+  service tor restart
+fi
 
-cp /var/lib/tor/ssn_${NAME}/private_key /home/ssn_${NAME}/
-chown ssn_${NAME}:ssn_${NAME}  /home/ssn_${NAME}/private_key
+# to read the cookie of the control port
+adduser ssn_${NAME} debian-tor
 
-onion_addr=$(cat /var/lib/tor/ssn_${NAME}/hostname)
+onion_addr=$(cat /home/ssn_${NAME}/keys/hostname)
 
 logger -s "initializing database as user ssn_${NAME}..."
 su -l ssn_${NAME} <<EOF
-/home/pi/zwiebelnetz/test/client_main -cmd init -nickname ${NAME} -onion ${onion_addr} -password ${PW} -key \$HOME/private_key
-rm \$HOME/private_key
+/home/pi/zwiebelnetz/test/client_main -cmd init -nickname ${NAME} -onion ${onion_addr} -password ${PW} -key \$HOME/keys/ssn_key.pem
+rm -r \$HOME/keys
 EOF
 
 logger -s "...finished initializing database, exiting..."